@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"github.com/wfscot/tcp-delay-proxy/proxy"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the admin API served with --admin-addr. GET /config returns the delay settings of every proxy and PUT /config
+// changes them. durations are strings as in the config file. fields left out of a PUT body keep their current value.
+// new sessions use the new settings right away; with ?existing=true or ?apply=existing, running sessions pick them up
+// for chunks read from then on, while chunks already queued keep their due times. for example:
+//
+//	curl -X PUT -d '{"upDelay": "200ms", "downDelay": "200ms"}' 'localhost:7070/config?existing=true'
+//
+// ?listen=addr limits a PUT to the proxy with that listen address. an upstreamAddr in the body repoints that proxy:
+// sessions accepted from then on dial the new address, while running ones keep their connections. it has to name a
+// single proxy unless only one is running.
+//
+// GET /sessions lists the running sessions of every proxy. POST /sessions/{id}/pause stops a running session from
+// writing in either direction until POST /sessions/{id}/resume.
+
+// the settings of a single proxy as returned by GET /config
+type adminProxyConfig struct {
+	Listen         string `json:"listen"`
+	Upstream       string `json:"upstream"`
+	UpDelay        string `json:"upDelay"`
+	DownDelay      string `json:"downDelay"`
+	RandomizeDelay bool   `json:"randomizeDelay"`
+	// the delay schedule's active window, if any. sessions started now get its delays instead of the ones above.
+	ScheduleWindow string `json:"scheduleWindow,omitempty"`
+}
+
+type adminConfig struct {
+	Proxies []adminProxyConfig `json:"proxies"`
+}
+
+// the body of PUT /config. pointers distinguish fields that were left out.
+type adminConfigUpdate struct {
+	UpDelay        *string `json:"upDelay"`
+	DownDelay      *string `json:"downDelay"`
+	RandomizeDelay *bool   `json:"randomizeDelay"`
+	UpstreamAddr   *string `json:"upstreamAddr"`
+}
+
+type adminSessions struct {
+	Sessions []dumpedSession `json:"sessions"`
+}
+
+type adminHandler struct {
+	runner *proxyRunner
+	udp    bool
+}
+
+func newAdminHandler(runner *proxyRunner, udp bool) http.Handler {
+	h := &adminHandler{runner: runner, udp: udp}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/config", h.serveConfig)
+	mux.HandleFunc("/sessions", h.serveSessions)
+	mux.HandleFunc("/sessions/", h.serveSession)
+	return mux
+}
+
+func (h *adminHandler) serveConfig(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.writeConfig(w)
+
+	case http.MethodPut:
+		applyExisting := false
+		if v := r.URL.Query().Get("existing"); v != "" {
+			var err error
+			applyExisting, err = strconv.ParseBool(v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid existing parameter: %s", err), http.StatusBadRequest)
+				return
+			}
+		}
+		// apply=existing is the same as existing=true, and apply=new, the default, as existing=false
+		switch v := r.URL.Query().Get("apply"); v {
+		case "":
+		case "existing", "new":
+			if r.URL.Query().Get("existing") != "" && applyExisting != (v == "existing") {
+				http.Error(w, "apply and existing parameters contradict each other", http.StatusBadRequest)
+				return
+			}
+			applyExisting = v == "existing"
+		default:
+			http.Error(w, fmt.Sprintf("invalid apply parameter %q. expected existing or new", v), http.StatusBadRequest)
+			return
+		}
+
+		var update adminConfigUpdate
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&update); err != nil {
+			http.Error(w, fmt.Sprintf("invalid body: %s", err), http.StatusBadRequest)
+			return
+		}
+		if err := h.apply(update, applyExisting, r.URL.Query().Get("listen")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.writeConfig(w)
+
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// validates the whole update before applying it to every proxy, or the one listening on listen if given, so that a
+// bad request changes nothing
+func (h *adminHandler) apply(update adminConfigUpdate, applyExisting bool, listen string) error {
+	var upDelay, downDelay *time.Duration
+	durations := []struct {
+		field string
+		value *string
+		dst   **time.Duration
+	}{
+		{"upDelay", update.UpDelay, &upDelay},
+		{"downDelay", update.DownDelay, &downDelay},
+	}
+	for _, d := range durations {
+		if d.value == nil {
+			continue
+		}
+		v, err := time.ParseDuration(*d.value)
+		if err != nil {
+			return fmt.Errorf("%s: %s", d.field, err)
+		}
+		if v < 0 {
+			return fmt.Errorf("%s: must not be negative", d.field)
+		}
+		*d.dst = &v
+	}
+	if h.udp && update.RandomizeDelay != nil && *update.RandomizeDelay {
+		return errors.New("randomizeDelay: not supported with --udp")
+	}
+
+	proxies := h.runner.active()
+	if listen != "" {
+		var selected []*runningProxy
+		for _, rp := range proxies {
+			if rp.def.listenAddr == listen {
+				selected = append(selected, rp)
+			}
+		}
+		if len(selected) == 0 {
+			return fmt.Errorf("no proxy listening on %s", listen)
+		}
+		proxies = selected
+	}
+	if update.UpstreamAddr != nil {
+		if err := validateUpstreamAddr(*update.UpstreamAddr); err != nil {
+			return fmt.Errorf("upstreamAddr: %s", err)
+		}
+		if len(proxies) > 1 {
+			return fmt.Errorf("upstreamAddr: %d proxies are running. pick one with ?listen=", len(proxies))
+		}
+		for _, rp := range proxies {
+			if _, ok := rp.srv.(proxy.UpstreamConfigurable); !ok {
+				return fmt.Errorf("proxy %s doesn't support changing the upstream", rp.def.listenAddr)
+			}
+		}
+	}
+	// a body with just the upstream leaves the delays alone
+	changeDelays := update.UpstreamAddr == nil || update.UpDelay != nil || update.DownDelay != nil || update.RandomizeDelay != nil
+	if changeDelays {
+		for _, rp := range proxies {
+			if _, ok := rp.srv.(proxy.DelayConfigurable); !ok {
+				return fmt.Errorf("proxy %s doesn't support changing delays", rp.def.listenAddr)
+			}
+		}
+	}
+
+	for _, rp := range proxies {
+		if update.UpstreamAddr != nil {
+			uc := rp.srv.(proxy.UpstreamConfigurable)
+			log.Info().Str("listenAddr", rp.def.listenAddr).Str("oldUpstreamAddr", uc.UpstreamAddr()).Str("upstreamAddr", *update.UpstreamAddr).
+				Msg("changed upstream via admin API. new sessions use it.")
+			uc.SetUpstreamAddr(*update.UpstreamAddr)
+		}
+		if !changeDelays {
+			continue
+		}
+		dc := rp.srv.(proxy.DelayConfigurable)
+		settings := dc.DelaySettings()
+		if upDelay != nil {
+			settings.UpDelay = *upDelay
+		}
+		if downDelay != nil {
+			settings.DownDelay = *downDelay
+		}
+		if update.RandomizeDelay != nil {
+			settings.RandomizeDelay = *update.RandomizeDelay
+		}
+		dc.SetDelaySettings(settings, applyExisting)
+		log.Info().Str("listenAddr", rp.def.listenAddr).Dur("upDelay", settings.UpDelay).Dur("downDelay", settings.DownDelay).
+			Bool("randomizeDelay", settings.RandomizeDelay).Bool("applyExisting", applyExisting).Msg("changed delays via admin API")
+	}
+	return nil
+}
+
+func (h *adminHandler) serveSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(adminSessions{Sessions: collectSessions(h.runner, time.Now())})
+}
+
+// handles /sessions/{id}/pause and /sessions/{id}/resume
+func (h *adminHandler) serveSession(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/sessions/"), "/")
+	if len(parts) != 2 || (parts[1] != "pause" && parts[1] != "resume") {
+		http.NotFound(w, r)
+		return
+	}
+	id := parts[0]
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	for _, rp := range h.runner.active() {
+		sp, ok := rp.srv.(proxy.SessionPauser)
+		if !ok {
+			continue
+		}
+		var snapshot proxy.SessionSnapshot
+		if parts[1] == "pause" {
+			snapshot, ok = sp.PauseSession(id)
+		} else {
+			snapshot, ok = sp.ResumeSession(id)
+		}
+		if !ok {
+			continue
+		}
+		log.Info().Str("listenAddr", rp.def.listenAddr).Str("sessionId", id).Str("clientAddr", snapshot.ClientAddr).
+			Bool("paused", snapshot.Paused).Dur("pausedDuration", snapshot.PausedDuration).Msgf("%sd session via admin API", parts[1])
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(describeSession(rp, snapshot, time.Now()))
+		return
+	}
+	http.Error(w, fmt.Sprintf("no running session %q", id), http.StatusNotFound)
+}
+
+func (h *adminHandler) writeConfig(w http.ResponseWriter) {
+	proxies := h.runner.active()
+	cfg := adminConfig{Proxies: make([]adminProxyConfig, 0, len(proxies))}
+	for _, rp := range proxies {
+		cfg.Proxies = append(cfg.Proxies, describeProxy(rp))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cfg)
+}
+
+// returns the current settings of a proxy
+func describeProxy(rp *runningProxy) adminProxyConfig {
+	pc := adminProxyConfig{Listen: rp.def.listenAddr, Upstream: rp.upstreamAddr()}
+	if dc, ok := rp.srv.(proxy.DelayConfigurable); ok {
+		settings := dc.DelaySettings()
+		pc.UpDelay = settings.UpDelay.String()
+		pc.DownDelay = settings.DownDelay.String()
+		pc.RandomizeDelay = settings.RandomizeDelay
+	}
+	if sr, ok := rp.srv.(proxy.StatsReporter); ok {
+		pc.ScheduleWindow = sr.Stats().ScheduleWindow
+	}
+	return pc
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/wfscot/tcp-delay-proxy/proxy"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defines the config file format used with --config.
+// the file is JSON and contains a list of proxies, each of which results in its own server. durations are given as
+// strings (1s, 100ms, etc.). for example:
+//
+//	{
+//	  "proxies": [
+//	    {"listen": "127.0.0.1:8080", "upstream": "db:5432", "upDelay": "100ms", "downDelay": "100ms"},
+//	    {"listen": "8081", "upstream": "cache:6379", "upDelay": "50ms", "randomizeDelay": true}
+//	  ]
+//	}
+//
+// an optional schedule gives time windows of the day, in local time, with their own delays. they apply to all proxies
+// of the file, replacing the delays of sessions started within a window. windows may wrap around midnight but must
+// not overlap. with an interval, the schedule is evaluated again at that interval and running sessions pick up the
+// delays of a new window. for example:
+//
+//	  "schedule": {
+//	    "interval": "1m",
+//	    "windows": [
+//	      {"window": "09:00-17:00", "upDelay": "200ms", "downDelay": "200ms"},
+//	      {"window": "22:00-06:00", "upDelay": "20ms", "downDelay": "20ms"}
+//	    ]
+//	  }
+//
+// named conditions blocks define delay, jitter and bandwidth settings once so that entries can refer to them by name.
+// settings given in the entry itself override those of the block. for example:
+//
+//	  "conditions": {
+//	    "flaky-wifi": {"upDelay": "30ms", "downDelay": "30ms", "jitter": "25ms", "downBandwidth": "20M"}
+//	  },
+//	  "proxies": [
+//	    {"listen": "8080", "upstream": "db:5432", "conditions": "flaky-wifi"},
+//	    {"listen": "8081", "upstream": "cache:6379", "conditions": "flaky-wifi", "downDelay": "80ms"}
+//	  ]
+//
+// jitter and bandwidths given in the file replace the corresponding flags for that proxy.
+
+// entries and conditions blocks are decoded individually so errors can name them
+type configFile struct {
+	Proxies    []json.RawMessage          `json:"proxies"`
+	Conditions map[string]json.RawMessage `json:"conditions"`
+	Schedule   *scheduleConfig            `json:"schedule"`
+}
+
+type scheduleConfig struct {
+	Interval string                 `json:"interval"`
+	Windows  []scheduleWindowConfig `json:"windows"`
+}
+
+type scheduleWindowConfig struct {
+	Window    string `json:"window"`
+	UpDelay   string `json:"upDelay"`
+	DownDelay string `json:"downDelay"`
+}
+
+// the delay schedule of a config file
+type configSchedule struct {
+	schedule *proxy.DelaySchedule
+	interval time.Duration
+}
+
+// the settings a conditions block can hold. durations and bandwidths are kept as strings and parsed during validation
+// so errors can name the field. empty fields and a nil randomizeDelay are left unset.
+type conditionsConfig struct {
+	UpDelay             string `json:"upDelay"`
+	DownDelay           string `json:"downDelay"`
+	RandomizeDelay      *bool  `json:"randomizeDelay"`
+	RerandomizeInterval string `json:"rerandomizeInterval"`
+	Jitter              string `json:"jitter"`
+	UpBandwidth         string `json:"upBandwidth"`
+	DownBandwidth       string `json:"downBandwidth"`
+}
+
+// an entry may refer to a conditions block and override its settings inline
+type proxyConfig struct {
+	Listen     string `json:"listen"`
+	Upstream   string `json:"upstream"`
+	Conditions string `json:"conditions"`
+	conditionsConfig
+}
+
+// a single proxy definition, regardless of whether it came from the command line or the config file. name identifies
+// the definition in error messages.
+type proxyDef struct {
+	name                string
+	listenAddr          string
+	upstreamAddr        string
+	upDelay             time.Duration
+	downDelay           time.Duration
+	randomizeDelay      bool
+	rerandomizeInterval time.Duration
+	// set by the config file to replace the jitter and bandwidth flags for this proxy. nil uses the flags.
+	jitter        *time.Duration
+	upBandwidth   *int64
+	downBandwidth *int64
+}
+
+// loads and validates the config file. errors identify the file, entry index and field at fault. the schedule is nil
+// if the file has none.
+func loadConfig(path string) ([]proxyDef, *configSchedule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var cfg configFile
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if len(cfg.Proxies) == 0 {
+		return nil, nil, fmt.Errorf("%s: no proxies defined", path)
+	}
+
+	conditions := make(map[string]conditionsConfig, len(cfg.Conditions))
+	for name, raw := range cfg.Conditions {
+		var cc conditionsConfig
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&cc); err != nil {
+			if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+				return nil, nil, fmt.Errorf("%s: conditions[%q].%s: expected %s, got %s", path, name, typeErr.Field, typeErr.Type, typeErr.Value)
+			}
+			return nil, nil, fmt.Errorf("%s: conditions[%q]: %s", path, name, err)
+		}
+		if field, err := cc.apply(&proxyDef{}); err != nil {
+			return nil, nil, fmt.Errorf("%s: conditions[%q].%s: %s", path, name, field, err)
+		}
+		conditions[name] = cc
+	}
+
+	defs := make([]proxyDef, 0, len(cfg.Proxies))
+	for i, raw := range cfg.Proxies {
+		entryErr := func(field string, err error) error {
+			return fmt.Errorf("%s: proxies[%d].%s: %s", path, i, field, err)
+		}
+
+		var pc proxyConfig
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&pc); err != nil {
+			if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+				return nil, nil, entryErr(typeErr.Field, fmt.Errorf("expected %s, got %s", typeErr.Type, typeErr.Value))
+			}
+			return nil, nil, fmt.Errorf("%s: proxies[%d]: %s", path, i, err)
+		}
+
+		if pc.Conditions != "" {
+			cc, ok := conditions[pc.Conditions]
+			if !ok {
+				return nil, nil, entryErr("conditions", fmt.Errorf("unknown conditions %q", pc.Conditions))
+			}
+			pc.conditionsConfig = cc.overriddenBy(pc.conditionsConfig)
+		}
+		def, field, err := pc.toDef()
+		if err != nil {
+			return nil, nil, entryErr(field, err)
+		}
+		def.name = fmt.Sprintf("%s: proxies[%d]", path, i)
+		defs = append(defs, def)
+	}
+
+	if cfg.Schedule == nil {
+		return defs, nil, nil
+	}
+	sched, field, err := cfg.Schedule.toSchedule()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: schedule%s: %s", path, field, err)
+	}
+	return defs, sched, nil
+}
+
+// validates the schedule. on error, the path of the offending field below the schedule is returned.
+func (sc scheduleConfig) toSchedule() (*configSchedule, string, error) {
+	cs := &configSchedule{}
+	if sc.Interval != "" {
+		var err error
+		cs.interval, err = time.ParseDuration(sc.Interval)
+		if err != nil {
+			return nil, ".interval", err
+		}
+		if cs.interval <= 0 {
+			return nil, ".interval", errors.New("must be positive")
+		}
+	}
+	if len(sc.Windows) == 0 {
+		return nil, ".windows", errors.New("no windows defined")
+	}
+
+	windows := make([]proxy.ScheduleWindow, 0, len(sc.Windows))
+	for i, wc := range sc.Windows {
+		var w proxy.ScheduleWindow
+		var err error
+		if w.Start, w.End, err = parseScheduleWindow(wc.Window); err != nil {
+			return nil, fmt.Sprintf(".windows[%d].window", i), err
+		}
+		w.Name = wc.Window
+		for _, d := range []struct {
+			field string
+			value string
+			dst   *time.Duration
+		}{
+			{"upDelay", wc.UpDelay, &w.UpDelay},
+			{"downDelay", wc.DownDelay, &w.DownDelay},
+		} {
+			if d.value == "" {
+				continue
+			}
+			if *d.dst, err = time.ParseDuration(d.value); err != nil {
+				return nil, fmt.Sprintf(".windows[%d].%s", i, d.field), err
+			}
+			if *d.dst < 0 {
+				return nil, fmt.Sprintf(".windows[%d].%s", i, d.field), errors.New("must not be negative")
+			}
+		}
+		windows = append(windows, w)
+	}
+
+	var err error
+	if cs.schedule, err = proxy.NewDelaySchedule(windows, time.Local); err != nil {
+		return nil, ".windows", err
+	}
+	return cs, "", nil
+}
+
+// parses a window like 09:00-17:00. times are hh:mm or hh:mm:ss, and the end may be 24:00.
+func parseScheduleWindow(s string) (time.Duration, time.Duration, error) {
+	i := strings.Index(s, "-")
+	if i < 0 {
+		return 0, 0, fmt.Errorf("expected <start>-<end>, e.g. 09:00-17:00 (got %q)", s)
+	}
+	start, err := parseTimeOfDay(s[:i])
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := parseTimeOfDay(s[i+1:])
+	if err != nil {
+		return 0, 0, err
+	}
+	if start == 24*time.Hour {
+		return 0, 0, fmt.Errorf("window can't start at %s", s[:i])
+	}
+	if start == end {
+		return 0, 0, errors.New("start and end must differ")
+	}
+	return start, end, nil
+}
+
+// parses hh:mm or hh:mm:ss as an offset from midnight
+func parseTimeOfDay(s string) (time.Duration, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 && len(parts) != 3 {
+		return 0, fmt.Errorf("invalid time of day %q. expected hh:mm or hh:mm:ss", s)
+	}
+	var d time.Duration
+	for i, p := range parts {
+		v, err := strconv.ParseUint(p, 10, 32)
+		if err != nil || (i == 0 && v > 24) || (i > 0 && v >= 60) {
+			return 0, fmt.Errorf("invalid time of day %q. expected hh:mm or hh:mm:ss", s)
+		}
+		d = d*60 + time.Duration(v)
+	}
+	if len(parts) == 2 {
+		d *= 60
+	}
+	d *= time.Second
+	if d > 24*time.Hour {
+		return 0, fmt.Errorf("invalid time of day %q. expected hh:mm or hh:mm:ss", s)
+	}
+	return d, nil
+}
+
+// returns the block's settings with those set in o replacing them
+func (cc conditionsConfig) overriddenBy(o conditionsConfig) conditionsConfig {
+	for _, f := range []struct{ dst, src *string }{
+		{&cc.UpDelay, &o.UpDelay},
+		{&cc.DownDelay, &o.DownDelay},
+		{&cc.RerandomizeInterval, &o.RerandomizeInterval},
+		{&cc.Jitter, &o.Jitter},
+		{&cc.UpBandwidth, &o.UpBandwidth},
+		{&cc.DownBandwidth, &o.DownBandwidth},
+	} {
+		if *f.src != "" {
+			*f.dst = *f.src
+		}
+	}
+	if o.RandomizeDelay != nil {
+		cc.RandomizeDelay = o.RandomizeDelay
+	}
+	return cc
+}
+
+// validates the settings and sets them on the definition. on error, the name of the offending field is returned.
+func (cc conditionsConfig) apply(def *proxyDef) (string, error) {
+	if cc.RandomizeDelay != nil {
+		def.randomizeDelay = *cc.RandomizeDelay
+	}
+
+	var jitter time.Duration
+	durations := []struct {
+		field string
+		value string
+		dst   *time.Duration
+		// delays are limited to maxDelay
+		delay bool
+	}{
+		{"upDelay", cc.UpDelay, &def.upDelay, true},
+		{"downDelay", cc.DownDelay, &def.downDelay, true},
+		{"rerandomizeInterval", cc.RerandomizeInterval, &def.rerandomizeInterval, false},
+		{"jitter", cc.Jitter, &jitter, true},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		var err error
+		*d.dst, err = time.ParseDuration(d.value)
+		if err != nil {
+			return d.field, err
+		}
+		if *d.dst < 0 {
+			return d.field, errors.New("must not be negative")
+		}
+		if d.delay && *d.dst > maxDelay {
+			return d.field, fmt.Errorf("must not be longer than %s", maxDelay)
+		}
+	}
+	if cc.Jitter != "" {
+		def.jitter = &jitter
+	}
+
+	bandwidths := []struct {
+		field string
+		value string
+		dst   **int64
+	}{
+		{"upBandwidth", cc.UpBandwidth, &def.upBandwidth},
+		{"downBandwidth", cc.DownBandwidth, &def.downBandwidth},
+	}
+	for _, b := range bandwidths {
+		if b.value == "" {
+			continue
+		}
+		rate, err := parseBandwidth(b.value)
+		if err != nil {
+			return b.field, err
+		}
+		*b.dst = &rate
+	}
+	return "", nil
+}
+
+// validates the entry and converts it to a proxy definition. on error, the name of the offending field is returned.
+func (pc proxyConfig) toDef() (proxyDef, string, error) {
+	def := proxyDef{
+		upstreamAddr: pc.Upstream,
+	}
+
+	var err error
+	def.listenAddr, err = parseListenAddr(pc.Listen)
+	if err != nil {
+		return def, "listen", err
+	}
+	if err := validateUpstreamAddr(pc.Upstream); err != nil {
+		return def, "upstream", err
+	}
+	if field, err := pc.conditionsConfig.apply(&def); err != nil {
+		return def, field, err
+	}
+	if def.rerandomizeInterval > 0 && !def.randomizeDelay {
+		return def, "rerandomizeInterval", errors.New("requires randomizeDelay")
+	}
+
+	return def, "", nil
+}
@@ -0,0 +1,24 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func daemonized() bool {
+	return false
+}
+
+// background mode relies on setsid and isn't supported on windows
+func daemonize(logPath string) (int, error) {
+	return 0, errors.New("background mode is not supported on this platform")
+}
+
+// best effort. FindProcess fails on windows if the process doesn't exist.
+func processAlive(pid int) bool {
+	_, err := os.FindProcess(pid)
+	return err == nil
+}
@@ -0,0 +1,52 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// set in the environment of the background child so it doesn't fork again
+const envDaemonized = "TDP_DAEMONIZED"
+
+// indicates whether this process is the detached background child
+func daemonized() bool {
+	return os.Getenv(envDaemonized) != ""
+}
+
+// re-executes the current process detached from the terminal in its own session with the same arguments. stdout and
+// stderr of the child go to logPath, or are discarded if it's empty. returns the pid of the child.
+func daemonize(logPath string) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+
+	if logPath == "" {
+		logPath = os.DevNull
+	}
+	out, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), envDaemonized+"=1")
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	return cmd.Process.Pid, nil
+}
+
+// checks whether a process with the given pid exists
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
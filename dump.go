@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/rs/zerolog/log"
+	"github.com/wfscot/tcp-delay-proxy/proxy"
+	"io/ioutil"
+	"time"
+)
+
+// a session as written by the SIGUSR1 dump and returned by the admin API. durations are strings as in the config file.
+type dumpedSession struct {
+	ID              string    `json:"id"`
+	Listen          string    `json:"listen"`
+	ClientAddr      string    `json:"clientAddr"`
+	UpstreamAddr    string    `json:"upstreamAddr"`
+	StartTime       time.Time `json:"startTime"`
+	Age             string    `json:"age"`
+	UpDelay         string    `json:"upDelay"`
+	DownDelay       string    `json:"downDelay"`
+	UpBytes         int64     `json:"upBytes"`
+	DownBytes       int64     `json:"downBytes"`
+	UpChunks        int64     `json:"upChunks"`
+	DownChunks      int64     `json:"downChunks"`
+	UpQueuedBytes   int64     `json:"upQueuedBytes"`
+	DownQueuedBytes int64     `json:"downQueuedBytes"`
+	// when each direction last read from its source and wrote to its destination, left out if it never has
+	UpLastRead      *time.Time `json:"upLastRead,omitempty"`
+	UpLastWritten   *time.Time `json:"upLastWritten,omitempty"`
+	DownLastRead    *time.Time `json:"downLastRead,omitempty"`
+	DownLastWritten *time.Time `json:"downLastWritten,omitempty"`
+	Paused          bool       `json:"paused"`
+	PausedDuration  string     `json:"pausedDuration,omitempty"`
+}
+
+type sessionDump struct {
+	Time     time.Time       `json:"time"`
+	Sessions []dumpedSession `json:"sessions"`
+}
+
+// writes a snapshot of every active session to path as JSON, replacing any previous dump. without a path, each
+// session is logged at warn level instead so that it shows at the default verbosity.
+func dumpSessions(runner *proxyRunner, path string) error {
+	now := time.Now()
+	dump := sessionDump{Time: now, Sessions: collectSessions(runner, now)}
+
+	if path == "" {
+		log.Warn().Int("sessions", len(dump.Sessions)).Msg("session dump")
+		for _, ds := range dump.Sessions {
+			log.Warn().Str("sessionId", ds.ID).Str("listenAddr", ds.Listen).Str("clientAddr", ds.ClientAddr).Str("upstreamAddr", ds.UpstreamAddr).
+				Str("age", ds.Age).Str("upDelay", ds.UpDelay).Str("downDelay", ds.DownDelay).
+				Int64("upBytes", ds.UpBytes).Int64("downBytes", ds.DownBytes).
+				Int64("upQueuedBytes", ds.UpQueuedBytes).Int64("downQueuedBytes", ds.DownQueuedBytes).Msg("active session")
+		}
+		return nil
+	}
+
+	b, err := json.MarshalIndent(dump, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(b, '\n'), 0644)
+}
+
+// returns the active sessions of every proxy
+func collectSessions(runner *proxyRunner, now time.Time) []dumpedSession {
+	sessions := []dumpedSession{}
+	for _, rp := range runner.active() {
+		lister, ok := rp.srv.(proxy.SessionLister)
+		if !ok {
+			continue
+		}
+		for _, ss := range lister.Sessions() {
+			sessions = append(sessions, describeSession(rp, ss, now))
+		}
+	}
+	return sessions
+}
+
+func describeSession(rp *runningProxy, ss proxy.SessionSnapshot, now time.Time) dumpedSession {
+	ds := dumpedSession{
+		ID:              ss.ID,
+		Listen:          rp.def.listenAddr,
+		ClientAddr:      ss.ClientAddr,
+		UpstreamAddr:    ss.UpstreamAddr,
+		StartTime:       ss.StartTime,
+		Age:             now.Sub(ss.StartTime).Round(time.Millisecond).String(),
+		UpDelay:         ss.UpDelay.String(),
+		DownDelay:       ss.DownDelay.String(),
+		UpBytes:         ss.UpBytes,
+		DownBytes:       ss.DownBytes,
+		UpChunks:        ss.UpChunks,
+		DownChunks:      ss.DownChunks,
+		UpQueuedBytes:   ss.UpQueuedBytes,
+		DownQueuedBytes: ss.DownQueuedBytes,
+		UpLastRead:      optionalTime(ss.UpLastRead),
+		UpLastWritten:   optionalTime(ss.UpLastWritten),
+		DownLastRead:    optionalTime(ss.DownLastRead),
+		DownLastWritten: optionalTime(ss.DownLastWritten),
+		Paused:          ss.Paused,
+	}
+	if ss.PausedDuration > 0 {
+		ds.PausedDuration = ss.PausedDuration.String()
+	}
+	return ds
+}
+
+// returns nil for the zero time, so that it's left out of the JSON
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
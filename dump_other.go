@@ -0,0 +1,12 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+)
+
+// there is no SIGUSR1 on windows, so sessions can't be dumped
+func notifyDump(c chan<- os.Signal) {
+}
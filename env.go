@@ -0,0 +1,99 @@
+package main
+
+import (
+	"github.com/pborman/getopt/v2"
+	"os"
+	"strings"
+)
+
+// every flag can also be set through an environment variable, which is handy for container deployments. flags on the
+// command line take precedence over the environment, which in turn takes precedence over the defaults.
+// by default the variable name is derived from the long flag name (e.g. --target-rtt becomes TDP_TARGET_RTT). the
+// names below are exceptions, either for readability or because the flag has no long name.
+
+const envPrefix = "TDP_"
+
+var envNames = map[string]string{
+	"updelay":        "TDP_UP_DELAY",
+	"downdelay":      "TDP_DOWN_DELAY",
+	"randomizedelay": "TDP_RANDOMIZE_DELAY",
+	"v":              "TDP_VERBOSITY",
+	"q":              "TDP_QUIET",
+}
+
+// the positional args
+const (
+	envListen   = "TDP_LISTEN"
+	envUpstream = "TDP_UPSTREAM"
+)
+
+// returns the environment variable name for an option
+func envName(opt getopt.Option) string {
+	name := opt.LongName()
+	if name == "" {
+		name = opt.ShortName()
+	}
+	if envName, ok := envNames[name]; ok {
+		return envName
+	}
+	return envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// applies environment variables to all options that weren't given on the command line. returns the names of the
+// variables that were applied. invalid values are reported as problems just like invalid flags.
+func applyEnv() []string {
+	var applied []string
+	getopt.VisitAll(func(opt getopt.Option) {
+		name := envName(opt)
+		value, ok := os.LookupEnv(name)
+		if !ok || opt.Seen() {
+			return
+		}
+		if err := opt.Value().Set(value, opt); err != nil {
+			problem("invalid value for %s (from environment variable %s): %s", opt.Name(), name, err)
+			return
+		}
+		applied = append(applied, name)
+	})
+	return applied
+}
+
+// indicates whether the option with the given long name was set explicitly, on the command line or through one of
+// the applied environment variables
+func flagGiven(name string, fromEnv []string) bool {
+	opt := getopt.Lookup(name)
+	if opt.Seen() {
+		return true
+	}
+	env := envName(opt)
+	for _, applied := range fromEnv {
+		if applied == env {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the positional args from the environment if none were given on the command line
+func envArgs(args []string, needUpstream bool) ([]string, []string) {
+	if len(args) != 0 {
+		return args, nil
+	}
+	listen, listenOk := os.LookupEnv(envListen)
+	if !needUpstream {
+		// sessions are served internally, so there is only the listen address
+		if !listenOk {
+			return args, nil
+		}
+		return []string{listen}, []string{envListen}
+	}
+	upstream, upstreamOk := os.LookupEnv(envUpstream)
+	if !listenOk && !upstreamOk {
+		return args, nil
+	}
+	if !listenOk || !upstreamOk {
+		problem("environment variables %s and %s must be set together", envListen, envUpstream)
+		return args, nil
+	}
+	return []string{listen, upstream}, []string{envListen, envUpstream}
+}
@@ -6,5 +6,6 @@ require (
 	github.com/pborman/getopt/v2 v2.1.0
 	github.com/rs/zerolog v1.20.0
 	golang.org/x/exp v0.0.0-20210220032938-85be41e4509f
+	golang.org/x/sys v0.0.0-20210304124612-50617c2ba197
 	gonum.org/v1/gonum v0.9.0
 )
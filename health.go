@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// the health endpoints served with --health-addr. /healthz returns 200 once every proxy is listening and 503 before
+// that or once the proxies are being torn down, e.g. after a listener failed or while draining on SIGTERM. /info describes the running proxies.
+
+// a proxy as returned by /info. addr is the address actually listened on, if listening.
+type proxyInfo struct {
+	adminProxyConfig
+	Addr  string `json:"addr,omitempty"`
+	Ready bool   `json:"ready"`
+}
+
+type healthHandler struct {
+	ctx    context.Context
+	runner *proxyRunner
+}
+
+func newHealthHandler(ctx context.Context, runner *proxyRunner) http.Handler {
+	h := &healthHandler{ctx: ctx, runner: runner}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", h.serveHealthz)
+	mux.HandleFunc("/info", h.serveInfo)
+	return mux
+}
+
+func (h *healthHandler) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	if h.ctx.Err() != nil || h.runner.isDraining() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	for _, rp := range h.runner.active() {
+		select {
+		case <-rp.srv.Ready():
+		default:
+			http.Error(w, "not listening yet: "+rp.def.listenAddr, http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.Write([]byte("ok\n"))
+}
+
+func (h *healthHandler) serveInfo(w http.ResponseWriter, r *http.Request) {
+	proxies := h.runner.active()
+	infos := make([]proxyInfo, 0, len(proxies))
+	for _, rp := range proxies {
+		info := proxyInfo{adminProxyConfig: describeProxy(rp)}
+		select {
+		case <-rp.srv.Ready():
+			info.Ready = true
+			if addr := rp.srv.Addr(); addr != nil {
+				info.Addr = addr.String()
+			}
+		default:
+		}
+		infos = append(infos, info)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Proxies []proxyInfo `json:"proxies"`
+	}{infos})
+}
@@ -2,62 +2,414 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
-	"github.com/pborman/getopt/v2"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/wfscot/tcp-delay-proxy/proxy"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"runtime"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// exit codes other than 0 and the general failure code 1
+const (
+	// an upstream couldn't be reached by --check-upstream
+	exitUpstreamUnreachable = 2
+	// sessions were still open when the --drain-timeout deadline hit
+	exitDrainTimeout = 3
+	// a second signal closed the sessions still draining
+	exitAborted = 4
+	// the arguments were invalid
+	exitInvalidArgs = 5
 )
 
 func main() {
 	// configure the zerolog for pretty commmand line feedback
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 
-	// add fields to logger
-	log := log.With().Str("func", "main").Logger()
-
 	// default log level is warn
 	zerolog.SetGlobalLevel(zerolog.WarnLevel)
 
-	// use getopt to process command line flags. this is used instead of flag pkg due to the strong historic precedent.
-	getopt.SetParameters("listenPort upstreamAddr")
-	verbosity := getopt.Counter('v', "verbosity. can be used multiple times to further increase.")
-	quiet := getopt.Bool('q', "quiet. do not print any log info. overrides verbosity flag.")
-	upDelay := getopt.DurationLong("updelay", 'u', 0, "upstream delay as duration (1s, 100ms, etc.). default 0.")
-	downDelay := getopt.DurationLong("downdelay", 'd', 0, "downstream delay as duration (1s, 100ms, etc.). default 0.")
-	randomizeDelay := getopt.BoolLong("randomizedelay", 'r', "randomize delay using lognormal distribution (mu = 0, sigma = 1.0) around up/down delay")
-
-	// use ParseV2 simply to make sure that we have the v2 version of getopt
-	getopt.ParseV2()
-
-	// after flags we should have exactly 2 args
-	args := getopt.Args()
-	if len(args) != 2 {
-		fmt.Printf("error: wrong number of arguments (%d)\n", len(args))
-		getopt.Usage()
+	a := parseArgs()
+
+	// optionally make sure the upstreams are reachable
+	if *a.checkUpstreamFlag {
+		for _, def := range a.defs {
+			if err := checkUpstream(def.upstreamAddr, *a.dialTimeout); err != nil {
+				fmt.Fprintf(errOut, "error: upstream check failed: %s\n", err)
+				os.Exit(exitUpstreamUnreachable)
+			}
+		}
+	}
+
+	// load the certificates up front so that a bad file fails startup
+	if err := a.loadTLS(); err != nil {
+		fmt.Fprintf(errOut, "error: %s\n", err)
 		os.Exit(1)
 	}
+	log := a.setupLogging()
 
-	// parse listenPort
-	listenPort64, err := strconv.ParseInt(args[0], 10, 16)
-	if err != nil {
-		fmt.Printf("error: invalid int for listenPort (got %s)\n", args[0])
-		getopt.Usage()
+	if len(a.fromEnv) > 0 {
+		log.Debug().Strs("vars", a.fromEnv).Msg("settings taken from environment")
+	}
+	if a.profile != nil {
+		log.Info().Str("profile", a.profile.Name).Dur("upDelay", *a.upDelay).Dur("downDelay", *a.downDelay).Dur("jitter", *a.jitter).
+			Str("upBandwidth", formatBandwidth(a.upBandwidthRate)).Str("downBandwidth", formatBandwidth(a.downBandwidthRate)).
+			Msg("using network profile. effective settings after flag overrides.")
+	}
+
+	// in background mode, re-execute detached and let the child do the work. a live instance named by the pid file is
+	// caught here, so that the caller gets the failure rather than a child that quietly exits.
+	if *a.background && !daemonized() {
+		if *a.pidPath != "" {
+			if err := checkPidFile(*a.pidPath); err != nil {
+				fmt.Fprintf(errOut, "error: %s\n", err)
+				os.Exit(1)
+			}
+		}
+		pid, err := daemonize(*a.logPath)
+		if err != nil {
+			log.Error().Err(err).Msg("error while starting in background")
+			os.Exit(1)
+		}
+		log.Info().Int("pid", pid).Msg("started in background")
+		os.Exit(0)
+	}
+
+	// generated only now, so that in background mode the certificate logged and written is the one the child serves
+	if err := a.generateSelfSigned(); err != nil {
+		fmt.Fprintf(errOut, "error: %s\n", err)
 		os.Exit(1)
 	}
-	listenPort := int(listenPort64)
+	if a.selfSigned != nil {
+		l := log.Info().Str("fingerprint", proxy.CertFingerprint(a.selfSigned)).Str("subject", a.selfSigned.Subject.CommonName).
+			Strs("dnsNames", a.selfSigned.DNSNames).Interface("ipAddresses", a.selfSigned.IPAddresses)
+		if *a.tlsCertOut != "" {
+			l = l.Str("certFile", *a.tlsCertOut)
+		}
+		l.Msg("generated self-signed TLS certificate")
+	}
+
+	// write the pid file and make sure it is removed on the way out. note that os.Exit skips deferred calls, so all
+	// exits below go through exit.
+	exit := os.Exit
+	if *a.pidPath != "" {
+		if err := writePidFile(*a.pidPath); err != nil {
+			log.Error().Err(err).Msg("error while writing pid file")
+			os.Exit(1)
+		}
+		exit = func(code int) {
+			removePidFile(*a.pidPath)
+			os.Exit(code)
+		}
+	}
+
+	// establish the context with a cancel function and embed the logger
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = log.WithContext(ctx)
+
+	// SIGINT (control+c) and SIGTERM, e.g. from docker stop or systemd, stop accepting and drain the open sessions. a
+	// second one, or SIGQUIT, closes them right away.
+	stop := make(chan os.Signal, 2)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
+
+	if *a.replayDir != "" {
+		// a replay has nothing to drain
+		go func() {
+			<-stop
+			log.Info().Msg("interrupt received. exiting.")
+			cancel()
+		}()
+		exit(runReplay(ctx, *a.replayDir, a.replayUpstream, a.replayScale, *a.upDelay, *a.downDelay, *a.writeTimeout))
+	}
+
+	// assemble optional server settings
+	opts, traceOut, err := a.buildServerOptions(log)
+	if err != nil {
+		exit(1)
+	}
+
+	// optionally serve internal counters for debugging
+	if *a.debugAddr != "" {
+		proxy.PublishDebugVars()
+		ln, err := net.Listen("tcp", *a.debugAddr)
+		if err != nil {
+			log.Error().Err(err).Str("debugAddr", *a.debugAddr).Msg("error while establishing debug listener")
+			exit(1)
+		}
+		log.Info().Stringer("addr", ln.Addr()).Msg("serving debug vars on /debug/vars")
+		// the handler is registered on the default mux by the expvar package
+		go http.Serve(ln, nil)
+	}
+
+	// optionally serve the admin API. the listener is established before the servers start so that a bad address
+	// fails fast, but requests are only served once all servers exist.
+	var adminLn net.Listener
+	if *a.adminAddr != "" {
+		var err error
+		adminLn, err = net.Listen("tcp", *a.adminAddr)
+		if err != nil {
+			log.Error().Err(err).Str("adminAddr", *a.adminAddr).Msg("error while establishing admin listener")
+			exit(1)
+		}
+		log.Info().Stringer("addr", adminLn.Addr()).Msg("serving admin API on /config and /sessions")
+	}
+
+	var healthLn net.Listener
+	if *a.healthAddr != "" {
+		var err error
+		healthLn, err = net.Listen("tcp", *a.healthAddr)
+		if err != nil {
+			log.Error().Err(err).Str("healthAddr", *a.healthAddr).Msg("error while establishing health listener")
+			exit(1)
+		}
+		log.Info().Stringer("addr", healthLn.Addr()).Msg("serving health endpoints on /healthz and /info")
+	}
+
+	// deliver session events in the background
+	var wh *webhook
+	if *a.webhookURL != "" {
+		wh = newWebhook(*a.webhookURL)
+		go wh.run(ctx)
+	}
+
+	// create one server per proxy definition and run them all under the same context. if any of them fails (e.g.
+	// because it can't bind its listener), tear everything down and exit non-zero.
+	runner := newProxyRunner(ctx, func(def proxyDef) proxy.Server {
+		return a.newServer(def, opts, wh)
+	})
+	if *a.stdio {
+		runner.run = func(ctx context.Context, srv proxy.Server) error {
+			return srv.(proxy.StreamServer).ServeStream(ctx, os.Stdin, os.Stdout)
+		}
+	}
+	srvs := make([]proxy.Server, 0, len(a.defs))
+	for _, def := range a.defs {
+		srvs = append(srvs, runner.start(def, false).srv)
+	}
+
+	if *a.measure > 0 {
+		go logAddedLatency(ctx, runner, *a.measure)
+	}
+	if a.scenario != nil {
+		go runScenario(ctx, runner, a.scenario, *a.scenarioLoop)
+	}
+
+	if adminLn != nil {
+		go http.Serve(adminLn, newAdminHandler(runner, *a.udp))
+	}
+	if healthLn != nil {
+		go http.Serve(healthLn, newHealthHandler(ctx, runner))
+	}
+
+	// with a config file, SIGHUP re-reads it and applies the changes
+	hup := make(chan os.Signal, 1)
+	if *a.configPath != "" {
+		signal.Notify(hup, syscall.SIGHUP)
+	}
+
+	// receives whether the drain finished in time
+	var drained chan bool
+	// whether a second signal closed the remaining sessions
+	aborted := false
+
+	// SIGUSR1 dumps the active sessions, e.g. to see where a hanging test is stuck
+	dump := make(chan os.Signal, 1)
+	notifyDump(dump)
+
+	// print the actual ports in definition order so scripts can capture them
+	if *a.printPort {
+		go func() {
+			for _, srv := range srvs {
+				select {
+				case <-ctx.Done():
+					return
+				case <-srv.Done():
+					// failed to listen. the main loop reports the error.
+					return
+				case <-srv.Ready():
+					switch addr := srv.Addr().(type) {
+					case *net.TCPAddr:
+						fmt.Println(addr.Port)
+					case *net.UDPAddr:
+						fmt.Println(addr.Port)
+					}
+				}
+			}
+		}()
+	}
+
+	failed := false
+	for runner.len() > 0 {
+		select {
+		case e := <-runner.exits:
+			runner.remove(e.rp)
+			if e.err == nil {
+				continue
+			}
+			// a proxy added by a reload that can't listen is rejected without affecting the others
+			if e.rp.added && e.rp.srv.Addr() == nil {
+				log.Error().Err(e.err).Str("proxy", e.rp.def.name).Str("listenAddr", e.rp.def.listenAddr).Msg("rejected proxy from reloaded config")
+				continue
+			}
+			log.Error().Err(e.err).Str("proxy", e.rp.def.name).Str("listenAddr", e.rp.def.listenAddr).Str("upstreamAddr", e.rp.upstreamAddr()).Msg("server exited with error")
+			cancel()
+			failed = true
+
+		case sig := <-stop:
+			if aborted {
+				continue
+			}
+			if drained != nil || sig == syscall.SIGQUIT {
+				log.Warn().Stringer("signal", sig).Int("abortedSessions", runner.numSessions()).Msg("closing remaining sessions right away.")
+				aborted = true
+				cancel()
+				continue
+			}
+			log.Info().Stringer("signal", sig).Int("sessions", runner.numSessions()).Dur("drainTimeout", *a.drainTimeout).
+				Msg("draining sessions. signal again to close them right away.")
+			drained = make(chan bool, 1)
+			go func() {
+				drained <- runner.shutdown(*a.drainTimeout)
+			}()
+
+		case <-hup:
+			if ctx.Err() != nil || drained != nil {
+				continue
+			}
+			log.Info().Str("config", *a.configPath).Msg("SIGHUP received. reloading config.")
+			if err := reloadConfig(*a.configPath, runner, a.checkDef, *a.checkUpstreamFlag, *a.dialTimeout); err != nil {
+				log.Error().Err(err).Msg("rejected config reload. keeping the current config.")
+				continue
+			}
+			log.Info().Msg("config reloaded")
+
+		case <-dump:
+			if err := dumpSessions(runner, *a.dumpPath); err != nil {
+				log.Error().Err(err).Str("dumpFile", *a.dumpPath).Msg("error while dumping sessions")
+				continue
+			}
+			if *a.dumpPath != "" {
+				log.Info().Str("dumpFile", *a.dumpPath).Msg("dumped sessions")
+			}
+		}
+	}
+	if traceOut != nil && traceOut.Err() != nil {
+		log.Error().Err(traceOut.Err()).Str("delayTraceOut", *a.traceOutPath).Msg("error while writing delay trace")
+		failed = true
+	}
+	if aborted {
+		exit(exitAborted)
+	}
+	if failed {
+		exit(1)
+	}
+	if drained != nil && !<-drained {
+		log.Warn().Dur("drainTimeout", *a.drainTimeout).Msg("drain deadline hit before all sessions finished")
+		exit(exitDrainTimeout)
+	}
+
+	exit(0)
+}
+
+// loads the certificates for TLS termination and the upstream TLS settings
+func (a *cliArgs) loadTLS() error {
+	if *a.tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(*a.tlsCert, *a.tlsKey)
+		if err != nil {
+			return fmt.Errorf("can't load TLS certificate: %s", err)
+		}
+		a.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	} else if *a.tlsSelfSigned {
+		// the certificate itself is added by generateSelfSigned
+		a.tlsConfig = &tls.Config{}
+	}
+	if len(*a.tlsALPN) > 0 {
+		a.tlsConfig.NextProtos = *a.tlsALPN
+	}
+	if *a.tlsClientCA != "" {
+		pool, err := loadCertPool(*a.tlsClientCA)
+		if err != nil {
+			return fmt.Errorf("can't load client CA file: %s", err)
+		}
+		a.tlsConfig.ClientCAs = pool
+		a.tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		if len(*a.tlsClientAllowCN) > 0 {
+			a.tlsConfig.VerifyPeerCertificate = allowClientCNs(*a.tlsClientAllowCN)
+		}
+	}
+
+	// set up TLS towards the upstream
+	if *a.upstreamTLS {
+		a.upstreamTLSConfig = &tls.Config{ServerName: *a.upstreamServerName, InsecureSkipVerify: *a.upstreamInsecure, NextProtos: *a.upstreamALPN}
+		if *a.upstreamCA != "" {
+			pool, err := loadCertPool(*a.upstreamCA)
+			if err != nil {
+				return fmt.Errorf("can't load upstream CA file: %s", err)
+			}
+			a.upstreamTLSConfig.RootCAs = pool
+		}
+	}
+	return nil
+}
+
+// generates the self-signed certificate for --tls without --tls-cert and adds it to the TLS config set up by
+// loadTLS. it is generated once, so that all proxies and config reloads present the same certificate.
+func (a *cliArgs) generateSelfSigned() error {
+	if !*a.tlsSelfSigned || *a.tlsCert != "" {
+		return nil
+	}
+	hostnames := *a.tlsHostnames
+	if len(hostnames) == 0 {
+		hostnames = listenHostnames(a.defs)
+	}
+	cert, err := proxy.NewSelfSignedCert(hostnames)
+	if err != nil {
+		return fmt.Errorf("can't generate TLS certificate: %s", err)
+	}
+	if *a.tlsCertOut != "" {
+		if err := ioutil.WriteFile(*a.tlsCertOut, proxy.CertPEM(cert), 0644); err != nil {
+			return fmt.Errorf("can't write TLS certificate: %s", err)
+		}
+	}
+	a.selfSigned = cert.Leaf
+	a.tlsConfig.Certificates = []tls.Certificate{cert}
+	return nil
+}
+
+// sends the logs where and at the level the flags ask for, returning the logger for main
+func (a *cliArgs) setupLogging() zerolog.Logger {
+	// send logs to a file if requested
+	if *a.logPath != "" {
+		f, err := os.OpenFile(*a.logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			usageError("can't open log file: %s", err)
+		}
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: f, NoColor: true})
+	}
 
-	// parse upstreamAddr
-	upstreamAddr := args[1]
+	// add fields to logger
+	log := log.With().Str("func", "main").Logger()
 
-	// set verbosity. quiet overrides verbosity flag.
-	if *quiet {
+	// set verbosity. an explicit log level overrides both quiet and the verbosity flag, and quiet overrides the
+	// verbosity flag.
+	if *a.logLevel != "" {
+		zerolog.SetGlobalLevel(a.level)
+	} else if *a.quiet {
 		zerolog.SetGlobalLevel(zerolog.Disabled)
 	} else {
-		switch *verbosity {
+		switch *a.verbosity {
 		case 0:
 			// nothing to do. leave at default (warn) level set above
 		case 1:
@@ -67,32 +419,344 @@ func main() {
 		case 3:
 			zerolog.SetGlobalLevel(zerolog.TraceLevel)
 		default:
-			log.Warn().Int("verbosity", *verbosity).Msg("got invalid verbosity count. using max (trace level)")
+			log.Warn().Int("verbosity", *a.verbosity).Msg("got invalid verbosity count. using max (trace level)")
 			zerolog.SetGlobalLevel(zerolog.TraceLevel)
 		}
 	}
+	// logged regardless of the level, so that captured logs say what they leave out
+	log.Log().Str("logLevel", zerolog.GlobalLevel().String()).Msg("effective log level")
+	return log
+}
 
-	// establish the context with a cancel function and embed the logger
-	ctx, cancel := context.WithCancel(context.Background())
-	ctx = log.WithContext(ctx)
+// re-reads the config file and applies it to the running proxies. new and changed upstreams are checked if requested.
+func reloadConfig(path string, runner *proxyRunner, checkDef func(def proxyDef) error, checkUpstreams bool, dialTimeout time.Duration) error {
+	// the schedule is only read at startup
+	defs, _, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+	if checkUpstreams {
+		// the upstreams of running proxies by listen address
+		existing := map[string]string{}
+		for _, rp := range runner.active() {
+			existing[rp.def.listenAddr] = rp.upstreamAddr()
+		}
+		for _, def := range defs {
+			if upstream, ok := existing[def.listenAddr]; ok && upstream == def.upstreamAddr {
+				continue
+			}
+			if err := checkUpstream(def.upstreamAddr, dialTimeout); err != nil {
+				return fmt.Errorf("%s: upstream check failed: %s", def.name, err)
+			}
+		}
+	}
+	return runner.apply(defs, checkDef)
+}
 
-	// handle SIGINT (control+c)
-	go func() {
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt)
-		<-c
-		log.Info().Msg("interrupt received. exiting.")
-		cancel()
-		// don't exit yet. let context cancellation do its magic.
-	}()
-
-	// create the server and run it
-	srv := proxy.NewTcpDelayServer(listenPort, *upDelay, *downDelay, *randomizeDelay, upstreamAddr)
-	err = srv.Run(ctx)
+// parses an http proxy URL. the port defaults to 80 if not given.
+func parseHTTPProxy(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
 	if err != nil {
-		log.Error().Err(err).Msg("server exited with error")
-		os.Exit(1)
+		return nil, err
+	}
+	if u.Scheme != "http" {
+		return nil, fmt.Errorf("only http:// proxy URLs are supported (got %s)", s)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("missing host in %s", s)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), "80")
+	}
+	if u.User == nil {
+		u.User = url.User("")
+	}
+	return u, nil
+}
+
+// loads a pool of CA certificates from a PEM file
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// returns a peer certificate check that only accepts verified client certificates with one of the given common names.
+// the error names the presented subject so that rejections are easy to diagnose.
+func allowClientCNs(cns []string) func([][]byte, [][]*x509.Certificate) error {
+	return func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(verifiedChains) == 0 || len(verifiedChains[0]) == 0 {
+			return fmt.Errorf("no verified client certificate")
+		}
+		subject := verifiedChains[0][0].Subject
+		for _, cn := range cns {
+			if subject.CommonName == cn {
+				return nil
+			}
+		}
+		return fmt.Errorf("client certificate subject %s not allowed", subject)
 	}
+}
 
-	os.Exit(0)
+// the names accepted by --log-level, from least to most verbose
+var logLevelNames = []string{"error", "warn", "info", "debug", "trace"}
+
+func parseLogLevel(s string) (zerolog.Level, bool) {
+	for _, name := range logLevelNames {
+		if s == name {
+			level, err := zerolog.ParseLevel(name)
+			return level, err == nil
+		}
+	}
+	return zerolog.NoLevel, false
+}
+
+// the hosts the proxies listen on, for the certificate generated by --tls. wildcard addresses and unix sockets are
+// reachable as localhost.
+func listenHostnames(defs []proxyDef) []string {
+	var names []string
+	seen := map[string]bool{}
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, def := range defs {
+		host, _, err := net.SplitHostPort(def.listenAddr)
+		if err != nil || host == "" || net.ParseIP(host).IsUnspecified() {
+			add("localhost")
+			add("127.0.0.1")
+			add("::1")
+			continue
+		}
+		add(host)
+	}
+	return names
+}
+
+// parses a local address to bind to as ip or ip:port. IPv6 addresses with a port must be in brackets.
+func parseBindAddr(s string) (*net.TCPAddr, error) {
+	if ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")); ip != nil {
+		return &net.TCPAddr{IP: ip}, nil
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not of the form ip or ip:port", s)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not an IP address", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q in %q. must be a number from 0 to 65535", port, s)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// checks that an upstream address consists of a non-empty host and a valid, non-zero port, or is a Unix socket
+// address as accepted for listening. the error says which part is wrong.
+func validateUpstreamAddr(s string) error {
+	if isUnixAddr(s) {
+		return validateUnixAddr(s)
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return fmt.Errorf("%q is not of the form host:port: %s", s, err)
+	}
+	if host == "" {
+		return fmt.Errorf("missing host in %q", s)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || p == 0 {
+		return fmt.Errorf("invalid port %q in %q. must be a number from 1 to 65535", port, s)
+	}
+	return nil
+}
+
+// resolves the host of an upstream address and attempts a TCP connection so that configuration problems show up at
+// startup rather than on the first client connection
+func checkUpstream(s string, timeout time.Duration) error {
+	if addr, ok := proxy.SplitUnixAddr(s); ok {
+		conn, err := net.DialTimeout("unix", addr, timeout)
+		if err != nil {
+			return fmt.Errorf("can't connect to %s: %s", s, errors.Unwrap(err))
+		}
+		return conn.Close()
+	}
+	host, _, err := net.SplitHostPort(s)
+	if err != nil {
+		return err
+	}
+	if _, err := net.LookupHost(host); err != nil {
+		return fmt.Errorf("can't resolve host %q: %s", host, err)
+	}
+	conn, err := net.DialTimeout("tcp", s, timeout)
+	if err != nil {
+		return fmt.Errorf("can't connect to %s: %s", s, err)
+	}
+	return conn.Close()
+}
+
+// parses a port range of the form "lo-hi" or "host:lo-hi". ok is false if s isn't a port range.
+func parsePortRange(s string) (host string, lo int, hi int, ok bool) {
+	ports := s
+	if i := strings.LastIndex(s, ":"); i >= 0 {
+		host, ports = s[:i], s[i+1:]
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	}
+	i := strings.Index(ports, "-")
+	if i < 0 {
+		return "", 0, 0, false
+	}
+	lo64, err := strconv.ParseUint(ports[:i], 10, 16)
+	if err != nil {
+		return "", 0, 0, false
+	}
+	hi64, err := strconv.ParseUint(ports[i+1:], 10, 16)
+	if err != nil {
+		return "", 0, 0, false
+	}
+	return host, int(lo64), int(hi64), true
+}
+
+// parses the rate/size argument of --generate. the size is optional.
+func parseGenerate(s string) (int64, int, error) {
+	rateStr, sizeStr := s, ""
+	if i := strings.Index(s, "/"); i >= 0 {
+		rateStr, sizeStr = s[:i], s[i+1:]
+	}
+	rate, err := parseByteSize(rateStr)
+	if err != nil {
+		return 0, 0, fmt.Errorf("rate: %s", err)
+	}
+	size := int64(proxy.DefaultGeneratorChunkSize)
+	if sizeStr != "" {
+		size, err = parseByteSize(sizeStr)
+		if err != nil {
+			return 0, 0, fmt.Errorf("size: %s", err)
+		}
+		if size < 1 || size > 64*1024*1024 {
+			return 0, 0, fmt.Errorf("size must be between 1 and 64M (got %s)", sizeStr)
+		}
+	}
+	return rate, int(size), nil
+}
+
+// parses a number of bytes with an optional K, M or G suffix (powers of 1024) and an optional trailing B
+func parseByteSize(s string) (int64, error) {
+	num := strings.TrimSuffix(strings.ToUpper(s), "B")
+	mult := int64(1)
+	if n := len(num); n > 0 {
+		switch num[n-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		}
+		if mult != 1 {
+			num = num[:n-1]
+		}
+	}
+	v, err := strconv.ParseUint(num, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid byte size %q", s)
+	}
+	return int64(v) * mult, nil
+}
+
+// parses a bandwidth in bits per second with an optional k, M or G suffix (powers of 1000) and returns it in bytes
+// per second. an empty string or 0 means no cap.
+func parseBandwidth(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	num := s
+	mult := 1.0
+	switch num[len(num)-1] {
+	case 'k', 'K':
+		mult = 1e3
+	case 'm', 'M':
+		mult = 1e6
+	case 'g', 'G':
+		mult = 1e9
+	}
+	if mult != 1 {
+		num = num[:len(num)-1]
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid bandwidth %q", s)
+	}
+	bytesPerSec := int64(v * mult / 8)
+	if v > 0 && bytesPerSec == 0 {
+		return 0, fmt.Errorf("bandwidth %q is below 8 bits per second", s)
+	}
+	return bytesPerSec, nil
+}
+
+// formats a bandwidth in bytes per second as bits per second in the form parseBandwidth takes
+func formatBandwidth(bytesPerSec int64) string {
+	bits := float64(bytesPerSec) * 8
+	switch {
+	case bytesPerSec == 0:
+		return "0"
+	case bits >= 1e9:
+		return strconv.FormatFloat(bits/1e9, 'f', -1, 64) + "G"
+	case bits >= 1e6:
+		return strconv.FormatFloat(bits/1e6, 'f', -1, 64) + "M"
+	case bits >= 1e3:
+		return strconv.FormatFloat(bits/1e3, 'f', -1, 64) + "k"
+	}
+	return strconv.FormatFloat(bits, 'f', -1, 64)
+}
+
+// reports whether an address names a Unix domain socket, i.e. is "unix:/path", "unix-abstract:name" or "@name"
+func isUnixAddr(s string) bool {
+	_, ok := proxy.SplitUnixAddr(s)
+	return ok
+}
+
+// checks a Unix socket address. abstract sockets only exist on linux.
+func validateUnixAddr(s string) error {
+	addr, _ := proxy.SplitUnixAddr(s)
+	if addr == "" || addr == "\x00" {
+		return fmt.Errorf("missing socket path or name in address %s", s)
+	}
+	if addr[0] == 0 && runtime.GOOS != "linux" {
+		return fmt.Errorf("abstract unix socket %s is only supported on linux", s)
+	}
+	return nil
+}
+
+// parses a listen address. a bare port listens on all interfaces. "unix:/path" listens on a Unix domain socket, and
+// "unix-abstract:name" or "@name" on one in the linux abstract namespace.
+func parseListenAddr(s string) (string, error) {
+	if isUnixAddr(s) {
+		if err := validateUnixAddr(s); err != nil {
+			return "", err
+		}
+		return s, nil
+	}
+	addr := s
+	if _, err := strconv.ParseUint(addr, 10, 64); err == nil {
+		addr = ":" + addr
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", fmt.Errorf("invalid port %q in address %s. must be a number from 0 to 65535", port, s)
+	}
+	return addr, nil
 }
\ No newline at end of file
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"github.com/rs/zerolog/log"
+	"github.com/wfscot/tcp-delay-proxy/proxy"
+	"time"
+)
+
+// logs the latency each proxy actually added over the last interval, per direction. intervals without traffic are
+// skipped.
+func logAddedLatency(ctx context.Context, runner *proxyRunner, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		for _, rp := range runner.active() {
+			m, ok := rp.srv.(proxy.LatencyMeasurer)
+			if !ok {
+				continue
+			}
+			l := m.TakeAddedLatency()
+			if l.Up.Count == 0 && l.Down.Count == 0 {
+				continue
+			}
+			log.Info().Str("listenAddr", rp.def.listenAddr).Dur("upDelay", rp.def.upDelay).Dur("downDelay", rp.def.downDelay).
+				Int64("upChunks", l.Up.Count).Dur("upMean", l.Up.Mean).
+				Dur("upOverheadP50", l.Up.OverheadP50).Dur("upOverheadP95", l.Up.OverheadP95).Dur("upOverheadP99", l.Up.OverheadP99).Dur("upOverheadMax", l.Up.OverheadMax).
+				Int64("downChunks", l.Down.Count).Dur("downMean", l.Down.Mean).
+				Dur("downOverheadP50", l.Down.OverheadP50).Dur("downOverheadP95", l.Down.OverheadP95).Dur("downOverheadP99", l.Down.OverheadP99).Dur("downOverheadMax", l.Down.OverheadMax).
+				Msg("added latency")
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"github.com/rs/zerolog"
+	"github.com/wfscot/tcp-delay-proxy/proxy"
+	"os"
+)
+
+// assembles the server settings shared by all proxies. a failure to open a delay trace is logged and returned.
+func (a *cliArgs) buildServerOptions(log zerolog.Logger) ([]proxy.ServerOption, *proxy.DelayTraceWriter, error) {
+	opts := []proxy.ServerOption{
+		proxy.WithDialTimeout(*a.dialTimeout),
+		proxy.WithDialRetries(*a.dialRetries, *a.dialBackoff),
+		proxy.WithAcceptWorkers(*a.acceptWorkers),
+		proxy.WithLogger(log),
+		proxy.WithHalfCloseTimeout(*a.halfCloseTimeout),
+		proxy.WithRandomizeMax(a.randomizeMax),
+	}
+	if a.upstreamHandler != nil {
+		opts = append(opts, proxy.WithUpstreamHandler(a.upstreamHandler))
+	}
+	if *a.measure > 0 {
+		opts = append(opts, proxy.WithLatencyMeasurement())
+	}
+	if *a.recordDir != "" {
+		opts = append(opts, proxy.WithRecording(*a.recordDir))
+	}
+	if *a.ttfbDelay > 0 {
+		opts = append(opts, proxy.WithTTFBDelay(*a.ttfbDelay))
+	}
+	if a.upBandwidthRate > 0 || a.downBandwidthRate > 0 {
+		opts = append(opts, proxy.WithBandwidth(a.upBandwidthRate, a.downBandwidthRate))
+	}
+	if a.upReadRateLimit > 0 || a.downReadRateLimit > 0 {
+		opts = append(opts, proxy.WithReadRate(a.upReadRateLimit, a.downReadRateLimit))
+	}
+	if a.schedule != nil {
+		opts = append(opts, proxy.WithDelaySchedule(a.schedule.schedule, a.schedule.interval))
+	}
+	if *a.traceInPath != "" {
+		trace, err := loadDelayTrace(*a.traceInPath)
+		if err != nil {
+			log.Error().Err(err).Str("delayTraceIn", *a.traceInPath).Msg("error while loading delay trace")
+			return nil, nil, err
+		}
+		log.Info().Str("delayTraceIn", *a.traceInPath).Int("chunks", trace.Len()).Msg("loaded delay trace")
+		opts = append(opts, proxy.WithDelayTraceIn(trace, a.traceFallbackDelay))
+	}
+	var traceOut *proxy.DelayTraceWriter
+	if *a.traceOutPath != "" {
+		f, err := os.Create(*a.traceOutPath)
+		if err != nil {
+			log.Error().Err(err).Str("delayTraceOut", *a.traceOutPath).Msg("error while creating delay trace")
+			return nil, nil, err
+		}
+		traceOut = proxy.NewDelayTraceWriter(f)
+		opts = append(opts, proxy.WithDelayTraceOut(traceOut))
+	}
+	if *a.seed != 0 {
+		opts = append(opts, proxy.WithSeed(*a.seed))
+	}
+	if *a.clientNoDelay == "" {
+		*a.clientNoDelay = *a.noDelay
+	}
+	if *a.clientNoDelay != "" {
+		opts = append(opts, proxy.WithClientNoDelay(*a.clientNoDelay == "true"))
+	}
+	if *a.upstreamNoDelay == "" {
+		*a.upstreamNoDelay = *a.noDelay
+	}
+	if *a.upstreamNoDelay != "" {
+		opts = append(opts, proxy.WithUpstreamNoDelay(*a.upstreamNoDelay == "true"))
+	}
+	if *a.socks5 != "" {
+		opts = append(opts, proxy.WithSocks5(*a.socks5, *a.socks5User, *a.socks5Password))
+	}
+	if a.httpProxyURL != nil {
+		password, _ := a.httpProxyURL.User.Password()
+		opts = append(opts, proxy.WithHTTPProxy(a.httpProxyURL.Host, a.httpProxyURL.User.Username(), password))
+	}
+	if a.tlsConfig != nil {
+		opts = append(opts, proxy.WithTLSConfig(a.tlsConfig))
+	}
+	if a.upstreamTLSConfig != nil {
+		opts = append(opts, proxy.WithUpstreamTLS(a.upstreamTLSConfig))
+		if *a.upstreamALPNFromClient {
+			opts = append(opts, proxy.WithUpstreamALPNFromClient())
+		}
+	}
+	if *a.acceptProxy {
+		opts = append(opts, proxy.WithAcceptProxy())
+	}
+	if *a.statsInterval > 0 {
+		opts = append(opts, proxy.WithStatsInterval(*a.statsInterval))
+	}
+	if a.statsBytesCount > 0 {
+		opts = append(opts, proxy.WithStatsBytes(a.statsBytesCount))
+	}
+	if *a.tlsHandshakeOnly {
+		opts = append(opts, proxy.WithTLSHandshakeDelayOnly())
+	}
+	if a.sniRoutes != nil {
+		opts = append(opts, proxy.WithSNIRoutes(a.sniRoutes, *a.routeUnknown == "reject"))
+	}
+	switch *a.sendProxy {
+	case "v1":
+		opts = append(opts, proxy.WithSendProxy(proxy.ProxyProtoV1))
+	case "v2":
+		opts = append(opts, proxy.WithSendProxy(proxy.ProxyProtoV2))
+	}
+	switch *a.listenFamily {
+	case "ipv4":
+		opts = append(opts, proxy.WithListenNetwork("tcp4"))
+	case "ipv6":
+		opts = append(opts, proxy.WithListenNetwork("tcp6"))
+	}
+	switch *a.upstreamFamily {
+	case "ipv4":
+		opts = append(opts, proxy.WithUpstreamNetwork("tcp4"))
+	case "ipv6":
+		opts = append(opts, proxy.WithUpstreamNetwork("tcp6"))
+	}
+	if a.upstreamLocalAddr != nil {
+		opts = append(opts, proxy.WithUpstreamLocalAddr(a.upstreamLocalAddr))
+	}
+	if *a.tfo {
+		opts = append(opts, proxy.WithTCPFastOpen())
+	}
+	if *a.upstreamTFO {
+		opts = append(opts, proxy.WithUpstreamTCPFastOpen())
+	}
+	if *a.mptcp == "listen" || *a.mptcp == "both" {
+		opts = append(opts, proxy.WithMultipathTCP())
+	}
+	if *a.mptcp == "dial" || *a.mptcp == "both" {
+		opts = append(opts, proxy.WithUpstreamMultipathTCP())
+	}
+	if a.sockbufRecvSize > 0 || a.sockbufSendSize > 0 {
+		opts = append(opts, proxy.WithSocketBuffers(int(a.sockbufRecvSize), int(a.sockbufSendSize)))
+	}
+	if *a.dialFallbackDelay > 0 {
+		opts = append(opts, proxy.WithDialFallbackDelay(*a.dialFallbackDelay))
+	}
+	if a.sockMode != 0 {
+		opts = append(opts, proxy.WithSocketMode(os.FileMode(a.sockMode)))
+	}
+	if *a.dumpBytes != 64 {
+		opts = append(opts, proxy.WithPipeOptions(proxy.WithDumpBytes(*a.dumpBytes)))
+	}
+	if *a.writeTimeout > 0 {
+		opts = append(opts, proxy.WithPipeOptions(proxy.WithWriteTimeout(*a.writeTimeout)))
+	}
+	if *a.targetRTT > 0 {
+		log.Debug().Dur("targetRTT", *a.targetRTT).Dur("interval", *a.targetRTTInterval).Msg("enabling target rtt")
+		opts = append(opts, proxy.WithPipeOptions(proxy.WithTargetRTT(*a.targetRTT, *a.targetRTTInterval)))
+	}
+	if *a.jitter > 0 {
+		j := proxy.Jitter{Amount: *a.jitter, Correlation: a.jitterCorrelation}
+		log.Debug().Interface("jitter", j).Msg("enabling jitter")
+		opts = append(opts, proxy.WithPipeOptions(proxy.WithJitter(j)))
+	}
+	if a.queueLimitBytes > 0 {
+		opts = append(opts, proxy.WithPipeOptions(proxy.WithQueueLimit(a.queueLimitBytes)))
+	}
+	if a.bloat != nil {
+		log.Debug().Interface("bufferbloat", *a.bloat).Msg("enabling bufferbloat")
+		opts = append(opts, proxy.WithPipeOptions(proxy.WithBufferbloat(*a.bloat)))
+	}
+	if a.geP > 0 {
+		ge := proxy.GilbertElliott{P: a.geP, R: a.geR, BadDelay: *a.geBadDelay, BadLoss: a.geBadLoss}
+		log.Debug().Interface("gilbertElliott", ge).Msg("enabling gilbert-elliott model")
+		opts = append(opts, proxy.WithPipeOptions(proxy.WithGilbertElliott(ge)))
+	}
+	return opts, traceOut, nil
+}
+
+// creates the server for one proxy definition
+func (a *cliArgs) newServer(def proxyDef, opts []proxy.ServerOption, wh *webhook) proxy.Server {
+	if *a.udp {
+		return proxy.NewUdpDelayServer(def.listenAddr, def.upDelay, def.downDelay, def.upstreamAddr, *a.udpIdleTimeout)
+	}
+	srvOpts := opts[:len(opts):len(opts)]
+	if def.rerandomizeInterval > 0 {
+		srvOpts = append(srvOpts, proxy.WithRerandomizeInterval(def.rerandomizeInterval))
+	}
+	// jitter and bandwidths from the config file replace the flags
+	if def.jitter != nil {
+		srvOpts = append(srvOpts, proxy.WithPipeOptions(proxy.WithJitter(proxy.Jitter{Amount: *def.jitter, Correlation: a.jitterCorrelation})))
+	}
+	if def.upBandwidth != nil || def.downBandwidth != nil {
+		up, down := a.upBandwidthRate, a.downBandwidthRate
+		if def.upBandwidth != nil {
+			up = *def.upBandwidth
+		}
+		if def.downBandwidth != nil {
+			down = *def.downBandwidth
+		}
+		srvOpts = append(srvOpts, proxy.WithBandwidth(up, down))
+	}
+	if wh != nil {
+		srvOpts = append(srvOpts, proxy.WithHooks(wh.hooks(def.listenAddr)))
+	}
+	return proxy.NewTcpDelayServer(def.listenAddr, def.upDelay, def.downDelay, def.randomizeDelay, def.upstreamAddr, srvOpts...)
+}
+
+// reads a delay trace file
+func loadDelayTrace(path string) (*proxy.DelayTrace, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	trace, err := proxy.LoadDelayTrace(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return trace, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// returns an error if the pid file at path exists and names a live process other than this one, so that two instances
+// don't fight over the same listeners. a missing or stale file (e.g. from a crashed run) is fine.
+func checkPidFile(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err == nil && pid != os.Getpid() && processAlive(pid) {
+		return fmt.Errorf("pid file %s names running process %d. is another instance already running?", path, pid)
+	}
+	return nil
+}
+
+// writes the current pid to path after checking it with checkPidFile. a stale file is overwritten.
+func writePidFile(path string) error {
+	if err := checkPidFile(path); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+// removes the pid file, but only if it still names this process
+func removePidFile(path string) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil || strings.TrimSpace(string(b)) != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	os.Remove(path)
+}
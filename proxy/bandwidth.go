@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// defines bandwidth caps. a capped pipe paces its writes to the destination as a link of the given rate would, so a
+// chunk takes its length divided by the rate to go through on top of its delay. writes are split into slices of about
+// 10ms worth of data so that the rate holds even for large chunks. once the pipe falls behind, it stops reading until
+// it has caught up, so the sender sees the backpressure of the slow link.
+
+// read rate limits work the other way round: the pipe reads from its source at no more than the given rate, reading
+// slices of the same size and waiting between reads as the bytes read would take. the source's TCP receive window
+// fills up, so the real sender is slowed down as if the proxy were a slow consumer.
+
+// the time worth of data written or read at once by a capped pipe
+const rateSliceDuration = 10 * time.Millisecond
+
+// the smallest slice written or read at once, so that very low rates don't end up writing byte by byte
+const minRateSlice = 512
+
+// caps the rate at which the pipe writes to its destination to bytesPerSec. 0, the default, means no cap.
+func WithRateLimit(bytesPerSec int64) PipeOption {
+	return func(o *pipeOptions) {
+		o.rateLimit = bytesPerSec
+	}
+}
+
+// paces the writes or reads of a single pipe
+type ratePacer struct {
+	rate int64
+	// when the link is done with what has been written so far
+	free time.Time
+}
+
+func newRatePacer(bytesPerSec int64) *ratePacer {
+	return &ratePacer{rate: bytesPerSec}
+}
+
+// the largest slice to write at once
+func (p *ratePacer) slice() int {
+	n := int(p.rate * int64(rateSliceDuration) / int64(time.Second))
+	if n < minRateSlice {
+		n = minRateSlice
+	}
+	return n
+}
+
+// waits until the link is free. returns false if the context is done first.
+func (p *ratePacer) wait(ctx context.Context) bool {
+	wait := time.Until(p.free)
+	if wait <= 0 {
+		return true
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// records n bytes written, keeping the link busy for as long as they take at the rate. the link may fall behind by a
+// slice, so that timer overshoot doesn't lower the rate, but an idle link doesn't save up for a larger burst.
+func (p *ratePacer) sent(n int) {
+	if earliest := time.Now().Add(-rateSliceDuration); p.free.Before(earliest) {
+		p.free = earliest
+	}
+	p.free = p.free.Add(time.Duration(int64(n) * int64(time.Second) / p.rate))
+}
+
+// caps the rate at which the pipe reads from its source to bytesPerSec. 0, the default, means no cap.
+func WithReadRateLimit(bytesPerSec int64) PipeOption {
+	return func(o *pipeOptions) {
+		o.readRateLimit = bytesPerSec
+	}
+}
+
+// returns the part of b to read into next, waiting until the read rate allows another read first. returns nil if the
+// context is done while waiting.
+func (o *pipeOptions) readBuffer(ctx context.Context, b []byte) []byte {
+	if o.readPacer == nil {
+		return b
+	}
+	if !o.readPacer.wait(ctx) {
+		return nil
+	}
+	if len(b) > o.readPacer.slice() {
+		b = b[:o.readPacer.slice()]
+	}
+	return b
+}
+
+// records n bytes read from the source
+func (o *pipeOptions) countRead(n int) {
+	if o.readPacer != nil {
+		o.readPacer.sent(n)
+	}
+	if o.counters != nil && n > 0 {
+		atomic.AddInt64(&o.counters.read, int64(n))
+		atomic.StoreInt64(&o.counters.lastRead, time.Now().UnixNano())
+	}
+}
+
+// makes sessions cap the rate at which their up and down pipes read from the client and upstream in bytes per second,
+// e.g. to make the upstream believe the client is on a slow modem. 0 means no cap in that direction.
+func WithReadRate(upBytesPerSec int64, downBytesPerSec int64) ServerOption {
+	return func(s *tcpDelayServer) {
+		s.upReadRate = upBytesPerSec
+		s.downReadRate = downBytesPerSec
+	}
+}
+
+// makes sessions cap the rate of their up and down pipes in bytes per second. 0 means no cap in that direction.
+func WithBandwidth(upBytesPerSec int64, downBytesPerSec int64) ServerOption {
+	return func(s *tcpDelayServer) {
+		s.upBandwidth = upBytesPerSec
+		s.downBandwidth = downBytesPerSec
+	}
+}
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// pools of byte buffers shared by all pipes, so that sessions don't allocate a fresh read buffer per direction and the
+// delayed pipe doesn't allocate a fresh slice for every chunk it queues. buffers are grouped by capacity in powers of
+// two, so a buffer is never more than twice the size asked for.
+var bufferPools [32]sync.Pool
+
+// returns the index of the smallest power of two holding size bytes
+func bufferClass(size int) int {
+	if size <= 1 {
+		return 0
+	}
+	return bits.Len(uint(size - 1))
+}
+
+// returns a buffer of length size from the pools. pass it to putBuffer once nothing references it anymore. pointers
+// are pooled rather than slices to avoid an allocation per call.
+func getBuffer(size int) *[]byte {
+	c := bufferClass(size)
+	if c >= len(bufferPools) {
+		b := make([]byte, size)
+		return &b
+	}
+	if v := bufferPools[c].Get(); v != nil {
+		b := v.(*[]byte)
+		*b = (*b)[:size]
+		return b
+	}
+	b := make([]byte, size, 1<<uint(c))
+	return &b
+}
+
+// returns a buffer obtained from getBuffer to the pools. buffers that didn't come from them are ignored.
+func putBuffer(b *[]byte) {
+	if b == nil {
+		return
+	}
+	c := cap(*b)
+	class := bits.TrailingZeros(uint(c))
+	if c == 0 || c != 1<<uint(class) || class >= len(bufferPools) {
+		return
+	}
+	bufferPools[class].Put(b)
+}
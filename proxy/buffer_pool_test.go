@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBufferPoolSizes(t *testing.T) {
+	for _, size := range []int{1, 512, 1000, 1024 * 1024} {
+		b := getBuffer(size)
+		if len(*b) != size || cap(*b) >= 2*size+1 {
+			t.Fatalf("asked for %d bytes, got len %d cap %d", size, len(*b), cap(*b))
+		}
+		putBuffer(b)
+	}
+}
+
+// the bytes forwarded per benchmark op. with b.SetBytes, allocs/op is the allocations per MB forwarded.
+const benchBytesPerOp = 1024 * 1024
+
+// forwards b.N MB through a pipe created by newPipe in 16KB writes
+func benchmarkPipe(b *testing.B, newPipe func(src io.ReadWriteCloser, dst io.ReadWriteCloser) Pipe) {
+	client, src := tcpPair(b)
+	dst, upstream := tcpPair(b)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go newPipe(src, dst).Run(ctx)
+	drained := make(chan int64)
+	go func() {
+		n, _ := io.Copy(ioutil.Discard, upstream)
+		drained <- n
+	}()
+
+	chunk := testData(16 * 1024)
+	b.SetBytes(benchBytesPerOp)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for n := 0; n < benchBytesPerOp; n += len(chunk) {
+			if _, err := client.Write(chunk); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	client.(*net.TCPConn).CloseWrite()
+	if n := <-drained; n != int64(b.N)*benchBytesPerOp {
+		b.Fatalf("forwarded %d bytes, want %d", n, int64(b.N)*benchBytesPerOp)
+	}
+}
+
+func BenchmarkSimplePipe(b *testing.B) {
+	benchmarkPipe(b, func(src io.ReadWriteCloser, dst io.ReadWriteCloser) Pipe {
+		return NewSimplePipe(src, dst)
+	})
+}
+
+func BenchmarkDelayedPipe(b *testing.B) {
+	benchmarkPipe(b, func(src io.ReadWriteCloser, dst io.ReadWriteCloser) Pipe {
+		return NewDelayedPipe(src, dst, time.Millisecond)
+	})
+}
+
+func BenchmarkDelayedPipeSmallBuffer(b *testing.B) {
+	benchmarkPipe(b, func(src io.ReadWriteCloser, dst io.ReadWriteCloser) Pipe {
+		return NewDelayedPipe(src, dst, time.Millisecond, WithBufferSize(4096))
+	})
+}
+
+func BenchmarkDelayedPipeNoCopy(b *testing.B) {
+	benchmarkPipe(b, func(src io.ReadWriteCloser, dst io.ReadWriteCloser) Pipe {
+		return NewDelayedPipe(src, dst, time.Millisecond, WithBufferSize(4096), WithNoCopy())
+	})
+}
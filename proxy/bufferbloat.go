@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"time"
+)
+
+// defines bufferbloat, i.e. latency growing as the sender fills the buffer in front of a bottleneck link, as seen on
+// many consumer connections. each chunk's delay is increased by an amount depending on the bytes already queued in
+// the delayed pipe when it is read. the queue fills when the destination drains slower than the source sends, e.g.
+// with a bandwidth cap or a slow reader, so a fast sender sees its delay grow until the buffer is full.
+
+type Bufferbloat struct {
+	// the size of the emulated buffer in bytes. the extra delay stops growing once this many bytes are queued.
+	Buffer int64
+	// with a bandwidth in bytes per second, the extra delay is the time the queued bytes take to drain at that rate
+	Bandwidth int64
+	// without a bandwidth, the extra delay grows linearly from 0 with an empty queue to MaxDelay with a full buffer
+	MaxDelay time.Duration
+}
+
+// returns the extra delay for a chunk read while the given number of bytes are queued
+func (b Bufferbloat) extra(queued int64) time.Duration {
+	if b.Buffer <= 0 {
+		return 0
+	}
+	if queued > b.Buffer {
+		queued = b.Buffer
+	}
+	if b.Bandwidth > 0 {
+		return time.Duration(queued * int64(time.Second) / b.Bandwidth)
+	}
+	return time.Duration(float64(b.MaxDelay) * float64(queued) / float64(b.Buffer))
+}
+
+// enables bufferbloat on the pipe
+func WithBufferbloat(b Bufferbloat) PipeOption {
+	return func(o *pipeOptions) {
+		o.bufferbloat = &b
+	}
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"expvar"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// internal counters exposed via expvar for debugging. they are maintained regardless, but only published once
+// PublishDebugVars is called, so merely importing the package doesn't register anything.
+
+var (
+	// chunks waiting in delayed pipes, each with its own routine, and the bytes in them
+	debugPendingWrites int64
+	debugBytesInFlight int64
+	// client connections accepted by all servers, and errors accepting them
+	debugAccepts        int64
+	debugAcceptFailures int64
+	// panics recovered in sessions
+	debugPanics int64
+	// chunks and bytes dropped by delayed pipes because their queue limit was reached
+	debugTailDrops        int64
+	debugTailDroppedBytes int64
+)
+
+// the currently running sessions by registration number
+var debugSessions = struct {
+	sync.Mutex
+	next     int64
+	sessions map[int64]*session
+}{sessions: map[int64]*session{}}
+
+func registerSession(s *session) int64 {
+	debugSessions.Lock()
+	defer debugSessions.Unlock()
+	debugSessions.next++
+	debugSessions.sessions[debugSessions.next] = s
+	return debugSessions.next
+}
+
+func unregisterSession(id int64) {
+	debugSessions.Lock()
+	defer debugSessions.Unlock()
+	delete(debugSessions.sessions, id)
+}
+
+var publishOnce sync.Once
+
+// publishes the proxy's internal counters with expvar under the "tdp." prefix: pending delayed writes, bytes in
+// flight, accepted connections and accept errors, recovered panics, chunks and bytes dropped at queue limits and the queue depths, byte counts and last error of each active session. safe to call
+// more than once. serve them with expvar's handler, e.g. on /debug/vars of http.DefaultServeMux.
+func PublishDebugVars() {
+	publishOnce.Do(func() {
+		expvar.Publish("tdp.pendingDelayedWrites", expvar.Func(func() interface{} {
+			return atomic.LoadInt64(&debugPendingWrites)
+		}))
+		expvar.Publish("tdp.bytesInFlight", expvar.Func(func() interface{} {
+			return atomic.LoadInt64(&debugBytesInFlight)
+		}))
+		expvar.Publish("tdp.accepts", expvar.Func(func() interface{} {
+			return atomic.LoadInt64(&debugAccepts)
+		}))
+		expvar.Publish("tdp.acceptFailures", expvar.Func(func() interface{} {
+			return atomic.LoadInt64(&debugAcceptFailures)
+		}))
+		expvar.Publish("tdp.panics", expvar.Func(func() interface{} {
+			return atomic.LoadInt64(&debugPanics)
+		}))
+		expvar.Publish("tdp.tailDrops", expvar.Func(func() interface{} {
+			return atomic.LoadInt64(&debugTailDrops)
+		}))
+		expvar.Publish("tdp.tailDroppedBytes", expvar.Func(func() interface{} {
+			return atomic.LoadInt64(&debugTailDroppedBytes)
+		}))
+		expvar.Publish("tdp.sessions", expvar.Func(func() interface{} {
+			debugSessions.Lock()
+			defer debugSessions.Unlock()
+			sessions := make(map[string]interface{}, len(debugSessions.sessions))
+			for id, s := range debugSessions.sessions {
+				sessions[strconv.FormatInt(id, 10)] = s.debugInfo()
+			}
+			return sessions
+		}))
+	})
+}
@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// defines the seam through which a delayed pipe obtains the base delay for each chunk it reads.
+// the provider is consulted by the pipe's read routine once per chunk, after which any per-chunk impairment models
+// (e.g. Gilbert-Elliott) are applied on top.
+
+type delayProvider interface {
+	delay() time.Duration
+}
+
+// a fixed delay. this is the default if nothing else is configured.
+type staticDelay time.Duration
+
+func (d staticDelay) delay() time.Duration {
+	return time.Duration(d)
+}
+
+// a delay that can be changed while pipes are running. chunks already queued keep the delay they were given.
+type variableDelay struct {
+	d int64
+}
+
+func newVariableDelay(d time.Duration) *variableDelay {
+	return &variableDelay{d: int64(d)}
+}
+
+func (v *variableDelay) delay() time.Duration {
+	return time.Duration(atomic.LoadInt64(&v.d))
+}
+
+func (v *variableDelay) set(d time.Duration) {
+	atomic.StoreInt64(&v.d, int64(d))
+}
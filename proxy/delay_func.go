@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"golang.org/x/exp/rand"
+	"gonum.org/v1/gonum/stat/distuv"
+	"sync"
+	"time"
+)
+
+// defines pluggable delay models.
+// a DelayFunc replaces the base delay of a delayed pipe. it is consulted once for every chunk read, and impairment
+// models like Gilbert-Elliott are still applied on top. library users can supply their own, e.g. to replay the delays
+// of a captured trace.
+
+type DelayFunc interface {
+	// returns the delay for a chunk of chunkLen bytes read elapsed after the pipe started
+	Next(chunkLen int, elapsed time.Duration) time.Duration
+}
+
+// a fixed delay for every chunk
+type StaticDelay time.Duration
+
+func (d StaticDelay) Next(chunkLen int, elapsed time.Duration) time.Duration {
+	return time.Duration(d)
+}
+
+// a base delay offset by correlated per-chunk jitter, as with WithJitter
+type jitteredDelay struct {
+	base time.Duration
+	mu   sync.Mutex
+	s    *jitterState
+}
+
+// returns a DelayFunc adding jitter to base. the delay never goes below zero. without a seed, a time based seed is
+// used. the returned value is safe to share between pipes, which then draw from the same sequence.
+func NewJitteredDelay(base time.Duration, jitter Jitter, seed uint64) DelayFunc {
+	return &jitteredDelay{base: base, s: newJitterState(jitter, newSeededRand(seed))}
+}
+
+func (d *jitteredDelay) Next(chunkLen int, elapsed time.Duration) time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delay := d.base + d.s.next()
+	if delay < 0 {
+		delay = 0
+	}
+	return delay
+}
+
+// a per-chunk delay drawn from a log-normal distribution
+type logNormalDelay struct {
+	median time.Duration
+	mu     sync.Mutex
+	dist   distuv.LogNormal
+}
+
+// returns a DelayFunc drawing each chunk's delay from a log-normal distribution with the given median and sigma (the
+// standard deviation of the underlying normal distribution). the mean is e^(sigma²/2) times the median. unlike
+// --randomizedelay, which draws once per session and scales so that the configured delay is the mean, this draws per
+// chunk around the median. without a seed, a time based seed is used.
+func NewLogNormalDelay(median time.Duration, sigma float64, seed uint64) DelayFunc {
+	return &logNormalDelay{
+		median: median,
+		dist:   distuv.LogNormal{Mu: 0, Sigma: sigma, Src: rand.NewSource(seedOrNow(seed))},
+	}
+}
+
+func (d *logNormalDelay) Next(chunkLen int, elapsed time.Duration) time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return scaleDelay(d.median, d.dist.Rand())
+}
+
+// returns seed, or a time based seed if it is zero
+func seedOrNow(seed uint64) uint64 {
+	if seed == 0 {
+		return uint64(time.Now().UnixNano())
+	}
+	return seed
+}
+
+func newSeededRand(seed uint64) *rand.Rand {
+	return rand.New(rand.NewSource(seedOrNow(seed)))
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"golang.org/x/exp/rand"
+	"math"
+	"testing"
+	"time"
+)
+
+// each way of drawing random delays averages out to the delay it is configured with
+func TestRandomDelayMeans(t *testing.T) {
+	const n = 200000
+	const delay = 150 * time.Millisecond
+
+	unclamped := NewTcpDelayServer("", delay, delay, true, "", WithRandomizeMax(0)).(*tcpDelayServer)
+	clamped := NewTcpDelayServer("", delay, delay, true, "").(*tcpDelayServer)
+	dists := []struct {
+		name string
+		next func() time.Duration
+		mean time.Duration
+	}{
+		{
+			name: "randomized",
+			next: randomizedDelay(unclamped, delay),
+			mean: delay,
+		},
+		{
+			// the clamp lowers the mean by about 1%
+			name: "randomized and clamped",
+			next: randomizedDelay(clamped, delay),
+			mean: delay,
+		},
+		{
+			name: "jittered",
+			next: delayFuncSampler(NewJitteredDelay(delay, Jitter{Amount: 20 * time.Millisecond, Correlation: 0.5}, 42)),
+			mean: delay,
+		},
+		{
+			// the log-normal delay is drawn around the median instead
+			name: "log-normal",
+			next: delayFuncSampler(NewLogNormalDelay(delay, 0.5, 42)),
+			mean: time.Duration(float64(delay) * math.Exp(0.5*0.5/2)),
+		},
+	}
+	for _, dist := range dists {
+		sum := 0.0
+		for i := 0; i < n; i++ {
+			sum += float64(dist.next())
+		}
+		mean := sum / n
+		if rel := math.Abs(mean-float64(dist.mean)) / float64(dist.mean); rel > 0.03 {
+			t.Errorf("%s: got a mean of %s, want %s", dist.name, time.Duration(mean), dist.mean)
+		}
+	}
+}
+
+func TestRandomizeClamp(t *testing.T) {
+	s := NewTcpDelayServer("", 0, 0, true, "", WithRandomizeMax(3)).(*tcpDelayServer)
+	if got, want := s.randomize(100*time.Millisecond, 1000), 300*time.Millisecond; got != want {
+		t.Fatalf("got %s for a huge factor, want the %s limit", got, want)
+	}
+	if got, want := s.randomize(100*time.Millisecond, 0.5), 50*time.Millisecond; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+// draws session delays the way the server does for randomized delays
+func randomizedDelay(s *tcpDelayServer, d time.Duration) func() time.Duration {
+	dist := newRandomizeDist(rand.NewSource(42))
+	return func() time.Duration {
+		return s.randomize(d, dist.Rand())
+	}
+}
+
+func delayFuncSampler(f DelayFunc) func() time.Duration {
+	return func() time.Duration {
+		return f.Next(1024, 0)
+	}
+}
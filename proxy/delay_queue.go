@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+)
+
+// the chunks of a delayed pipe waiting to be written, in the order they were read. the read routine pushes chunks
+// with their due time and the write routine takes them from the head once they are due, so chunks can't overtake each
+// other even if their delays differ. a chunk whose delay has passed simply waits for the ones before it.
+type delayQueue struct {
+	mu     sync.Mutex
+	chunks []delayedWrite
+	closed bool
+	// the bytes in the queued chunks
+	bytes int64
+
+	// the maximum number of chunks in the queue. push blocks while it is full.
+	depth int
+
+	// signalled when a chunk is pushed or the queue is closed (pushed), and when a chunk is removed (popped)
+	pushed chan struct{}
+	popped chan struct{}
+}
+
+func newDelayQueue(depth int) *delayQueue {
+	if depth < 1 {
+		depth = 1
+	}
+	return &delayQueue{depth: depth, pushed: make(chan struct{}, 1), popped: make(chan struct{}, 1)}
+}
+
+// wakes up a routine waiting on c without blocking
+func wake(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// appends a chunk, waiting for room if the queue is full. returns false if ctx is done first.
+func (q *delayQueue) push(ctx context.Context, dw delayedWrite) bool {
+	for {
+		q.mu.Lock()
+		if len(q.chunks) < q.depth {
+			q.chunks = append(q.chunks, dw)
+			q.bytes += int64(len(dw.bbuf))
+			q.mu.Unlock()
+			wake(q.pushed)
+			return true
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return false
+
+		case <-q.popped:
+		}
+	}
+}
+
+// waits until the queue has room for another chunk. returns false if ctx is done first.
+func (q *delayQueue) waitRoom(ctx context.Context) bool {
+	for {
+		q.mu.Lock()
+		room := len(q.chunks) < q.depth
+		q.mu.Unlock()
+		if room {
+			return true
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+
+		case <-q.popped:
+		}
+	}
+}
+
+// marks the end of the chunks. the write routine finishes once it has written the ones already queued.
+func (q *delayQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	wake(q.pushed)
+}
+
+// returns the chunk at the head of the queue without removing it, waiting for one if the queue is empty. returns false
+// once the queue is closed and empty, or if ctx is done first.
+func (q *delayQueue) head(ctx context.Context) (delayedWrite, bool) {
+	for {
+		q.mu.Lock()
+		if len(q.chunks) > 0 {
+			dw := q.chunks[0]
+			q.mu.Unlock()
+			return dw, true
+		}
+		closed := q.closed
+		q.mu.Unlock()
+		if closed {
+			return delayedWrite{}, false
+		}
+
+		select {
+		case <-ctx.Done():
+			return delayedWrite{}, false
+
+		case <-q.pushed:
+		}
+	}
+}
+
+// removes the chunk at the head of the queue
+func (q *delayQueue) pop() {
+	q.mu.Lock()
+	q.bytes -= int64(len(q.chunks[0].bbuf))
+	q.chunks[0] = delayedWrite{}
+	q.chunks = q.chunks[1:]
+	q.mu.Unlock()
+	wake(q.popped)
+}
+
+// removes and returns all queued chunks
+func (q *delayQueue) drain() []delayedWrite {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	chunks := q.chunks
+	q.chunks = nil
+	q.bytes = 0
+	return chunks
+}
+
+// returns the bytes in the queued chunks. the write routine pops a chunk before writing it, so the one being written
+// doesn't count.
+func (q *delayQueue) queuedBytes() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.bytes
+}
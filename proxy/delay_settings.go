@@ -0,0 +1,20 @@
+package proxy
+
+import (
+	"time"
+)
+
+// the delay settings of a server. they can be changed while the server runs, e.g. from an admin API.
+type DelaySettings struct {
+	UpDelay        time.Duration
+	DownDelay      time.Duration
+	RandomizeDelay bool
+}
+
+// implemented by servers whose delay settings can be changed at runtime. new sessions always use the current
+// settings. with applyExisting, sessions that are already running pick them up for chunks read after the change.
+// sessions that were started without any delay or impairment use simple pipes and aren't affected.
+type DelayConfigurable interface {
+	DelaySettings() DelaySettings
+	SetDelaySettings(settings DelaySettings, applyExisting bool)
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defines traces of the delay decisions of delayed pipes, so that a run with random delays can be reproduced exactly.
+// a trace has one line per chunk: the session's connection number, the direction, the chunk's index within its pipe
+// starting at 1 and the delay applied to it, or "drop" for a chunk dropped by an impairment model, e.g.
+//
+//	3 up 17 152.301ms
+//
+// chunks are looked up by session, direction and index, so a trace still applies when sessions interleave differently
+// than in the traced run. sessions are numbered in the order they are accepted, though, so they have to connect in the
+// same order. empty lines and lines starting with # are ignored.
+
+// writes the delay decisions of delayed pipes as a trace. it is safe to share between sessions.
+type DelayTraceWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	err error
+}
+
+func NewDelayTraceWriter(w io.Writer) *DelayTraceWriter {
+	return &DelayTraceWriter{w: w}
+}
+
+func (t *DelayTraceWriter) write(session int64, direction string, index int64, delay time.Duration, drop bool) {
+	decision := delay.String()
+	if drop {
+		decision = "drop"
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err == nil {
+		_, t.err = fmt.Fprintf(t.w, "%d %s %d %s\n", session, direction, index, decision)
+	}
+}
+
+// returns the first error writing the trace. nothing more is written after an error.
+func (t *DelayTraceWriter) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+type delayTraceKey struct {
+	session   int64
+	direction string
+	index     int64
+}
+
+type delayTraceEntry struct {
+	delay time.Duration
+	drop  bool
+}
+
+// a trace read by LoadDelayTrace
+type DelayTrace struct {
+	entries map[delayTraceKey]delayTraceEntry
+}
+
+// reads a trace as written by a DelayTraceWriter. errors name the offending line.
+func LoadDelayTrace(r io.Reader) (*DelayTrace, error) {
+	t := &DelayTrace{entries: make(map[delayTraceKey]delayTraceEntry)}
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("line %d: expected session, direction, index and delay but got %d fields", line, len(fields))
+		}
+		session, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid session %q", line, fields[0])
+		}
+		if fields[1] != "up" && fields[1] != "down" {
+			return nil, fmt.Errorf("line %d: direction must be up or down (got %q)", line, fields[1])
+		}
+		index, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil || index < 1 {
+			return nil, fmt.Errorf("line %d: invalid chunk index %q", line, fields[2])
+		}
+		var e delayTraceEntry
+		if fields[3] == "drop" {
+			e.drop = true
+		} else if e.delay, err = time.ParseDuration(fields[3]); err != nil || e.delay < 0 {
+			return nil, fmt.Errorf("line %d: invalid delay %q", line, fields[3])
+		}
+		t.entries[delayTraceKey{session, fields[1], index}] = e
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// the number of chunks in the trace
+func (t *DelayTrace) Len() int {
+	return len(t.entries)
+}
+
+// makes the server write the delay decisions of its sessions to the given trace
+func WithDelayTraceOut(w *DelayTraceWriter) ServerOption {
+	return func(s *tcpDelayServer) {
+		s.traceOut = w
+	}
+}
+
+// makes the server's sessions take their delay decisions from the given trace instead of the delay models. chunks
+// missing from the trace, e.g. because it ran out, get the fallback delay, or the delay they would have gotten without
+// the trace if fallback is negative.
+func WithDelayTraceIn(t *DelayTrace, fallback time.Duration) ServerOption {
+	return func(s *tcpDelayServer) {
+		s.traceIn = t
+		s.traceFallback = fallback
+	}
+}
+
+// the trace settings of a session's pipes
+type delayTracing struct {
+	in       *DelayTrace
+	fallback time.Duration
+	out      *DelayTraceWriter
+	session  int64
+}
+
+// makes a delayed pipe trace its delay decisions as part of the given session
+func withDelayTracing(t *delayTracing) PipeOption {
+	return func(o *pipeOptions) {
+		o.tracing = t
+	}
+}
+
+// returns the delay decision for the chunk with the given index, taking it from the trace if there is one, and writes
+// it to the trace output
+func (o *pipeOptions) traceDelay(index int64, delay time.Duration, drop bool) (time.Duration, bool) {
+	t := o.tracing
+	if t == nil {
+		return delay, drop
+	}
+	if t.in != nil {
+		if e, ok := t.in.entries[delayTraceKey{t.session, o.direction, index}]; ok {
+			delay, drop = e.delay, e.drop
+		} else if t.fallback >= 0 {
+			delay, drop = t.fallback, false
+		}
+	}
+	if t.out != nil {
+		t.out.write(t.session, o.direction, index, delay, drop)
+	}
+	return delay, drop
+}
@@ -0,0 +1,206 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	"net"
+	"syscall"
+	"time"
+)
+
+// handles establishing the upstream connection for a session, including the dial timeout and retrying transient
+// failures with exponential backoff. the connection may be established through a SOCKS5 or HTTP CONNECT proxy, or to
+// an internal handler instead of a real upstream.
+
+// establishes upstream connections. *net.Dialer implements this, and so can in-memory transports used in tests.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+type dialConfig struct {
+	// nil uses a net.Dialer
+	dialer  Dialer
+	timeout time.Duration
+	retries int
+	backoff time.Duration
+	noDelay *bool
+	// the network direct upstream connections are dialed with, "tcp" if empty
+	network string
+	// how long the dialer waits before racing the other address family, 0 for Go's default
+	fallbackDelay time.Duration
+	// the local address direct upstream connections originate from. nil lets the OS choose.
+	localAddr *net.TCPAddr
+	// SO_RCVBUF and SO_SNDBUF of client and direct upstream connections. 0 keeps the kernel's default.
+	recvBuf int
+	sendBuf int
+	// sets TCP_FASTOPEN_CONNECT on upstream connections
+	fastOpen bool
+	// requests multipath TCP for upstream connections
+	multipathTCP bool
+	socks5       *socks5Config
+	http         *httpProxyConfig
+	// serves sessions internally instead of dialing the upstream
+	handler UpstreamHandler
+}
+
+// dials the upstream, retrying transient failures. waiting between attempts respects context cancellation so that
+// shutdown isn't delayed by a retry loop.
+func (dc dialConfig) dial(ctx context.Context, log zerolog.Logger, addr string) (net.Conn, error) {
+	backoff := dc.backoff
+	for attempt := 0; ; attempt++ {
+		conn, err := dc.dialOnce(ctx, addr)
+		if err == nil {
+			if dc.noDelay != nil {
+				if err := setNoDelay(conn, *dc.noDelay); err != nil {
+					log.Warn().Err(err).Bool("noDelay", *dc.noDelay).Msg("error while setting TCP_NODELAY on upstream connection")
+				}
+			}
+			logSocketBuffers(log, conn, "upstream", dc.recvBuf, dc.sendBuf)
+			return conn, nil
+		}
+		if attempt >= dc.retries || !isTransientDialErr(err) {
+			return nil, fmt.Errorf("giving up on upstream %s after %d attempt(s): %w", addr, attempt+1, err)
+		}
+		log.Warn().Err(err).Int("attempt", attempt+1).Dur("backoff", backoff).Msg("upstream dial failed. retrying.")
+
+		t := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+
+		case <-t.C:
+		}
+		backoff *= 2
+	}
+}
+
+// connects to addr with the configured dialer, from localAddr if given, giving up after the dial timeout or once ctx
+// is done. a net.Dialer dials hosts with both IPv4 and IPv6 addresses Happy Eyeballs style (RFC 6555), i.e. it starts
+// on the other family after the fallback delay and uses whichever connects first, so a blackholed family doesn't hold
+// up the dial.
+func (dc dialConfig) dialContext(ctx context.Context, network string, addr string, localAddr *net.TCPAddr) (net.Conn, error) {
+	if dc.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dc.timeout)
+		defer cancel()
+	}
+	d := dc.dialer
+	if d == nil {
+		nd := &net.Dialer{FallbackDelay: dc.fallbackDelay}
+		if localAddr != nil {
+			nd.LocalAddr = localAddr
+		}
+		if dc.recvBuf > 0 || dc.sendBuf > 0 {
+			nd.Control = socketBuffersControl(dc.recvBuf, dc.sendBuf)
+		}
+		if dc.fastOpen && network != "unix" {
+			nd.Control = chainControl(nd.Control, tfoConnectControl)
+		}
+		if dc.multipathTCP {
+			setDialMultipathTCP(nd)
+		}
+		d = nd
+	}
+	return d.DialContext(ctx, network, addr)
+}
+
+// makes a single attempt at connecting to the upstream, either directly or through the configured proxy
+func (dc dialConfig) dialOnce(ctx context.Context, addr string) (net.Conn, error) {
+	if dc.handler != nil {
+		return dialHandler(ctx, dc.handler)
+	}
+	// Unix socket upstreams are local, so they are always dialed directly
+	if unixAddr, ok := SplitUnixAddr(addr); ok {
+		conn, err := dc.dialContext(ctx, "unix", unixAddr, nil)
+		return conn, printableUnixErr(err)
+	}
+	if dc.http != nil {
+		conn, err := dc.dialContext(ctx, "tcp", dc.http.addr, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to http proxy %s: %w", dc.http.addr, err)
+		}
+		tunnel, err := dc.http.connect(conn, addr, dc.timeout)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tunnel, nil
+	}
+	if dc.socks5 == nil {
+		network := dc.network
+		if network == "" {
+			network = "tcp"
+		}
+		conn, err := dc.dialContext(ctx, network, addr, dc.localAddr)
+		if dc.localAddr != nil && (errors.Is(err, syscall.EADDRNOTAVAIL) || errors.Is(err, syscall.EADDRINUSE)) {
+			// name the address, since the error alone doesn't say which side is at fault
+			return nil, fmt.Errorf("can't bind upstream connection to local address %s: %w", dc.localAddr, err)
+		}
+		return conn, err
+	}
+
+	// errors reaching the SOCKS5 proxy itself are reported as such so they can be told apart from the proxy failing
+	// to reach the upstream
+	conn, err := dc.dialContext(ctx, "tcp", dc.socks5.addr, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to socks5 proxy %s: %w", dc.socks5.addr, err)
+	}
+	if err := dc.socks5.connect(conn, addr, dc.timeout); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// describes the proxy the upstream is reached through, if any
+func (dc dialConfig) via() string {
+	if dc.handler != nil {
+		return "internal handler"
+	}
+	if dc.socks5 != nil {
+		return "socks5 " + dc.socks5.addr
+	}
+	if dc.http != nil {
+		return "http " + dc.http.addr
+	}
+	return ""
+}
+
+// indicates whether a dial error is worth retrying, e.g. a refused connection while the upstream is restarting, as
+// opposed to something permanent like an unknown host
+func isTransientDialErr(err error) bool {
+	var socksErr *socks5ReplyError
+	if errors.As(err, &socksErr) {
+		return socksErr.transient()
+	}
+	var httpErr *httpProxyError
+	if errors.As(err, &httpErr) {
+		return httpErr.transient()
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	// custom dialers may report the dial timeout as the context's error
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.Temporary()
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETUNREACH)
+}
+
+// sets TCP_NODELAY if the connection is a TCP connection
+func setNoDelay(conn net.Conn, noDelay bool) error {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	return tc.SetNoDelay(noDelay)
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"github.com/rs/zerolog"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// a Dialer that blocks until the context is done, like a dial to a blackholed address
+type blackholeDialer struct{}
+
+func (blackholeDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// a Dialer whose upstream refuses every connection
+type refusingDialer struct{}
+
+func (refusingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return nil, &net.OpError{Op: "dial", Net: network, Err: syscall.ECONNREFUSED}
+}
+
+// dials with dc, cancelling the context after cancelAfter, and returns how long the dial took along with its error
+func dialCancelled(dc dialConfig, addr string, cancelAfter time.Duration) (time.Duration, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	time.AfterFunc(cancelAfter, cancel)
+	start := time.Now()
+	conn, err := dc.dial(ctx, zerolog.Nop(), addr)
+	if conn != nil {
+		conn.Close()
+	}
+	return time.Since(start), err
+}
+
+func TestDialCancelUnroutable(t *testing.T) {
+	// a TEST-NET-1 address, which nothing answers
+	const addr = "192.0.2.1:81"
+	took, err := dialCancelled(dialConfig{}, addr, 100*time.Millisecond)
+	if err != nil && !errors.Is(err, context.Canceled) && took < 100*time.Millisecond {
+		t.Skipf("%s fails right away in this environment: %s", addr, err)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want a context error", err)
+	}
+	if took > time.Second {
+		t.Fatalf("dial took %s to notice the cancellation", took)
+	}
+}
+
+func TestDialCancelBlocked(t *testing.T) {
+	took, err := dialCancelled(dialConfig{dialer: blackholeDialer{}}, "upstream:80", 50*time.Millisecond)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want a context error", err)
+	}
+	if took > time.Second {
+		t.Fatalf("dial took %s to notice the cancellation", took)
+	}
+}
+
+func TestDialCancelDuringBackoff(t *testing.T) {
+	dc := dialConfig{dialer: refusingDialer{}, retries: 5, backoff: time.Minute}
+	took, err := dialCancelled(dc, "upstream:80", 50*time.Millisecond)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want a context error", err)
+	}
+	if took > time.Second {
+		t.Fatalf("dial took %s to notice the cancellation", took)
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	dc := dialConfig{dialer: blackholeDialer{}, timeout: 50 * time.Millisecond}
+	took, err := dialCancelled(dc, "upstream:80", time.Minute)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the dial timeout", err)
+	}
+	if took > time.Second {
+		t.Fatalf("dial took %s with a %s timeout", took, dc.timeout)
+	}
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"syscall"
+)
+
+// the failure modes of a session. errors returned by sessions (and passed to hooks) wrap one of these along with the
+// underlying error, so callers can tell them apart with errors.Is and still get at the cause with errors.As. the
+// message is that of the underlying error.
+var (
+	// the upstream couldn't be reached
+	ErrUpstreamDial = errors.New("upstream dial failed")
+
+	// the PROXY protocol header for the upstream couldn't be built, e.g. because of an unsupported version
+	ErrProxyHeader = errors.New("PROXY protocol header failed")
+
+	// the TLS handshake with the upstream failed, e.g. because its certificate doesn't verify
+	ErrUpstreamTLS = errors.New("upstream TLS handshake failed")
+
+	// reading from or writing to the client connection failed, e.g. because the client reset it mid-stream
+	ErrClientClosed = errors.New("client connection failed")
+
+	// reading from or writing to the upstream connection failed
+	ErrUpstreamClosed = errors.New("upstream connection failed")
+
+	// a pipe gave up because a write made no progress, e.g. it stalled past the write timeout
+	ErrPipeAborted = errors.New("pipe aborted")
+
+	// a Transformer rejected a chunk
+	ErrTransform = errors.New("transformer failed")
+
+	// code running the session panicked, e.g. a Transformer. the panic only ends the session.
+	ErrPanic = errors.New("session panicked")
+
+	// a pipe's destination was closed by its peer while the pipe was still forwarding to it. the pipe stops reading
+	// rather than discarding what it reads. sessions report it along with ErrClientClosed or ErrUpstreamClosed.
+	ErrDestinationClosed = errors.New("destination closed")
+)
+
+// an error of one of the kinds above
+type kindError struct {
+	kind error
+	err  error
+}
+
+func wrapErr(kind error, err error) error {
+	return &kindError{kind: kind, err: err}
+}
+
+func (e *kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kindError) Unwrap() error {
+	return e.err
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+// returned by the pipes when reading from their source or writing to their destination fails. the session turns it
+// into ErrClientClosed or ErrUpstreamClosed depending on the direction of the pipe.
+type pipeIOError struct {
+	read bool
+	err  error
+}
+
+func (e *pipeIOError) Error() string {
+	return e.err.Error()
+}
+
+func (e *pipeIOError) Unwrap() error {
+	return e.err
+}
+
+// indicates whether a write failed because the peer closed the destination
+func isDestClosed(err error) bool {
+	return err == io.EOF || errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// returns the error for a failed write to the destination, telling a closed destination apart from other failures
+func writeErr(err error) error {
+	if isDestClosed(err) {
+		err = wrapErr(ErrDestinationClosed, err)
+	}
+	return &pipeIOError{err: err}
+}
+
+// attributes a pipe error to the connection it happened on. the up pipe reads from the client and writes to the
+// upstream, and the down pipe the other way around.
+func classifyPipeErr(err error, up bool) error {
+	var ioErr *pipeIOError
+	if !errors.As(err, &ioErr) {
+		return err
+	}
+	if ioErr.read == up {
+		return wrapErr(ErrClientClosed, err)
+	}
+	return wrapErr(ErrUpstreamClosed, err)
+}
+
+// keeps the first error reported by routines running concurrently. later errors are usually a consequence of the
+// teardown the first one caused.
+type firstError struct {
+	mu  sync.Mutex
+	err error
+}
+
+func (f *firstError) set(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err == nil {
+		f.err = err
+	}
+}
+
+func (f *firstError) get() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// run with -race
+func TestFirstErrorConcurrent(t *testing.T) {
+	var first firstError
+	errs := make([]error, 100)
+	wg := sync.WaitGroup{}
+	for i := range errs {
+		errs[i] = fmt.Errorf("error %d", i)
+		wg.Add(1)
+		go func(err error) {
+			defer wg.Done()
+			first.set(err)
+			first.get()
+		}(errs[i])
+	}
+	wg.Wait()
+
+	got := first.get()
+	found := false
+	for _, err := range errs {
+		found = found || err == got
+	}
+	if !found {
+		t.Fatalf("got %v, want one of the errors set", got)
+	}
+	first.set(errors.New("later"))
+	if first.get() != got {
+		t.Fatalf("a later error replaced %v", got)
+	}
+}
+
+func TestClassifyPipeErr(t *testing.T) {
+	readErr := &pipeIOError{read: true, err: syscall.ECONNRESET}
+	writeErr := writeErr(syscall.EPIPE)
+	for _, c := range []struct {
+		err  error
+		up   bool
+		want error
+	}{
+		{readErr, true, ErrClientClosed},
+		{readErr, false, ErrUpstreamClosed},
+		{writeErr, true, ErrUpstreamClosed},
+		{writeErr, false, ErrClientClosed},
+	} {
+		err := classifyPipeErr(c.err, c.up)
+		if !errors.Is(err, c.want) {
+			t.Errorf("%v with up %t: got %v, want %v", c.err, c.up, err, c.want)
+		}
+	}
+	if err := classifyPipeErr(writeErr, true); !errors.Is(err, ErrDestinationClosed) || !errors.Is(err, syscall.EPIPE) {
+		t.Errorf("got %v, want a closed destination wrapping EPIPE", err)
+	}
+	if err := classifyPipeErr(io.ErrUnexpectedEOF, true); err != io.ErrUnexpectedEOF {
+		t.Errorf("got %v for an error from neither connection", err)
+	}
+}
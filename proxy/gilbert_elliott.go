@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"github.com/rs/zerolog"
+	"golang.org/x/exp/rand"
+	"time"
+)
+
+// defines a two-state Gilbert-Elliott model for bursty impairment.
+// the pipe alternates between a "good" state, in which chunks receive the normal delay, and a "bad" state, in which
+// chunks receive additional delay and may optionally be dropped. state transitions are evaluated once per chunk, so
+// the mean burst length in the bad state is 1/R chunks.
+
+type GilbertElliott struct {
+	// probability of moving from the good state to the bad state, evaluated per chunk
+	P float64
+	// probability of moving from the bad state back to the good state, evaluated per chunk
+	R float64
+	// additional delay applied to each chunk while in the bad state
+	BadDelay time.Duration
+	// probability of dropping a chunk while in the bad state. note that dropping chunks silently loses data and
+	// breaks TCP semantics for the endpoints. use with care.
+	BadLoss float64
+}
+
+// per-pipe state of the model
+type gilbertElliottState struct {
+	params GilbertElliott
+	rng    *rand.Rand
+	bad    bool
+}
+
+func newGilbertElliottState(params GilbertElliott, rng *rand.Rand) *gilbertElliottState {
+	return &gilbertElliottState{params: params, rng: rng}
+}
+
+// evaluates the state transition for a new chunk and returns the additional delay to apply as well as whether the
+// chunk should be dropped
+func (s *gilbertElliottState) next(log zerolog.Logger) (time.Duration, bool) {
+	if s.bad {
+		if s.rng.Float64() < s.params.R {
+			s.bad = false
+			log.Debug().Str("from", "bad").Str("to", "good").Msg("gilbert-elliott state transition")
+		}
+	} else {
+		if s.rng.Float64() < s.params.P {
+			s.bad = true
+			log.Debug().Str("from", "good").Str("to", "bad").Msg("gilbert-elliott state transition")
+		}
+	}
+
+	// nothing to do in the good state
+	if !s.bad {
+		return 0, false
+	}
+
+	drop := s.params.BadLoss > 0 && s.rng.Float64() < s.params.BadLoss
+	return s.params.BadDelay, drop
+}
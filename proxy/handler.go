@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// defines internal upstreams. instead of dialing out, each session can be served by a handler running inside the
+// proxy, e.g. to echo everything back as a quick latency playground without having to set up an upstream, or to
+// sink or generate traffic for benchmarking the proxy itself.
+
+// serves the upstream side of a session. conn behaves like a TCP connection from the proxy: reads return what the
+// client sent once the up delay has passed, and writes reach the client after the down delay. it can be half-closed
+// via CloseWrite. the handler should return once conn fails, which happens once the session has ended. conn is closed
+// after the handler returns.
+type UpstreamHandler func(conn net.Conn)
+
+// writes everything read back to the client and passes on the client's half-close
+func EchoHandler(conn net.Conn) {
+	io.Copy(conn, conn)
+	closeWrite(conn)
+}
+
+// reads and discards everything the client sends, e.g. to measure how much the proxy can forward upstream. the
+// client's half-close is passed back so it sees the end of the stream.
+func SinkHandler(conn net.Conn) {
+	io.Copy(ioutil.Discard, conn)
+	closeWrite(conn)
+}
+
+// the chunk size of NewGeneratorHandler if none is given
+const DefaultGeneratorChunkSize = 32 * 1024
+
+// returns a handler writing filler data to the client in chunks of size bytes at rate bytes per second, e.g. to measure
+// how much the proxy can forward downstream. a rate of 0 writes as fast as the client reads, and a size that isn't
+// positive uses DefaultGeneratorChunkSize. anything the client sends is discarded. the handler keeps writing until the
+// session ends.
+func NewGeneratorHandler(rate int64, size int) UpstreamHandler {
+	if size < 1 {
+		size = DefaultGeneratorChunkSize
+	}
+	return func(conn net.Conn) {
+		go io.Copy(ioutil.Discard, conn)
+
+		chunk := make([]byte, size)
+		start := time.Now()
+		var sent int64
+		for {
+			// pace by the total sent so far rather than per chunk, so that sleeping late doesn't lower the rate
+			if rate > 0 {
+				due := start.Add(time.Duration(float64(sent) / float64(rate) * float64(time.Second)))
+				if wait := time.Until(due); wait > 0 {
+					time.Sleep(wait)
+				}
+			}
+			n, err := conn.Write(chunk)
+			sent += int64(n)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// creates a session served by EchoHandler. everything the client sends comes back after both the up and the down
+// delay.
+func NewEchoSession(upDelay time.Duration, downDelay time.Duration, clientConn net.Conn, pipeOpts ...PipeOption) Session {
+	c := newSession(upDelay, downDelay, clientConn, "echo", pipeOpts)
+	c.dial.handler = EchoHandler
+	return c
+}
+
+// connects a session to its handler. the session's end is returned and the handler runs on the other one. a real
+// loopback connection is used rather than an in-memory one so that deadlines, half-closes and socket options behave
+// exactly as they do for a dialed upstream.
+func dialHandler(ctx context.Context, handler UpstreamHandler) (net.Conn, error) {
+	near, far, err := loopbackPair(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to internal handler: %w", err)
+	}
+	go func() {
+		handler(far)
+		far.Close()
+	}()
+	return near, nil
+}
+
+// returns both ends of a new TCP connection over the loopback interface
+func loopbackPair(ctx context.Context) (net.Conn, net.Conn, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer ln.Close()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	accepted := make(chan result, 1)
+	go func() {
+		conn, err := ln.Accept()
+		accepted <- result{conn, err}
+	}()
+
+	var d net.Dialer
+	near, err := d.DialContext(ctx, "tcp", ln.Addr().String())
+	if err != nil {
+		return nil, nil, err
+	}
+	r := <-accepted
+	if r.err != nil {
+		near.Close()
+		return nil, nil, r.err
+	}
+
+	// the listener is briefly reachable by other local processes, so make sure we got our own connection
+	if r.conn.RemoteAddr().String() != near.LocalAddr().String() {
+		near.Close()
+		r.conn.Close()
+		return nil, nil, fmt.Errorf("unexpected connection from %s on internal listener", r.conn.RemoteAddr())
+	}
+	return near, r.conn, nil
+}
@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+// how long a test waits for something that should happen right away before giving up
+const testTimeout = 10 * time.Second
+
+// returns the two ends of a loopback TCP connection. both are closed once the test ends.
+func tcpPair(t testing.TB) (net.Conn, net.Conn) {
+	t.Helper()
+	a, b, err := loopbackPair(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return a, b
+}
+
+// returns n bytes of reproducible random data
+func testData(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(b)
+	return b
+}
+
+// starts a TCP server handling each connection with handle, which is closed once handle returns
+func startUpstream(t testing.TB, handle func(conn net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// starts a TCP server echoing everything back to each client until the client closes its sending direction
+func startTCPEcho(t testing.TB) string {
+	t.Helper()
+	return startUpstream(t, func(conn net.Conn) {
+		io.Copy(conn, conn)
+	})
+}
+
+// runs srv until the test ends and returns its address once it is listening
+func runServer(t testing.TB, srv Server) string {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		<-srv.Done()
+	})
+	go srv.Run(ctx)
+	select {
+	case <-srv.Ready():
+	case <-srv.Done():
+		t.Fatal("server exited before listening")
+	case <-time.After(testTimeout):
+		t.Fatal("server didn't start listening")
+	}
+	return srv.Addr().String()
+}
+
+// sends data through a pipe created by newPipe and returns what arrived at the other end along with the error the
+// pipe returned. the sender half-closes its connection once done, which ends the pipe.
+func pipeThrough(t testing.TB, newPipe func(src io.ReadWriteCloser, dst io.ReadWriteCloser) Pipe, data []byte) ([]byte, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	client, src := tcpPair(t)
+	dst, upstream := tcpPair(t)
+
+	go func() {
+		client.Write(data)
+		client.(*net.TCPConn).CloseWrite()
+	}()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- newPipe(src, dst).Run(ctx)
+	}()
+
+	upstream.SetReadDeadline(time.Now().Add(testTimeout))
+	got, err := ioutil.ReadAll(upstream)
+	if err != nil {
+		t.Fatalf("error while reading from the pipe: %s", err)
+	}
+	return got, <-errc
+}
+
+// reports the first position at which got differs from want
+func checkSame(t testing.TB, got []byte, want []byte) {
+	t.Helper()
+	n := len(got)
+	if len(want) < n {
+		n = len(want)
+	}
+	for i := 0; i < n; i++ {
+		if got[i] != want[i] {
+			t.Fatalf("data differs at byte %d of %d", i, len(want))
+		}
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d bytes, want %d", len(got), len(want))
+	}
+}
+
+// serves srv on a listener on a random loopback port until the test ends and returns the listener's address
+func serveOn(t testing.TB, srv Server) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		<-srv.Done()
+	})
+	go srv.(ListenerServer).Serve(ctx, ln)
+	return ln.Addr().String()
+}
+
+// sends payload to addr and reads the same number of bytes back, returning them along with how long it took
+func roundTrip(t testing.TB, addr string, payload []byte) ([]byte, time.Duration) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return roundTripConn(t, conn, payload)
+}
+
+// like roundTrip, on a connection that has already been established
+func roundTripConn(t testing.TB, conn net.Conn, payload []byte) ([]byte, time.Duration) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(testTimeout))
+	defer conn.SetDeadline(time.Time{})
+	start := time.Now()
+	// write while reading, so that a large payload can't fill up the buffers in both directions
+	written := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(payload)
+		written <- err
+	}()
+	got := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("error while reading from %s: %s", conn.RemoteAddr(), err)
+	}
+	took := time.Since(start)
+	if err := <-written; err != nil {
+		t.Fatalf("error while writing to %s: %s", conn.RemoteAddr(), err)
+	}
+	return got, took
+}
+
+// polls cond until it holds, failing the test if it doesn't within the test timeout
+func waitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"net"
+	"time"
+)
+
+// optional callbacks for library users that want to observe connections, e.g. in a test harness. any of them may be
+// nil. hooks are called synchronously from the routines handling the connection, never from the accept loop, so a
+// slow hook holds up its own connection but not the acceptance of others. hooks of different connections may run
+// concurrently.
+type Hooks struct {
+	// called for each accepted client connection before anything is read from it. the upstream is the default one,
+	// which SNI routing may still change.
+	OnAccept func(session SessionSnapshot)
+
+	// called once the upstream connection is established, before any data is forwarded. with an upstream proxy,
+	// upstreamAddr is the proxy's address.
+	OnUpstreamConnected func(clientAddr net.Addr, upstreamAddr net.Addr)
+
+	// called when a pipe exits with an error. direction is "up" or "down".
+	OnPipeError func(clientAddr net.Addr, direction string, err error)
+
+	// called exactly once for each accepted connection once it is closed, including connections rejected before an
+	// upstream connection was made
+	OnSessionEnd func(stats SessionStats)
+}
+
+// the final state of a session as passed to OnSessionEnd. Err is the error that ended the session, if any.
+type SessionStats struct {
+	SessionSnapshot
+	EndTime time.Time
+	Err     error
+}
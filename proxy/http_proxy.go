@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// tunnels the upstream connection through an HTTP proxy using the CONNECT method, optionally with basic auth
+
+type httpProxyConfig struct {
+	addr     string
+	user     string
+	password string
+}
+
+// the longest part of a non-200 response body included in errors
+const httpProxyBodySnippetLen = 256
+
+// returned when the HTTP proxy refuses or fails the CONNECT request
+type httpProxyError struct {
+	proxyAddr  string
+	status     string
+	statusCode int
+	body       string
+}
+
+func (e *httpProxyError) Error() string {
+	return fmt.Sprintf("http proxy %s refused CONNECT: %s: %q", e.proxyAddr, e.status, e.body)
+}
+
+// indicates whether the proxy's failure might go away on retry, e.g. because the upstream is restarting
+func (e *httpProxyError) transient() bool {
+	return e.statusCode == http.StatusBadGateway || e.statusCode == http.StatusServiceUnavailable ||
+		e.statusCode == http.StatusGatewayTimeout
+}
+
+// a connection with data that was read ahead while parsing the proxy's response
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// sends the CONNECT request for addr on a connection to the proxy and waits for the response. returns the connection
+// to use from then on. the exchange is bounded by timeout unless it is 0.
+func (hc *httpProxyConfig) connect(conn net.Conn, addr string, timeout time.Duration) (net.Conn, error) {
+	if timeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, err
+		}
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if hc.user != "" {
+		creds := base64.StdEncoding.EncodeToString([]byte(hc.user + ":" + hc.password))
+		req += "Proxy-Authorization: Basic " + creds + "\r\n"
+	}
+	req += "\r\n"
+	if _, err := io.WriteString(conn, req); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return nil, fmt.Errorf("http proxy %s: error while reading CONNECT response: %w", hc.addr, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		snippet, _ := ioutil.ReadAll(io.LimitReader(resp.Body, httpProxyBodySnippetLen))
+		resp.Body.Close()
+		return nil, &httpProxyError{
+			proxyAddr:  hc.addr,
+			status:     resp.Status,
+			statusCode: resp.StatusCode,
+			body:       strings.TrimSpace(string(snippet)),
+		}
+	}
+
+	// the upstream may already have sent data (e.g. a banner) that was read along with the response. only wrap the
+	// connection if so, so that it stays a plain TCP connection otherwise.
+	if r.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: r}, nil
+	}
+	return conn, nil
+}
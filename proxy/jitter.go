@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"golang.org/x/exp/rand"
+	"time"
+)
+
+// defines per-chunk jitter, modeled after netem.
+// each chunk's delay is offset by a sample drawn uniformly from [-Amount, +Amount]. with a non-zero Correlation, the
+// offset is blended with the previous one (corr * previous + (1 - corr) * fresh) so that consecutive chunks see related
+// delays, much like a real WAN capture, rather than white noise.
+
+type Jitter struct {
+	// maximum offset applied to the delay in either direction
+	Amount time.Duration
+	// correlation between consecutive samples, from 0 (independent) to 1 (constant)
+	Correlation float64
+}
+
+// per-pipe state of the jitter model
+type jitterState struct {
+	params Jitter
+	rng    *rand.Rand
+	prev   float64
+}
+
+func newJitterState(params Jitter, rng *rand.Rand) *jitterState {
+	return &jitterState{params: params, rng: rng}
+}
+
+// returns the offset to apply to the next chunk's delay
+func (s *jitterState) next() time.Duration {
+	fresh := (s.rng.Float64()*2 - 1) * float64(s.params.Amount)
+	s.prev = s.params.Correlation*s.prev + (1-s.params.Correlation)*fresh
+	return time.Duration(s.prev)
+}
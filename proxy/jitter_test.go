@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// the offsets blend each fresh sample with the previous offset, which makes them an AR(1) process whose lag-1
+// autocorrelation is the configured correlation
+func TestJitterAutocorrelation(t *testing.T) {
+	const n = 100000
+	for _, corr := range []float64{0, 0.5, 0.9} {
+		params := Jitter{Amount: 10 * time.Millisecond, Correlation: corr}
+		s := newJitterState(params, newSeededRand(42))
+
+		samples := make([]float64, n)
+		for i := range samples {
+			d := s.next()
+			if d < -params.Amount || d > params.Amount {
+				t.Fatalf("correlation %g: offset %s outside of +/- %s", corr, d, params.Amount)
+			}
+			samples[i] = float64(d)
+		}
+
+		got := lag1Autocorrelation(samples)
+		if math.Abs(got-corr) > 0.02 {
+			t.Errorf("correlation %g: got lag-1 autocorrelation %.4f", corr, got)
+		}
+	}
+}
+
+func TestJitterSeedReproducible(t *testing.T) {
+	params := Jitter{Amount: 10 * time.Millisecond, Correlation: 0.5}
+	a := newJitterState(params, newSeededRand(7))
+	b := newJitterState(params, newSeededRand(7))
+	for i := 0; i < 1000; i++ {
+		if da, db := a.next(), b.next(); da != db {
+			t.Fatalf("sample %d: %s != %s with the same seed", i, da, db)
+		}
+	}
+}
+
+func lag1Autocorrelation(x []float64) float64 {
+	mean := 0.0
+	for _, v := range x {
+		mean += v
+	}
+	mean /= float64(len(x))
+	var num, den float64
+	for i, v := range x {
+		den += (v - mean) * (v - mean)
+		if i > 0 {
+			num += (v - mean) * (x[i-1] - mean)
+		}
+	}
+	return num / den
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// defines self-measurement of the latency the proxy actually adds. every chunk is timed from when it was read to when
+// its write to the destination completed, so timer, scheduling and write overhead show up on top of the configured
+// delay, e.g. to check that 150ms configured is still 150ms under load.
+
+// the latency added to the chunks of one direction. timer granularity makes percentiles of the total latency too
+// coarse to tell e.g. 150ms from 160ms, so they are given for the overhead, i.e. how much longer than its delay a chunk
+// took, while the total is given as an exact average.
+type LatencySummary struct {
+	Count int64
+	// the average time from reading a chunk to having written it
+	Mean time.Duration
+	// percentiles of the time past a chunk's due time when its write completed
+	OverheadP50 time.Duration
+	OverheadP95 time.Duration
+	OverheadP99 time.Duration
+	OverheadMax time.Duration
+}
+
+// the latency added to the chunks of each direction
+type AddedLatency struct {
+	Up   LatencySummary
+	Down LatencySummary
+}
+
+// implemented by servers that can measure the latency they add. nothing is measured unless the server was created
+// with WithLatencyMeasurement.
+type LatencyMeasurer interface {
+	// returns the latency added to the chunks written since the previous call
+	TakeAddedLatency() AddedLatency
+}
+
+// the latencies measured by the sessions of a server
+type latencyMeter struct {
+	up   latencyHistogram
+	down latencyHistogram
+}
+
+// the latencies of one direction
+type latencyHistogram struct {
+	mu       sync.Mutex
+	overhead skewHistogram
+	total    time.Duration
+}
+
+func (h *latencyHistogram) record(total time.Duration, overhead time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.overhead.record(overhead)
+	h.total += total
+}
+
+// summarizes the latencies recorded so far and starts over
+func (h *latencyHistogram) take() LatencySummary {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	o := h.overhead.take()
+	sum := LatencySummary{Count: o.Count, OverheadP50: o.P50, OverheadP95: o.P95, OverheadP99: o.P99, OverheadMax: o.Max}
+	if o.Count > 0 {
+		sum.Mean = h.total / time.Duration(o.Count)
+	}
+	h.total = 0
+	return sum
+}
+
+// makes the server measure the latency it adds to each chunk across all of its sessions. chunks written early to flush
+// them on shutdown aren't measured.
+func WithLatencyMeasurement() ServerOption {
+	return func(s *tcpDelayServer) {
+		s.latency = &latencyMeter{}
+	}
+}
+
+func (s *tcpDelayServer) TakeAddedLatency() AddedLatency {
+	if s.latency == nil {
+		return AddedLatency{}
+	}
+	return AddedLatency{Up: s.latency.up.take(), Down: s.latency.down.take()}
+}
+
+// makes the pipe record the latency of each chunk in the given histogram
+func withLatency(h *latencyHistogram) PipeOption {
+	return func(o *pipeOptions) {
+		o.latency = h
+	}
+}
+
+// records the latency of a chunk read at readTime and due at due whose write has just completed
+func (o *pipeOptions) recordLatency(readTime time.Time, due time.Time) {
+	if o.latency != nil {
+		now := time.Now()
+		o.latency.record(now.Sub(readTime), now.Sub(due))
+	}
+}
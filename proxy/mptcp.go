@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	"io/ioutil"
+	"runtime"
+	"strings"
+)
+
+// defines Multipath TCP (RFC 8684), which lets a connection use several paths at once, e.g. wifi and cellular. the
+// listener or dialer only requests it. the peer and both kernels have to agree, and connections fall back to plain
+// TCP otherwise, so the sessions log whether it was negotiated.
+
+// makes TCP listeners accept Multipath TCP connections. it has no effect with Serve.
+func WithMultipathTCP() ServerOption {
+	return func(s *tcpDelayServer) {
+		s.multipathTCP = true
+	}
+}
+
+// makes direct upstream connections request Multipath TCP. it has no effect with WithDialer.
+func WithUpstreamMultipathTCP() ServerOption {
+	return func(s *tcpDelayServer) {
+		s.dial.multipathTCP = true
+	}
+}
+
+// checks that the kernel has Multipath TCP enabled
+func mptcpAvailable() error {
+	if runtime.GOOS != "linux" {
+		return errors.New("multipath TCP is only supported on linux")
+	}
+	b, err := ioutil.ReadFile("/proc/sys/net/mptcp/enabled")
+	if err != nil {
+		return errors.New("the kernel doesn't support multipath TCP")
+	}
+	if v := strings.TrimSpace(string(b)); v != "1" {
+		return fmt.Errorf("net.mptcp.enabled is %s", v)
+	}
+	return nil
+}
+
+// warns if Multipath TCP won't be negotiated for listeners or upstream connections
+func checkMPTCP(log zerolog.Logger, upstream bool) {
+	side := "listeners"
+	if upstream {
+		side = "upstream connections"
+	}
+	err := errMPTCPUnsupported
+	if mptcpSupported {
+		err = mptcpAvailable()
+	}
+	if err != nil {
+		log.Warn().Err(err).Msgf("multipath TCP won't be negotiated for %s. falling back to TCP.", side)
+	}
+}
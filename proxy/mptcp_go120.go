@@ -0,0 +1,21 @@
+//go:build !go1.21
+// +build !go1.21
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+const mptcpSupported = false
+
+var errMPTCPUnsupported = errors.New("multipath TCP requires building with go 1.21 or later")
+
+func setListenMultipathTCP(lc *net.ListenConfig) {}
+
+func setDialMultipathTCP(d *net.Dialer) {}
+
+func usesMultipathTCP(conn net.Conn) bool {
+	return false
+}
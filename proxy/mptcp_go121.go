@@ -0,0 +1,32 @@
+//go:build go1.21
+// +build go1.21
+
+package proxy
+
+import (
+	"net"
+)
+
+// whether SetMultipathTCP is available, i.e. the binary is built with Go 1.21 or later
+const mptcpSupported = true
+
+// never returned when built with Go 1.21 or later
+var errMPTCPUnsupported error
+
+func setListenMultipathTCP(lc *net.ListenConfig) {
+	lc.SetMultipathTCP(true)
+}
+
+func setDialMultipathTCP(d *net.Dialer) {
+	d.SetMultipathTCP(true)
+}
+
+// reports whether a connection negotiated Multipath TCP. connections that aren't TCP never do.
+func usesMultipathTCP(conn net.Conn) bool {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return false
+	}
+	used, err := tc.MultipathTCP()
+	return err == nil && used
+}
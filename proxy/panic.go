@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"github.com/rs/zerolog"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// a panic in a session, e.g. in a Transformer, ends that session only. the routines running session code recover
+// from it, log it with its stack trace and report it as an error of kind ErrPanic, which tears the session down like
+// any other failure, and the server keeps serving.
+
+// turns a recovered panic into an error, logging it with the stack trace and counting it
+func panicked(log zerolog.Logger, r interface{}) error {
+	atomic.AddInt64(&debugPanics, 1)
+	log.Error().Str("panic", fmt.Sprint(r)).Str("stack", string(debug.Stack())).Msg("recovered from panic. closing session.")
+	return wrapErr(ErrPanic, fmt.Errorf("panic: %v", r))
+}
+
+// runs f, returning a panic in it as an error
+func runRecovered(log zerolog.Logger, f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = panicked(log, r)
+		}
+	}()
+	return f()
+}
+
+// runs the pipe, returning a panic in it as an error
+func runPipe(ctx context.Context, log zerolog.Logger, p Pipe) error {
+	return runRecovered(log, func() error {
+		return p.Run(ctx)
+	})
+}
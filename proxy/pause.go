@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// defines pausing of running sessions, e.g. to freeze a connection mid-transfer and see how the client copes with a
+// link that stops moving without being closed. a paused session keeps reading, so delayed pipes buffer their data up
+// to the in-flight cap before the sender sees backpressure, but neither pipe writes until the session is resumed.
+// plain pipes have no buffer and stop reading right away.
+
+// implemented by servers whose sessions can be paused. sessions are identified by SessionSnapshot.ID. both methods
+// return the session's state afterwards, or false if no running session has the given ID. pausing a paused session
+// or resuming a running one changes nothing.
+type SessionPauser interface {
+	PauseSession(id string) (SessionSnapshot, bool)
+	ResumeSession(id string) (SessionSnapshot, bool)
+}
+
+// holds back the writes of both pipes of a session while paused
+type pauseGate struct {
+	mu sync.Mutex
+	// closed on resume. nil while not paused.
+	resumed chan struct{}
+	since   time.Time
+	// the time spent paused before the current pause
+	total time.Duration
+}
+
+// returns false if already paused
+func (g *pauseGate) pause() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resumed != nil {
+		return false
+	}
+	g.resumed = make(chan struct{})
+	g.since = time.Now()
+	return true
+}
+
+// returns false if not paused
+func (g *pauseGate) resume() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resumed == nil {
+		return false
+	}
+	close(g.resumed)
+	g.resumed = nil
+	g.total += time.Since(g.since)
+	return true
+}
+
+func (g *pauseGate) paused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.resumed != nil
+}
+
+// the total time spent paused, including the current pause
+func (g *pauseGate) pausedFor() time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resumed != nil {
+		return g.total + time.Since(g.since)
+	}
+	return g.total
+}
+
+// waits while paused. a pipe told to flush doesn't wait, so that a paused session doesn't hold up shutdown beyond its
+// deadline. returns false if the context is done first.
+func (g *pauseGate) wait(ctx context.Context, flush <-chan struct{}) bool {
+	g.mu.Lock()
+	resumed := g.resumed
+	g.mu.Unlock()
+	if resumed == nil {
+		return true
+	}
+	select {
+	case <-resumed:
+		return true
+	case <-flush:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// makes the pipe hold back its writes while the gate is paused
+func withPause(g *pauseGate) PipeOption {
+	return func(o *pipeOptions) {
+		o.pause = g
+	}
+}
+
+func (s *tcpDelayServer) PauseSession(id string) (SessionSnapshot, bool) {
+	return s.withSession(id, func(c *session) {
+		c.pause.pause()
+	})
+}
+
+func (s *tcpDelayServer) ResumeSession(id string) (SessionSnapshot, bool) {
+	return s.withSession(id, func(c *session) {
+		c.pause.resume()
+	})
+}
+
+// calls f with the running session with the given ID and returns its state afterwards
+func (s *tcpDelayServer) withSession(id string, f func(c *session)) (SessionSnapshot, bool) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	for c := range s.sessions {
+		if c.id == id {
+			f(c)
+			return c.snapshot(), true
+		}
+	}
+	return SessionSnapshot{}, false
+}
@@ -2,6 +2,15 @@ package proxy
 
 import (
 	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	"golang.org/x/exp/rand"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
 )
 
 // A generalize representation of a pipe
@@ -10,3 +19,528 @@ import (
 type Pipe interface {
 	Run(ctx context.Context) error
 }
+
+// pipes run over any io.ReadWriteCloser and block in reads until data arrives. connections that also support
+// deadlines (e.g. net.Conn) are unblocked by moving their read deadline to now once the pipe has to stop. other streams
+// (e.g. SSH channels or in-memory fakes) are closed once the context is cancelled instead. the same goes for writes
+// blocked because the destination stopped reading.
+type deadlineSetter interface {
+	SetDeadline(t time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// clears any deadlines left on a connection that supports them
+func clearDeadlines(conn io.ReadWriteCloser) error {
+	if ds, ok := conn.(deadlineSetter); ok {
+		return ds.SetDeadline(time.Time{})
+	}
+	return nil
+}
+
+// returned by closeWrite if the connection can't be half-closed
+var errNoHalfClose = errors.New("half-close not supported")
+
+// shuts down the writing side of a connection (e.g. *net.TCPConn, *net.UnixConn or *tls.Conn) so that the peer sees
+// EOF while it can keep sending
+func closeWrite(conn io.ReadWriteCloser) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errNoHalfClose
+}
+
+// indicates whether closeWrite has a chance of working on the connection
+func canCloseWrite(conn io.ReadWriteCloser) bool {
+	if bc, ok := conn.(*bufferedConn); ok {
+		return canCloseWrite(bc.Conn)
+	}
+	_, ok := conn.(interface{ CloseWrite() error })
+	return ok
+}
+
+// passes the source's EOF on to the destination by half-closing it. failures are only logged as the other direction
+// will run into the same problem.
+func (o *pipeOptions) propagateEOF(log zerolog.Logger, dst io.ReadWriteCloser) {
+	if err := closeWrite(dst); err != nil {
+		log.Debug().Err(err).Msg("couldn't half-close dest")
+		return
+	}
+	log.Debug().Msg("half-closed dest")
+}
+
+// unblocks a pending read on src once ctx is done or handoff or flush is closed (either may be nil). the read then
+// fails, and the pipe finds out why from ctx, handoff and flush. sources without deadline support are closed on
+// cancellation and only notice a handoff or flush after their next read. the returned function stops watching and
+// must be called once the pipe stops reading. it waits for the watcher so that no deadline is set after it returns.
+func watchReads(ctx context.Context, src io.ReadWriteCloser, handoff <-chan struct{}, flush <-chan struct{}) func() {
+	ds, hasDeadlines := src.(deadlineSetter)
+	if !hasDeadlines {
+		handoff = nil
+		flush = nil
+	}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			if hasDeadlines {
+				ds.SetReadDeadline(time.Now())
+			} else {
+				src.Close()
+			}
+
+		case <-handoff:
+			ds.SetReadDeadline(time.Now())
+
+		case <-flush:
+			ds.SetReadDeadline(time.Now())
+
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
+
+// unblocks a pending write to dst once ctx is done, e.g. because the peer stopped reading. destinations without
+// deadline support are closed instead. the returned function stops watching and must be called once the pipe stops
+// writing. it waits for the watcher so that no deadline is set after it returns.
+func watchWrites(ctx context.Context, dst io.ReadWriteCloser) func() {
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			if ds, ok := dst.(deadlineSetter); ok {
+				ds.SetWriteDeadline(time.Now())
+			} else {
+				dst.Close()
+			}
+
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
+
+// writes b to dst. with a write timeout, a write that blocks for longer fails with a timeout error, which stalled
+// turns into the error aborting the pipe. with a rate limit, only part of b may be written once the link is free.
+func (o *pipeOptions) write(ctx context.Context, dst io.ReadWriteCloser, b []byte) (int, error) {
+	if o.pause != nil && !o.pause.wait(ctx, o.flush) {
+		return 0, ctx.Err()
+	}
+	if o.pacer != nil {
+		if !o.pacer.wait(ctx) {
+			return 0, ctx.Err()
+		}
+		if len(b) > o.pacer.slice() {
+			b = b[:o.pacer.slice()]
+		}
+		n, err := o.writeTimed(ctx, dst, b)
+		o.pacer.sent(n)
+		return n, err
+	}
+	return o.writeTimed(ctx, dst, b)
+}
+
+func (o *pipeOptions) writeTimed(ctx context.Context, dst io.ReadWriteCloser, b []byte) (int, error) {
+	if o.writeTimeout > 0 {
+		if ds, ok := dst.(deadlineSetter); ok {
+			if err := ds.SetWriteDeadline(time.Now().Add(o.writeTimeout)); err != nil {
+				return 0, err
+			}
+		}
+		// the watcher may have just moved the deadline to now, so don't start a write it can no longer interrupt
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+	}
+	return dst.Write(b)
+}
+
+// returns the error for a write that failed because it hit the write timeout, or nil if err is something else
+func (o *pipeOptions) stalled(err error) error {
+	var netErr net.Error
+	if o.writeTimeout > 0 && errors.As(err, &netErr) && netErr.Timeout() {
+		return wrapErr(ErrPipeAborted, fmt.Errorf("write stalled for %s: %w", o.writeTimeout, err))
+	}
+	return nil
+}
+
+// indicates whether the pipe has been told to hand off
+func (o *pipeOptions) handedOff() bool {
+	return isClosed(o.handoff)
+}
+
+// indicates whether the pipe has been told to flush
+func (o *pipeOptions) flushing() bool {
+	return isClosed(o.flush)
+}
+
+// indicates whether c is closed. a nil channel never is.
+func isClosed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// optional settings shared by the pipe implementations
+type pipeOptions struct {
+	seed              uint64
+	ge                *GilbertElliott
+	jitter            *Jitter
+	targetRTT         time.Duration
+	targetRTTInterval time.Duration
+	provider          delayProvider
+	handoff           <-chan struct{}
+	flush             <-chan struct{}
+	collapseDelays    bool
+	counters          *pipeCounters
+	dumpBytes         int
+	bufferSize        int
+	queueDepth        int
+	noCopy            bool
+	delayFunc         DelayFunc
+	transformer       Transformer
+	direction         string
+	writeTimeout      time.Duration
+	latency           *latencyHistogram
+	recorder          *recorder
+	tracing           *delayTracing
+	firstChunkDelay   time.Duration
+	rateLimit         int64
+	bufferbloat       *Bufferbloat
+	queueLimit        int64
+	readRateLimit     int64
+	readPacer         *ratePacer
+	pacer             *ratePacer
+	pause             *pauseGate
+}
+
+// defaults for the options below
+const (
+	// the number of bytes of each chunk hexdumped at trace level unless set with WithDumpBytes
+	defaultDumpBytes = 64
+	// the largest chunk a pipe reads at once
+	defaultBufferSize = 1024 * 1024
+	// the number of chunks a delayed pipe holds while delaying them
+	defaultQueueDepth = 1024
+)
+
+// a PipeOption customizes the behavior of a pipe. options that only make sense for a delayed pipe are ignored by the
+// simple pipe.
+type PipeOption func(*pipeOptions)
+
+// seeds the random number generator used by the pipe (e.g. for the Gilbert-Elliott model). without a seed, the pipe
+// uses a time based seed and results will not be reproducible.
+func WithPipeSeed(seed uint64) PipeOption {
+	return func(o *pipeOptions) {
+		o.seed = seed
+	}
+}
+
+// enables the Gilbert-Elliott bursty impairment model on the pipe
+func WithGilbertElliott(ge GilbertElliott) PipeOption {
+	return func(o *pipeOptions) {
+		o.ge = &ge
+	}
+}
+
+// enables correlated per-chunk jitter on the pipe. a zero amount disables jitter set by an earlier option.
+func WithJitter(jitter Jitter) PipeOption {
+	return func(o *pipeOptions) {
+		if jitter.Amount == 0 {
+			o.jitter = nil
+			return
+		}
+		o.jitter = &jitter
+	}
+}
+
+// replaces the static delay of a delayed pipe with one aiming for a target end-to-end round trip time. the network
+// RTT of both connections is measured via TCP_INFO every interval and the pipe adds half of the remainder. if the RTT
+// can't be measured, half of the target is added as a plain delay.
+func WithTargetRTT(target time.Duration, interval time.Duration) PipeOption {
+	return func(o *pipeOptions) {
+		o.targetRTT = target
+		o.targetRTTInterval = interval
+	}
+}
+
+// sets how many bytes at the start of each chunk are hexdumped at trace level. 0 disables the dump.
+func WithDumpBytes(n int) PipeOption {
+	return func(o *pipeOptions) {
+		o.dumpBytes = n
+	}
+}
+
+// replaces the base delay of a delayed pipe, including the static delay it was created with, with the given delay
+// model. impairment models still apply on top.
+func WithDelayFunc(f DelayFunc) PipeOption {
+	return func(o *pipeOptions) {
+		o.delayFunc = f
+	}
+}
+
+// sets the size of a pipe's read buffer, which limits the size of a chunk. the default is 1MB.
+func WithBufferSize(n int) PipeOption {
+	return func(o *pipeOptions) {
+		o.bufferSize = n
+	}
+}
+
+// sets how many chunks a delayed pipe holds while they are delayed. once that many are queued, the pipe stops reading
+// until the oldest one has been written. the default is 1024.
+func WithQueueDepth(n int) PipeOption {
+	return func(o *pipeOptions) {
+		o.queueDepth = n
+	}
+}
+
+// makes a delayed pipe read each chunk into a buffer of its own and queue it as is rather than copying it out of a
+// shared read buffer. this saves a copy per chunk at the cost of holding a full buffer for each queued chunk, so it is
+// best combined with a small WithBufferSize. the simple pipe never copies, so this has no effect on it.
+func WithNoCopy() PipeOption {
+	return func(o *pipeOptions) {
+		o.noCopy = true
+	}
+}
+
+// aborts the pipe with ErrPipeAborted if a single write to the destination blocks for longer than d, e.g. because the
+// peer stopped reading. only destinations supporting deadlines (e.g. net.Conn) are timed. 0, the default, waits
+// indefinitely.
+func WithWriteTimeout(d time.Duration) PipeOption {
+	return func(o *pipeOptions) {
+		o.writeTimeout = d
+	}
+}
+
+// adds d to the delay of the first chunk a delayed pipe forwards, on top of its normal delay. the chunks after it keep
+// their order, so they wait for it even if their own delay is shorter. used for the down pipe, this inflates the time
+// to first byte like slow server processing would, without slowing down the rest of the response.
+func WithFirstChunkDelay(d time.Duration) PipeOption {
+	return func(o *pipeOptions) {
+		o.firstChunkDelay = d
+	}
+}
+
+// emulates a router with a finite buffer by dropping chunks read while the delayed pipe already holds limit bytes, or
+// would hold more once the chunk is queued, instead of queueing them. note that dropping chunks silently loses data and
+// breaks TCP semantics for the endpoints. 0, the default, means no limit.
+func WithQueueLimit(limit int64) PipeOption {
+	return func(o *pipeOptions) {
+		o.queueLimit = limit
+	}
+}
+
+// replaces the static delay of a delayed pipe with the given provider. used by sessions that change their delays over
+// time.
+func withDelayProvider(provider delayProvider) PipeOption {
+	return func(o *pipeOptions) {
+		o.provider = provider
+	}
+}
+
+// makes a delayed pipe stop reading once the channel is closed. chunks already read are still delivered, after which
+// the pipe returns without error so that the caller can continue with the connections.
+func withHandoff(handoff <-chan struct{}) PipeOption {
+	return func(o *pipeOptions) {
+		o.handoff = handoff
+	}
+}
+
+// makes a pipe stop reading once the channel is closed, e.g. because the server is shutting down. a delayed pipe still
+// writes the chunks it has queued, right away if collapseDelays is set and once due otherwise, and then returns without
+// error. cancelling the context instead discards them.
+func withFlush(flush <-chan struct{}, collapseDelays bool) PipeOption {
+	return func(o *pipeOptions) {
+		o.flush = flush
+		o.collapseDelays = collapseDelays
+	}
+}
+
+// counters maintained by a pipe. they are updated atomically, so they can be read while the pipe is running.
+type pipeCounters struct {
+	// bytes read from the source, and bytes and chunks written to the destination
+	read    int64
+	written int64
+	chunks  int64
+	// when bytes were last read and written, in unix nanoseconds. 0 means never.
+	lastRead    int64
+	lastWritten int64
+	// the delays a delayed pipe applied to chunks, for their average and maximum
+	delayed  int64
+	delaySum int64
+	delayMax int64
+	// chunks read but not yet written by a delayed pipe, and the bytes in them
+	queued      int64
+	queuedBytes int64
+	// how late delayed chunks were written
+	skew skewHistogram
+	// bytes a delayed pipe wrote after being told to flush, and bytes it had read but discarded when cancelled
+	flushed   int64
+	discarded int64
+	// chunks that got the first chunk delay, i.e. 1 once it has been applied
+	firstChunkDelayed int64
+	// chunks and bytes dropped because the queue limit was reached
+	tailDrops        int64
+	tailDroppedBytes int64
+}
+
+// makes the pipe maintain the given counters
+func withCounters(counters *pipeCounters) PipeOption {
+	return func(o *pipeOptions) {
+		o.counters = counters
+	}
+}
+
+func newPipeOptions(opts []PipeOption) *pipeOptions {
+	o := &pipeOptions{dumpBytes: defaultDumpBytes, bufferSize: defaultBufferSize, queueDepth: defaultQueueDepth}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.bufferSize < 1 {
+		o.bufferSize = defaultBufferSize
+	}
+	if o.queueDepth < 0 {
+		o.queueDepth = 0
+	}
+	if o.rateLimit > 0 {
+		o.pacer = newRatePacer(o.rateLimit)
+	}
+	if o.readRateLimit > 0 {
+		o.readPacer = newRatePacer(o.readRateLimit)
+	}
+	return o
+}
+
+// indicates whether the options require a delayed pipe even if the static delay is zero
+func (o *pipeOptions) impaired() bool {
+	return o.ge != nil || o.jitter != nil || o.targetRTT > 0 || o.delayFunc != nil || o.bufferbloat != nil || o.queueLimit > 0
+}
+
+// records bytes written to the destination
+func (o *pipeOptions) count(n int) {
+	if o.counters != nil && n > 0 {
+		atomic.AddInt64(&o.counters.written, int64(n))
+		atomic.StoreInt64(&o.counters.lastWritten, time.Now().UnixNano())
+	}
+}
+
+// records a chunk completely written to the destination
+func (o *pipeOptions) countChunk() {
+	if o.counters != nil {
+		atomic.AddInt64(&o.counters.chunks, 1)
+	}
+}
+
+// records the delay applied to a chunk
+func (o *pipeOptions) recordDelay(d time.Duration) {
+	if o.counters == nil {
+		return
+	}
+	atomic.AddInt64(&o.counters.delayed, 1)
+	atomic.AddInt64(&o.counters.delaySum, int64(d))
+	for {
+		max := atomic.LoadInt64(&o.counters.delayMax)
+		if int64(d) <= max || atomic.CompareAndSwapInt64(&o.counters.delayMax, max, int64(d)) {
+			return
+		}
+	}
+}
+
+// returns the average and maximum delay applied to chunks
+func (c *pipeCounters) delays() (time.Duration, time.Duration) {
+	n := atomic.LoadInt64(&c.delayed)
+	if n == 0 {
+		return 0, 0
+	}
+	return time.Duration(atomic.LoadInt64(&c.delaySum) / n), time.Duration(atomic.LoadInt64(&c.delayMax))
+}
+
+// records how late a delayed chunk was written compared to when it was due
+func (o *pipeOptions) recordSkew(d time.Duration) {
+	if o.counters != nil {
+		o.counters.skew.record(d)
+	}
+}
+
+// records that the first chunk delay has been applied
+func (o *pipeOptions) countFirstChunkDelayed() {
+	if o.counters != nil {
+		atomic.AddInt64(&o.counters.firstChunkDelayed, 1)
+	}
+}
+
+// records a chunk of n bytes dropped because the queue limit was reached. the global debug counters are updated as
+// well.
+func (o *pipeOptions) countTailDrop(n int) {
+	if o.counters != nil {
+		atomic.AddInt64(&o.counters.tailDrops, 1)
+		atomic.AddInt64(&o.counters.tailDroppedBytes, int64(n))
+	}
+	atomic.AddInt64(&debugTailDrops, 1)
+	atomic.AddInt64(&debugTailDroppedBytes, int64(n))
+}
+
+// records bytes written while flushing
+func (o *pipeOptions) countFlushed(n int) {
+	if o.counters != nil {
+		atomic.AddInt64(&o.counters.flushed, int64(n))
+	}
+}
+
+// records bytes read but never written
+func (o *pipeOptions) countDiscarded(n int) {
+	if o.counters != nil && n > 0 {
+		atomic.AddInt64(&o.counters.discarded, int64(n))
+	}
+}
+
+// records a chunk of n bytes entering or, with a negative n, leaving the delay queue. the global debug counters are
+// updated as well.
+func (o *pipeOptions) queue(n int) {
+	chunks := int64(1)
+	if n < 0 {
+		chunks = -1
+	}
+	if o.counters != nil {
+		atomic.AddInt64(&o.counters.queued, chunks)
+		atomic.AddInt64(&o.counters.queuedBytes, int64(n))
+	}
+	atomic.AddInt64(&debugPendingWrites, chunks)
+	atomic.AddInt64(&debugBytesInFlight, int64(n))
+}
+
+// logs a hexdump of the start of a chunk read from the source. this is only done at trace level, and the dump isn't
+// built otherwise.
+func (o *pipeOptions) traceChunk(log zerolog.Logger, b []byte) {
+	if o.dumpBytes <= 0 {
+		return
+	}
+	e := log.Trace()
+	if !e.Enabled() {
+		return
+	}
+	n := len(b)
+	if n > o.dumpBytes {
+		b = b[:o.dumpBytes]
+	}
+	e.Int("numBytes", n).Int("dumpedBytes", len(b)).Msg("chunk hexdump\n" + hex.Dump(b))
+}
+
+// returns a new rng based on the configured seed, falling back to a time based seed
+func (o *pipeOptions) newRand() *rand.Rand {
+	return newSeededRand(o.seed)
+}
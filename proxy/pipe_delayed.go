@@ -3,41 +3,43 @@ package proxy
 import (
 	"context"
 	"errors"
-	"fmt"
 	"github.com/rs/zerolog/log"
 	"io"
-	"net"
 	"sync"
 	"time"
 )
 
-// represents a single delayed write. readTime is when the data was first read.
+// represents a single delayed write. readTime is when the data was first read and due is when it should be written.
+// pooled is the pooled buffer backing bbuf, if any. whoever removes the write from the queue returns it to the pools.
 type delayedWrite struct {
 	readTime time.Time
+	due      time.Time
 	bbuf     []byte
+	pooled   *[]byte
 }
 
 type delayedPipe struct {
-	src   net.Conn
-	dst   net.Conn
+	src   io.ReadWriteCloser
+	dst   io.ReadWriteCloser
 	delay time.Duration
+	opts  *pipeOptions
 }
 
-func NewDelayedPipe(src net.Conn, dst net.Conn, delay time.Duration) Pipe {
-	return &delayedPipe{src: src, dst: dst, delay: delay}
+func NewDelayedPipe(src io.ReadWriteCloser, dst io.ReadWriteCloser, delay time.Duration, opts ...PipeOption) Pipe {
+	return &delayedPipe{src: src, dst: dst, delay: delay, opts: newPipeOptions(opts)}
 }
 
 func (p *delayedPipe) Run(ctx context.Context) error {
 	// use the log object from the context with updated fields
 	log := log.Ctx(ctx).With().Str("func", "delayedPipe.Run").Logger()
 
-	// disable deadlines. note that the read routine will later overwrite the source read deadline, but that's ok.
-	err := p.src.SetDeadline(time.Time{})
+	// disable deadlines. reads block until data arrives or the pipe is cancelled or handed off.
+	err := clearDeadlines(p.src)
 	if err != nil {
 		log.Error().Err(err).Msg("error while disabling source connection deadline")
 		return err
 	}
-	err = p.dst.SetDeadline(time.Time{})
+	err = clearDeadlines(p.dst)
 	if err != nil {
 		log.Error().Err(err).Msg("error while disabling destination connection deadline")
 		return err
@@ -45,32 +47,42 @@ func (p *delayedPipe) Run(ctx context.Context) error {
 
 	// run the reading and writing logic as separate routines
 	// use a context both to tear down the children as well as to encapsulate the logger
+	parentCtx := ctx
 	ctx, cancel := context.WithCancel(ctx)
 	ctx = log.WithContext(ctx)
 
-	// set up a deep buffered channel for the read routine to deliver read bytes to the write routine
-	c := make(chan delayedWrite, 1024)
+	// the read routine queues chunks with their due time and the write routine writes them in order once due
+	q := newDelayQueue(p.opts.queueDepth)
 
-	// remember the last error
-	var lastErr error
+	// remember the first error. the other routine usually fails as a consequence of the teardown it causes.
+	var firstErr firstError
+
+	// whether the source was closed. the chunks read before are still written and the destination is then half-closed.
+	sourceClosed := false
 
 	wg := sync.WaitGroup{}
 	wg.Add(1)
 	go func() {
-		err := p.readRoutine(ctx, c)
+		err := runRecovered(log, func() error { return p.readRoutine(ctx, q) })
+		if err == errHandoff || err == errFlush || err == errSourceClosed {
+			// the write routine finishes once it has written everything queued
+			sourceClosed = err == errSourceClosed
+			wg.Done()
+			return
+		}
 		if err != nil {
 			log.Error().Err(err).Msg("readRoutine exited with error")
-			lastErr = err
+			firstErr.set(err)
 		}
 		cancel()
 		wg.Done()
 	}()
 	wg.Add(1)
 	go func() {
-		err := p.writeRoutine(ctx, c)
+		err := runRecovered(log, func() error { return p.writeRoutine(ctx, q) })
 		if err != nil {
 			log.Error().Err(err).Msg("writeRoutine exited with error")
-			lastErr = err
+			firstErr.set(err)
 		}
 		cancel()
 		wg.Done()
@@ -80,23 +92,90 @@ func (p *delayedPipe) Run(ctx context.Context) error {
 	log.Debug().Msg("waiting for children to finish")
 	wg.Wait()
 	log.Debug().Msg("children finished. exiting.")
+
+	// chunks that were queued but never written are discarded
+	for _, dw := range q.drain() {
+		p.opts.queue(-len(dw.bbuf))
+		p.opts.countDiscarded(len(dw.bbuf))
+		putBuffer(dw.pooled)
+	}
+
+	// once everything read before the source closed has been written, pass on the close
+	if sourceClosed && firstErr.get() == nil && parentCtx.Err() == nil {
+		p.opts.propagateEOF(log, p.dst)
+	}
 	log.Info().Msg("pipe shutting down")
 
-	return lastErr
+	return firstErr.get()
 }
 
-// handles the read operation for the delayed pipe. only returns on error or cancelled context.
-// nil return value indicates normal exit (cancelled context or normal connection close)
-// non-nil return value indicates a true error
-func (p *delayedPipe) readRoutine(ctx context.Context, c chan<- delayedWrite) error {
+// returned by the read routine once it has stopped reading due to a handoff or flush, or because the source was
+// closed. either way, the queue is closed so that the write routine returns once it has written everything.
+var (
+	errHandoff      = errors.New("handoff")
+	errFlush        = errors.New("flush")
+	errSourceClosed = errors.New("source closed")
+)
+
+// handles the read operation for the delayed pipe. only returns on error, handoff, flush, source close or cancelled
+// context.
+// nil return value indicates a cancelled context
+// errHandoff, errFlush and errSourceClosed indicate that the queue has been closed
+// any other return value indicates a true error
+func (p *delayedPipe) readRoutine(ctx context.Context, q *delayQueue) error {
 	// use the log object from the context
 	log := log.Ctx(ctx).With().Str("func", "delayedPipe.readRoutine").Logger()
 
-	// use a static buffer of 1MB
-	bbuf := make([]byte, 1024*1024)
+	// use a static buffer from the pools, 1MB unless set with WithBufferSize. without copying, each read gets a new one.
+	buf := getBuffer(p.opts.bufferSize)
+	defer func() {
+		putBuffer(buf)
+	}()
+	bbuf := *buf
+
+	// unblock the pending read once the context is cancelled or the pipe is handed off or told to flush. sources
+	// without deadlines can only be unblocked by closing them, which a handoff doesn't do so the source stays open for
+	// the caller.
+	defer watchReads(ctx, p.src, p.opts.handoff, p.opts.flush)()
+
+	// set up the base delay provider and the optional impairment models. a delay func replaces the provider.
+	start := time.Now()
+	var provider delayProvider = staticDelay(p.delay)
+	if p.opts.provider != nil {
+		provider = p.opts.provider
+	} else if p.opts.targetRTT > 0 {
+		provider = newTargetRTTDelay(p.opts.targetRTT, p.opts.targetRTTInterval, p.src, p.dst, log)
+	}
+	// all models share the pipe's rng so a single seed makes the pipe reproducible
+	rng := p.opts.newRand()
+	var jitter *jitterState
+	if p.opts.jitter != nil {
+		jitter = newJitterState(*p.opts.jitter, rng)
+	}
+	var ge *gilbertElliottState
+	if p.opts.ge != nil {
+		ge = newGilbertElliottState(*p.opts.ge, rng)
+	}
+
+	// set once the source has signalled EOF. the close is handled on the next pass so that data returned along with the
+	// EOF is forwarded first.
+	sourceEOF := false
+
+	// the index of the current chunk, for delay traces
+	var index int64
+
+	// whether the first chunk delay has been applied
+	firstChunkDelayed := false
 
 	// receive bytes in an infinite loop
 	for {
+		if sourceEOF {
+			// this is a normal close
+			log.Info().Msg("connection closed by source")
+			q.close()
+			return errSourceClosed
+		}
+
 		// use a select to allow for cancelling via context
 		select {
 		case <-ctx.Done():
@@ -104,59 +183,148 @@ func (p *delayedPipe) readRoutine(ctx context.Context, c chan<- delayedWrite) er
 			log.Debug().Msg("exiting due to cancelled context")
 			return nil
 
+		case <-p.opts.handoff:
+			// stop reading and close the queue so the write routine returns after writing the chunks read so far
+			log.Debug().Msg("handing off")
+			q.close()
+			return errHandoff
+
+		case <-p.opts.flush:
+			// stop reading and let the write routine deliver the chunks read so far
+			log.Debug().Msg("stopping to flush")
+			q.close()
+			return errFlush
+
 		default:
-			// otherwise, set a read deadline a short time in the future and attempt to read. this allows us to periodically
-			// check for context cancellation
-			err := p.src.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
-			if err != nil {
-				log.Error().Err(err).Msg("error while setting source read deadline")
-				return err
+			// wait for room in the queue before reading, so that a full queue holds back the source rather than a chunk
+			// already read. a chunk's delay starts once it is read and doesn't include the time the queue was backed up.
+			if !q.waitRoom(ctx) {
+				log.Debug().Msg("exiting due to cancelled context")
+				return nil
 			}
-			nb, err := p.src.Read(bbuf)
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				// this is a normal read timeout due to deadline. nothing to see here.
-				log.Trace().Msg("read timeout. continuing...")
-				continue
-			} else if err == io.EOF {
-				// this is a normal close. cancel the context and return.
-				log.Info().Msg("connection closed by source")
+
+			// otherwise, block until data arrives
+			// with a read rate limit, wait until the next read is allowed and read no more than the rate allows
+			readBuf := p.opts.readBuffer(ctx, bbuf)
+			if readBuf == nil {
+				log.Debug().Msg("exiting due to cancelled context")
+				return nil
+			}
+			nb, err := p.src.Read(readBuf)
+			p.opts.countRead(nb)
+			if err == io.EOF {
+				// a read may return the final bytes along with the EOF
+				sourceEOF = true
+				if nb == 0 {
+					continue
+				}
+			} else if err != nil && ctx.Err() != nil {
+				// the read was interrupted due to the cancelled context
+				log.Debug().Msg("exiting due to cancelled context")
 				return nil
+			} else if err != nil && p.opts.handedOff() {
+				// the read was interrupted by the handoff
+				log.Debug().Msg("handing off")
+				q.close()
+				return errHandoff
+			} else if err != nil && p.opts.flushing() {
+				// the read was interrupted to flush
+				log.Debug().Msg("stopping to flush")
+				q.close()
+				return errFlush
 			} else if err != nil {
 				// for any other error, return it. this should result in the context getting torn down.
 				log.Error().Err(err).Msg("error while reading from connection")
-				return err
+				return &pipeIOError{read: true, err: err}
 			}
 			// otherwise we have some data
-			log.Info().Int("numBytes", nb).Msg("read bytes")
+			log.Trace().Int("numBytes", nb).Msg("read bytes")
+			p.opts.traceChunk(log, bbuf[:nb])
+			p.opts.recordChunk(bbuf[:nb])
+			chunk, err := p.opts.transform(bbuf[:nb])
+			if err != nil {
+				log.Error().Err(err).Msg("error while transforming chunk")
+				return err
+			}
+			if len(chunk) == 0 {
+				log.Debug().Int("numBytes", nb).Msg("transformer dropped chunk")
+				continue
+			}
 
-			// use a go routine to delay the sending of the data to the write routine. this way the write routine is
-			// dead simple. when it gets it, it sends it.
-			// the one concern here is that somehow these routines execute out of order. to catch that, record the
-			// current readTime and make sure that is always increasing in the write routine.
-			dw := delayedWrite{
-				readTime: time.Now(),
-				bbuf:     make([]byte, nb),
-			}
-			// copy read bytes into new buffer
-			// this is a little memory inefficient but that is ok for a test tool
-			copy(dw.bbuf, bbuf[:nb])
-
-			go func(dw delayedWrite) {
-				// use a one-readTime timer
-				t := time.NewTimer(p.delay)
-
-				// use a select to also allow cancelling via context
-				select {
-				case <-ctx.Done():
-					// cancel the timer and exit. discard the data.
-					t.Stop()
-					return
-
-				case t := <-t.C:
-					c <- dw
-					log.Debug().Int("numBytes", nb).Time("readTime", dw.readTime).Time("writeTime", t).Msg("sent delayed write")
+			// determine the delay for this chunk
+			var delay time.Duration
+			if p.opts.delayFunc != nil {
+				delay = p.opts.delayFunc.Next(len(chunk), time.Since(start))
+			} else {
+				delay = provider.delay()
+			}
+			if jitter != nil {
+				delay += jitter.next()
+				if delay < 0 {
+					delay = 0
 				}
-			}(dw)
+			}
+			if p.opts.bufferbloat != nil {
+				delay += p.opts.bufferbloat.extra(q.queuedBytes())
+			}
+			drop := false
+			if ge != nil {
+				var extra time.Duration
+				extra, drop = ge.next(log)
+				delay += extra
+			}
+			firstChunk := !firstChunkDelayed && !drop && p.opts.firstChunkDelay > 0
+			if firstChunk {
+				delay += p.opts.firstChunkDelay
+			}
+			index++
+			delay, drop = p.opts.traceDelay(index, delay, drop)
+			if drop {
+				log.Debug().Int("numBytes", nb).Msg("dropped chunk in gilbert-elliott bad state or as traced")
+				continue
+			}
+			if p.opts.queueLimit > 0 {
+				if queued := q.queuedBytes(); queued+int64(len(chunk)) > p.opts.queueLimit {
+					log.Debug().Int("numBytes", len(chunk)).Int64("queuedBytes", queued).Msg("queue limit reached. dropped chunk.")
+					p.opts.countTailDrop(len(chunk))
+					continue
+				}
+			}
+			if firstChunk {
+				log.Debug().Dur("firstChunkDelay", p.opts.firstChunkDelay).Msg("delaying first chunk")
+				firstChunkDelayed = true
+				p.opts.countFirstChunkDelayed()
+			}
+			p.opts.recordDelay(delay)
+
+			// queue the chunk with its due time. the write routine writes chunks in the order they were read, so a
+			// chunk with a shorter delay waits for the ones before it rather than overtaking them.
+			readTime := time.Now()
+			dw := delayedWrite{
+				readTime: readTime,
+				due:      readTime.Add(delay),
+			}
+			if p.opts.noCopy {
+				// hand over the chunk along with the read buffer and read the next one into a fresh buffer
+				dw.bbuf = chunk
+				dw.pooled = buf
+				buf = getBuffer(p.opts.bufferSize)
+				bbuf = *buf
+			} else {
+				// copy read bytes into a pooled buffer sized for the chunk
+				dw.pooled = getBuffer(len(chunk))
+				dw.bbuf = *dw.pooled
+				copy(dw.bbuf, chunk)
+			}
+
+			p.opts.queue(len(dw.bbuf))
+			if !q.push(ctx, dw) {
+				p.opts.queue(-len(dw.bbuf))
+				putBuffer(dw.pooled)
+				log.Debug().Msg("exiting due to cancelled context")
+				return nil
+			}
+			log.Trace().Int("numBytes", len(dw.bbuf)).Time("readTime", dw.readTime).Time("due", dw.due).Msg("queued delayed write")
 		}
 	}
 }
@@ -164,59 +332,109 @@ func (p *delayedPipe) readRoutine(ctx context.Context, c chan<- delayedWrite) er
 // handles the write operation for the delayed pipe. only returns on error or cancelled context.
 // nil return value indicates normal exit (cancelled context or normal connection close)
 // non-nil return value indicates a true error
-func (p *delayedPipe) writeRoutine(ctx context.Context, c <-chan delayedWrite) error {
+func (p *delayedPipe) writeRoutine(ctx context.Context, q *delayQueue) error {
 	// use the log object from the context
 	log := log.Ctx(ctx).With().Str("func", "delayedPipe.writeRoutine").Logger()
 
-	// keep track of readTime of last write. this should always increase. this is to guard against the routines in
-	// the readRoutine somehow executing out of order for back-to-back reads
-	lastReadTime := time.Time{}
+	// unblock a pending write once the context is cancelled
+	defer watchWrites(ctx, p.dst)()
+
+	// a single timer for waiting until the next chunk is due
+	t := time.NewTimer(0)
+	defer t.Stop()
+	<-t.C
+
+	// when flushing with collapsed delays, waiting for a chunk ends as soon as the flush starts
+	var collapse <-chan struct{}
+	if p.opts.collapseDelays {
+		collapse = p.opts.flush
+	}
 
 	for {
-		// use a select statement to allow cancelling via context
-		select {
-		case <-ctx.Done():
-			// if the context has been cancelled, just return
-			log.Debug().Msg("exiting due to cancelled context")
+		// wait for the next chunk in line
+		dw, ok := q.head(ctx)
+		if !ok {
+			if ctx.Err() != nil {
+				log.Debug().Msg("exiting due to cancelled context")
+			} else {
+				// the queue is closed on handoff, flush and source close
+				log.Debug().Msg("all queued writes done. exiting.")
+			}
 			return nil
+		}
 
-		case dw := <-c:
-			// a delayed write is ready to write. write it now.
-			log.Debug().Int("numBytes", len(dw.bbuf)).Time("readTime", dw.readTime).Time("writeTime", time.Now()).Msg("doing delayed write")
-
-			// make sure the timestamps are always increasing
-			if dw.readTime.Before(lastReadTime) {
-				log.Error().Time("lastReadTime", lastReadTime).Time("dw.readTime", dw.readTime).Msg("delayed write out of order")
-				return fmt.Errorf("delayed write out of order. readTime: %s, lastReadTime: %s", dw.readTime, lastReadTime)
-			}
-			lastReadTime = dw.readTime
-
-			// this really should go through in one write call, but just in case, allow for partial writes and keep a write cursor
-			wc := 0
-			for wc < len(dw.bbuf) {
-				n, err := p.dst.Write(dw.bbuf[wc:])
-				if err == io.EOF {
-					// this is a normal close. exit the loop.
-					log.Info().Msg("connection closed by dest")
-					break
-				} else if err != nil {
-					log.Error().Err(err).Msg("error while writing to connection")
-					return err
-				}
+		// sleep until it is due. the chunk stays queued in the meantime so it is accounted for if the pipe is torn down.
+		collapsed := false
+		if wait := time.Until(dw.due); wait > 0 {
+			t.Reset(wait)
+			select {
+			case <-ctx.Done():
+				// if the context has been cancelled, just return
+				t.Stop()
+				log.Debug().Msg("exiting due to cancelled context")
+				return nil
 
-				// shouldn't happen, but just in case
-				if n < 0 {
-					log.Error().Msg("wrote negative bytes. aborting.")
-					return errors.New("negative bytes indicated in write call")
-				} else if n == 0 {
-					log.Error().Msg("wrote zero bytes. aborting.")
-					return errors.New("zero bytes indicated in write call")
+			case <-collapse:
+				// write the rest of the queue right away
+				if !t.Stop() {
+					<-t.C
 				}
+				collapsed = true
 
-				// otherwise we wrote some bytes. increment the counter
-				log.Debug().Int("numBytes", n).Msg("wrote bytes")
-				wc += n
+			case <-t.C:
 			}
 		}
+		q.pop()
+		p.opts.queue(-len(dw.bbuf))
+
+		// a delayed write is ready to write. write it now. chunks written early to flush don't count towards the skew.
+		log.Trace().Int("numBytes", len(dw.bbuf)).Time("readTime", dw.readTime).Time("writeTime", time.Now()).Msg("doing delayed write")
+		if !collapsed {
+			p.opts.recordSkew(time.Since(dw.due))
+		}
+
+		// this really should go through in one write call, but just in case, allow for partial writes and keep a write cursor
+		wc := 0
+		for wc < len(dw.bbuf) {
+			n, err := p.opts.write(ctx, p.dst, dw.bbuf[wc:])
+			if err != nil && ctx.Err() == nil && isDestClosed(err) {
+				// the destination is gone. stop instead of reading data that can't be delivered anymore.
+				log.Info().Err(err).Msg("connection closed by dest")
+				return writeErr(err)
+			} else if err != nil && ctx.Err() != nil {
+				// the write was interrupted due to the cancelled context
+				log.Debug().Msg("exiting due to cancelled context")
+				p.opts.countDiscarded(len(dw.bbuf) - wc)
+				return nil
+			} else if stalled := p.opts.stalled(err); stalled != nil {
+				log.Error().Err(stalled).Msg("write stalled. aborting.")
+				return stalled
+			} else if err != nil {
+				log.Error().Err(err).Msg("error while writing to connection")
+				return writeErr(err)
+			}
+
+			// shouldn't happen, but just in case
+			if n < 0 {
+				log.Error().Msg("wrote negative bytes. aborting.")
+				return wrapErr(ErrPipeAborted, errors.New("negative bytes indicated in write call"))
+			} else if n == 0 {
+				log.Error().Msg("wrote zero bytes. aborting.")
+				return wrapErr(ErrPipeAborted, errors.New("zero bytes indicated in write call"))
+			}
+
+			// otherwise we wrote some bytes. increment the counter
+			log.Trace().Int("numBytes", n).Msg("wrote bytes")
+			wc += n
+			p.opts.count(n)
+			if p.opts.flushing() {
+				p.opts.countFlushed(n)
+			}
+		}
+		p.opts.countChunk()
+		if !collapsed {
+			p.opts.recordLatency(dw.readTime, dw.due)
+		}
+		putBuffer(dw.pooled)
 	}
-}
+}
\ No newline at end of file
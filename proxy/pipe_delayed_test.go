@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tens of thousands of small chunks all go through the delay queue. an out of order write would show up as a sequence
+// number out of place.
+func TestDelayedPipeManySmallChunksInOrder(t *testing.T) {
+	const numbers = 100000
+	data := make([]byte, 4*numbers)
+	for i := 0; i < numbers; i++ {
+		binary.BigEndian.PutUint32(data[4*i:], uint32(i))
+	}
+
+	counters := &pipeCounters{}
+	got, err := pipeThrough(t, func(src io.ReadWriteCloser, dst io.ReadWriteCloser) Pipe {
+		return NewDelayedPipe(src, dst, time.Millisecond, WithBufferSize(16), withCounters(counters))
+	}, data)
+	if err != nil {
+		t.Fatalf("pipe failed: %s", err)
+	}
+	if len(got) != len(data) {
+		t.Fatalf("got %d bytes, want %d", len(got), len(data))
+	}
+	for i := 0; i < numbers; i++ {
+		if n := binary.BigEndian.Uint32(got[4*i:]); n != uint32(i) {
+			t.Fatalf("got sequence number %d at position %d", n, i)
+		}
+	}
+	if chunks := atomic.LoadInt64(&counters.chunks); chunks < 20000 {
+		t.Fatalf("only %d chunks were forwarded", chunks)
+	}
+}
+
+// a destination taking a while for every write, like a slow link
+type slowWriter struct {
+	perWrite time.Duration
+	written  int64
+}
+
+func (w *slowWriter) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (w *slowWriter) Write(b []byte) (int, error) {
+	time.Sleep(w.perWrite)
+	atomic.AddInt64(&w.written, int64(len(b)))
+	return len(b), nil
+}
+
+func (w *slowWriter) Close() error {
+	return nil
+}
+
+// once the destination falls behind, the full queue stops the pipe from reading, so chunks are delayed from when they
+// were read rather than waiting in an ever longer queue on top of their delay
+func TestDelayedPipeBackpressureBoundsSkew(t *testing.T) {
+	const queueDepth, perWrite = 8, 2 * time.Millisecond
+	client, src := tcpPair(t)
+	dst := &slowWriter{perWrite: perWrite}
+	data := testData(512 * 1024)
+	go func() {
+		client.Write(data)
+		client.(*net.TCPConn).CloseWrite()
+	}()
+
+	counters := &pipeCounters{}
+	p := NewDelayedPipe(src, dst, 5*time.Millisecond, WithBufferSize(1024), WithQueueDepth(queueDepth), withCounters(counters))
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := p.Run(ctx); err != nil {
+		t.Fatalf("pipe failed: %s", err)
+	}
+	if written := atomic.LoadInt64(&dst.written); written != int64(len(data)) {
+		t.Fatalf("wrote %d bytes, want %d", written, len(data))
+	}
+
+	// a chunk waits for at most the chunks queued before it. without backpressure, the last ones would wait for the
+	// whole transfer, about a second.
+	skew := counters.skew.summary()
+	if bound := 10 * queueDepth * perWrite; skew.Max > bound {
+		t.Fatalf("chunks were written up to %s late, more than %s for %d chunks", skew.Max, bound, skew.Count)
+	}
+}
+
+// the sender fills the queue much faster than it drains, so every chunk is read with more bytes queued ahead of it and
+// gets a longer delay than the one before, until the emulated buffer is full
+func TestDelayedPipeBufferbloatDelaysGrow(t *testing.T) {
+	const base, maxExtra = 100 * time.Millisecond, 160 * time.Millisecond
+	bloat := Bufferbloat{Buffer: 16 * 1024, MaxDelay: maxExtra}
+	client, src := tcpPair(t)
+	dst := &slowWriter{perWrite: 5 * time.Millisecond}
+	data := testData(32 * 1024)
+	go func() {
+		client.Write(data)
+		client.(*net.TCPConn).CloseWrite()
+	}()
+
+	trace := &bytes.Buffer{}
+	// nothing is due before the base delay is up, which is plenty of time to read everything
+	p := NewDelayedPipe(src, dst, base, WithBufferSize(1024), WithBufferbloat(bloat), withDirection("up"),
+		withDelayTracing(&delayTracing{out: NewDelayTraceWriter(trace), fallback: -1}))
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := p.Run(ctx); err != nil {
+		t.Fatalf("pipe failed: %s", err)
+	}
+
+	var delays []time.Duration
+	for _, line := range strings.Split(strings.TrimSpace(trace.String()), "\n") {
+		fields := strings.Fields(line)
+		d, err := time.ParseDuration(fields[len(fields)-1])
+		if err != nil {
+			t.Fatalf("invalid trace line %q", line)
+		}
+		delays = append(delays, d)
+	}
+	if len(delays) < 32 {
+		t.Fatalf("got %d chunks for %d bytes with a 1024 byte buffer", len(delays), len(data))
+	}
+	if delays[0] != base {
+		t.Fatalf("first chunk delayed by %s with an empty queue, want %s", delays[0], base)
+	}
+	for i := 1; i < len(delays); i++ {
+		full := delays[i-1] == base+maxExtra
+		if full && delays[i] != base+maxExtra || !full && delays[i] <= delays[i-1] {
+			t.Fatalf("chunk %d delayed by %s after %s", i+1, delays[i], delays[i-1])
+		}
+	}
+	if last := delays[len(delays)-1]; last != base+maxExtra {
+		t.Fatalf("last chunk delayed by %s with a full buffer, want %s", last, base+maxExtra)
+	}
+}
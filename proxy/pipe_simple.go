@@ -5,42 +5,60 @@ import (
 	"errors"
 	"github.com/rs/zerolog/log"
 	"io"
-	"net"
 	"time"
 )
 
 type simplePipe struct {
-	src net.Conn
-	dst net.Conn
+	src  io.ReadWriteCloser
+	dst  io.ReadWriteCloser
+	opts *pipeOptions
 }
 
-func NewSimplePipe(src net.Conn, dst net.Conn) Pipe {
-	return &simplePipe{src: src, dst: dst}
+func NewSimplePipe(src io.ReadWriteCloser, dst io.ReadWriteCloser, opts ...PipeOption) Pipe {
+	return &simplePipe{src: src, dst: dst, opts: newPipeOptions(opts)}
 }
 
 func (p *simplePipe) Run(ctx context.Context) error {
 	// use the log object from the context with updated fields
 	log := log.Ctx(ctx).With().Str("func", "simplePipe.Run").Logger()
 
-	// use a static buffer of 1MB
-	bbuf := make([]byte, 1024*1024)
+	// use a static buffer from the pools, 1MB unless set with WithBufferSize
+	buf := getBuffer(p.opts.bufferSize)
+	defer putBuffer(buf)
+	bbuf := *buf
 
-	// disable deadlines for now. note the loop below will set the source read deadline.
-	err := p.src.SetDeadline(time.Time{})
+	// disable deadlines. reads block until data arrives or the pipe is cancelled.
+	err := clearDeadlines(p.src)
 	if err != nil {
 		log.Error().Err(err).Msg("error while setting read deadline")
 		return err
 	}
-	err = p.dst.SetDeadline(time.Time{})
+	err = clearDeadlines(p.dst)
 	if err != nil {
 		log.Error().Err(err).Msg("error while setting write deadline")
 		return err
 	}
 
+	// unblock the pending read once the context is cancelled or the pipe is told to flush, and the pending write once
+	// the context is cancelled
+	defer watchReads(ctx, p.src, nil, p.opts.flush)()
+	defer watchWrites(ctx, p.dst)()
+
 	log.Info().Msg("pipe running")
 
+	// set once the source has signalled EOF. the close is handled on the next pass so that data returned along with the
+	// EOF is forwarded first.
+	sourceEOF := false
+
 	// receive bytes in an infinite loop
 	for {
+		if sourceEOF {
+			// this is a normal close
+			log.Info().Msg("connection closed by source")
+			p.opts.propagateEOF(log, p.dst)
+			return nil
+		}
+
 		// use a select to allow for cancelling via context
 		select {
 		case <-ctx.Done():
@@ -48,57 +66,91 @@ func (p *simplePipe) Run(ctx context.Context) error {
 			log.Debug().Msg("exiting due to cancelled context")
 			return nil
 
+		case <-p.opts.flush:
+			// nothing is pending, so just stop
+			log.Debug().Msg("stopping to flush")
+			return nil
+
 		default:
-			// otherwise, set a read deadline a short time in the future and attempt to read. this allows us to periodically
-			// check for context cancellation
-			err := p.src.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
-			if err != nil {
-				log.Error().Err(err).Msg("error while setting source read deadline")
-				return err
+			// otherwise, block until data arrives
+			// with a read rate limit, wait until the next read is allowed and read no more than the rate allows
+			readBuf := p.opts.readBuffer(ctx, bbuf)
+			if readBuf == nil {
+				log.Debug().Msg("exiting due to cancelled context")
+				return nil
 			}
-			nb, err := p.src.Read(bbuf)
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				// this is a normal read timeout due to deadline. nothing to see here.
-				log.Trace().Msg("read timeout. continuing...")
-				continue
-			} else if err == io.EOF {
-				// this is a normal close. return nil.
-				log.Info().Msg("connection closed by source")
+			nb, err := p.src.Read(readBuf)
+			p.opts.countRead(nb)
+			readTime := time.Now()
+			if err == io.EOF {
+				// a read may return the final bytes along with the EOF
+				sourceEOF = true
+				if nb == 0 {
+					continue
+				}
+			} else if err != nil && ctx.Err() != nil {
+				// the read was interrupted due to the cancelled context
+				log.Debug().Msg("exiting due to cancelled context")
+				return nil
+			} else if err != nil && p.opts.flushing() {
+				// the read was interrupted to flush
+				log.Debug().Msg("stopping to flush")
 				return nil
 			} else if err != nil {
 				// for any other error, return it. this should result in the context getting torn down.
 				log.Error().Err(err).Msg("error while reading from connection")
-				return err
+				return &pipeIOError{read: true, err: err}
 			}
 			// otherwise we have some data. write it immediately
-			log.Info().Int("numBytes", nb).Msg("read bytes")
+			log.Trace().Int("numBytes", nb).Msg("read bytes")
+			p.opts.traceChunk(log, bbuf[:nb])
+			p.opts.recordChunk(bbuf[:nb])
+			chunk, err := p.opts.transform(bbuf[:nb])
+			if err != nil {
+				log.Error().Err(err).Msg("error while transforming chunk")
+				return err
+			}
+			if len(chunk) == 0 {
+				log.Debug().Int("numBytes", nb).Msg("transformer dropped chunk")
+				continue
+			}
 
 			// this really should go through in one write call, but just in case, allow for partial writes and keep a write cursor
 			wc := 0
-			for wc < nb {
-				n, err := p.dst.Write(bbuf[wc:nb])
-				if err == io.EOF {
-					// this is a normal close. exit the loop.
-					log.Info().Msg("connection closed by dest")
+			for wc < len(chunk) {
+				n, err := p.opts.write(ctx, p.dst, chunk[wc:])
+				if err != nil && ctx.Err() == nil && isDestClosed(err) {
+					// the destination is gone. stop instead of reading data that can't be delivered anymore.
+					log.Info().Err(err).Msg("connection closed by dest")
+					return writeErr(err)
+				} else if err != nil && ctx.Err() != nil {
+					// the write was interrupted due to the cancelled context
+					log.Debug().Msg("exiting due to cancelled context")
 					return nil
+				} else if stalled := p.opts.stalled(err); stalled != nil {
+					log.Error().Err(stalled).Msg("write stalled. aborting.")
+					return stalled
 				} else if err != nil {
 					log.Error().Err(err).Msg("error while writing to connection")
-					return err
+					return writeErr(err)
 				}
 
 				// shouldn't happen, but just in case
 				if n < 0 {
 					log.Error().Msg("wrote negative bytes. aborting.")
-					return errors.New("negative bytes indicated in write call")
+					return wrapErr(ErrPipeAborted, errors.New("negative bytes indicated in write call"))
 				} else if n == 0 {
 					log.Error().Msg("wrote zero bytes. aborting.")
-					return errors.New("zero bytes indicated in write call")
+					return wrapErr(ErrPipeAborted, errors.New("zero bytes indicated in write call"))
 				}
 
 				// otherwise we wrote some bytes. increment the counter
-				log.Debug().Int("numBytes", nb).Msg("wrote bytes")
+				log.Trace().Int("numBytes", nb).Msg("wrote bytes")
 				wc += n
+				p.opts.count(n)
 			}
+			p.opts.countChunk()
+			p.opts.recordLatency(readTime, readTime)
 		}
 	}
 }
@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// a tiny buffer splits the data into many chunks, and a queue depth of 1 makes the delayed pipe stop reading after
+// each one until it has been written
+func TestPipeTinyBufferAndQueue(t *testing.T) {
+	data := testData(256 * 1024)
+	opts := []PipeOption{WithBufferSize(512), WithQueueDepth(1)}
+	pipes := map[string]func(src io.ReadWriteCloser, dst io.ReadWriteCloser) Pipe{
+		"simple": func(src io.ReadWriteCloser, dst io.ReadWriteCloser) Pipe {
+			return NewSimplePipe(src, dst, opts...)
+		},
+		"delayed": func(src io.ReadWriteCloser, dst io.ReadWriteCloser) Pipe {
+			return NewDelayedPipe(src, dst, time.Millisecond, opts...)
+		},
+		"delayed no copy": func(src io.ReadWriteCloser, dst io.ReadWriteCloser) Pipe {
+			return NewDelayedPipe(src, dst, time.Millisecond, append(opts, WithNoCopy())...)
+		},
+	}
+	for name, newPipe := range pipes {
+		t.Run(name, func(t *testing.T) {
+			got, err := pipeThrough(t, newPipe, data)
+			if err != nil {
+				t.Fatalf("pipe failed: %s", err)
+			}
+			checkSame(t, got, data)
+		})
+	}
+}
+
+func TestPipeChunksLimitedByBufferSize(t *testing.T) {
+	counters := &pipeCounters{}
+	data := testData(64 * 1024)
+	got, err := pipeThrough(t, func(src io.ReadWriteCloser, dst io.ReadWriteCloser) Pipe {
+		return NewDelayedPipe(src, dst, time.Millisecond, WithBufferSize(512), WithQueueDepth(1), withCounters(counters))
+	}, data)
+	if err != nil {
+		t.Fatalf("pipe failed: %s", err)
+	}
+	checkSame(t, got, data)
+	if chunks := atomic.LoadInt64(&counters.chunks); chunks < int64(len(data)/512) {
+		t.Fatalf("got %d chunks for %d bytes with a 512 byte buffer", chunks, len(data))
+	}
+}
+
+// a connection whose reads serve the given data and return the last of it together with io.EOF, which the io.Reader
+// contract allows
+type eofConn struct {
+	net.Conn
+	data []byte
+}
+
+func (c *eofConn) Read(b []byte) (int, error) {
+	n := copy(b, c.data)
+	c.data = c.data[n:]
+	if len(c.data) == 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func TestPipeForwardsDataReturnedWithEOF(t *testing.T) {
+	data := testData(10000)
+	pipes := map[string]func(src io.ReadWriteCloser, dst io.ReadWriteCloser) Pipe{
+		"simple": func(src io.ReadWriteCloser, dst io.ReadWriteCloser) Pipe {
+			return NewSimplePipe(src, dst, WithBufferSize(4096))
+		},
+		"delayed": func(src io.ReadWriteCloser, dst io.ReadWriteCloser) Pipe {
+			return NewDelayedPipe(src, dst, time.Millisecond, WithBufferSize(4096))
+		},
+	}
+	for name, newPipe := range pipes {
+		t.Run(name, func(t *testing.T) {
+			_, conn := tcpPair(t)
+			src := &eofConn{Conn: conn, data: data}
+			dst, upstream := tcpPair(t)
+			ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+			defer cancel()
+			errc := make(chan error, 1)
+			go func() {
+				errc <- newPipe(src, dst).Run(ctx)
+			}()
+
+			upstream.SetReadDeadline(time.Now().Add(testTimeout))
+			got, err := ioutil.ReadAll(upstream)
+			if err != nil {
+				t.Fatalf("error while reading from the pipe: %s", err)
+			}
+			if err := <-errc; err != nil {
+				t.Fatalf("pipe failed: %s", err)
+			}
+			// the last 1808 bytes come with the EOF
+			checkSame(t, got, data)
+		})
+	}
+}
+
+// the upstream goes away while the client is still sending. the pipe stops at its next write instead of carrying on
+// reading from the client.
+func TestPipeDestinationClosedMidTransfer(t *testing.T) {
+	pipes := map[string]func(src io.ReadWriteCloser, dst io.ReadWriteCloser) Pipe{
+		"simple": func(src io.ReadWriteCloser, dst io.ReadWriteCloser) Pipe {
+			return NewSimplePipe(src, dst)
+		},
+		"delayed": func(src io.ReadWriteCloser, dst io.ReadWriteCloser) Pipe {
+			return NewDelayedPipe(src, dst, time.Millisecond)
+		},
+	}
+	for name, newPipe := range pipes {
+		t.Run(name, func(t *testing.T) {
+			client, src := tcpPair(t)
+			dst, upstream := tcpPair(t)
+			ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+			defer cancel()
+			go func() {
+				chunk := testData(16 * 1024)
+				for {
+					if _, err := client.Write(chunk); err != nil {
+						return
+					}
+				}
+			}()
+			errc := make(chan error, 1)
+			go func() {
+				errc <- newPipe(src, dst).Run(ctx)
+			}()
+
+			upstream.SetReadDeadline(time.Now().Add(testTimeout))
+			if _, err := io.CopyN(ioutil.Discard, upstream, 64*1024); err != nil {
+				t.Fatalf("error while reading from the pipe: %s", err)
+			}
+			upstream.Close()
+			closed := time.Now()
+
+			select {
+			case err := <-errc:
+				if !errors.Is(err, ErrDestinationClosed) {
+					t.Fatalf("got %v, want %v", err, ErrDestinationClosed)
+				}
+				if took := time.Since(closed); took > time.Second {
+					t.Fatalf("pipe took %s to notice the closed destination", took)
+				}
+			case <-time.After(testTimeout):
+				t.Fatal("pipe kept going after the destination closed")
+			}
+		})
+	}
+}
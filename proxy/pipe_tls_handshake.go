@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"context"
+	"github.com/rs/zerolog/log"
+	"net"
+	"sync"
+	"time"
+)
+
+// a pipe that only delays the TLS handshake of passed through TLS traffic. the TLS record layer of the stream is
+// inspected (without decrypting anything) and once application data records have been seen in both directions, both
+// pipes hand off to simple pipes for the rest of the session. chunks already queued at that point are still delivered
+// with their delay, so the order of data is preserved. if the stream turns out not to be TLS, it is delayed as usual.
+
+// TLS record content types
+const (
+	tlsRecordHandshake       = 22
+	tlsRecordApplicationData = 23
+)
+
+// the handshake state shared by the up and down pipes of a session
+type tlsHandshakeState struct {
+	mu       sync.Mutex
+	seenUp   bool
+	seenDown bool
+	done     chan struct{}
+}
+
+func newTLSHandshakeState() *tlsHandshakeState {
+	return &tlsHandshakeState{done: make(chan struct{})}
+}
+
+// records that application data has been seen in one direction, closing done once it has been seen in both
+func (s *tlsHandshakeState) sawApplicationData(up bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.seenUp && s.seenDown {
+		return
+	}
+	if up {
+		s.seenUp = true
+	} else {
+		s.seenDown = true
+	}
+	if s.seenUp && s.seenDown {
+		close(s.done)
+	}
+}
+
+// a connection that follows the TLS record framing of the data read from it
+type tlsRecordWatcher struct {
+	net.Conn
+	state *tlsHandshakeState
+	up    bool
+
+	// position within the stream. hdr collects the header of the next record and remaining is what's left of the
+	// body of the current one.
+	hdr       []byte
+	remaining int
+	// set once application data has been seen or the stream turned out not to be TLS
+	stopped bool
+}
+
+func (w *tlsRecordWatcher) Read(b []byte) (int, error) {
+	n, err := w.Conn.Read(b)
+	if n > 0 && !w.stopped {
+		w.observe(b[:n])
+	}
+	return n, err
+}
+
+func (w *tlsRecordWatcher) observe(b []byte) {
+	for len(b) > 0 && !w.stopped {
+		// skip over the body of the current record
+		if w.remaining > 0 {
+			skip := w.remaining
+			if skip > len(b) {
+				skip = len(b)
+			}
+			w.remaining -= skip
+			b = b[skip:]
+			continue
+		}
+
+		// collect the 5 byte record header: content type, version and length
+		need := 5 - len(w.hdr)
+		if need > len(b) {
+			need = len(b)
+		}
+		w.hdr = append(w.hdr, b[:need]...)
+		b = b[need:]
+		if len(w.hdr) < 5 {
+			return
+		}
+		contentType, major := w.hdr[0], w.hdr[1]
+		w.remaining = int(w.hdr[3])<<8 | int(w.hdr[4])
+		w.hdr = w.hdr[:0]
+
+		switch {
+		case major != 3 || contentType < 20 || contentType > tlsRecordApplicationData:
+			// not TLS. stop looking and let the delay apply throughout.
+			w.stopped = true
+		case contentType == tlsRecordApplicationData:
+			w.stopped = true
+			w.state.sawApplicationData(w.up)
+		}
+	}
+}
+
+type tlsHandshakePipe struct {
+	src   net.Conn
+	dst   net.Conn
+	delay time.Duration
+	state *tlsHandshakeState
+	up    bool
+	opts  []PipeOption
+}
+
+// up indicates whether this is the client to upstream direction. both pipes of a session must share the state.
+func newTLSHandshakePipe(src net.Conn, dst net.Conn, delay time.Duration, state *tlsHandshakeState, up bool, opts ...PipeOption) Pipe {
+	return &tlsHandshakePipe{src: src, dst: dst, delay: delay, state: state, up: up, opts: opts}
+}
+
+func (p *tlsHandshakePipe) Run(ctx context.Context) error {
+	// use the log object from the context with updated fields
+	log := log.Ctx(ctx).With().Str("func", "tlsHandshakePipe.Run").Logger()
+	ctx = log.WithContext(ctx)
+
+	// delay while the handshake is in progress
+	watcher := &tlsRecordWatcher{Conn: p.src, state: p.state, up: p.up}
+	opts := append(p.opts[:len(p.opts):len(p.opts)], withHandoff(p.state.done))
+	if err := NewDelayedPipe(watcher, p.dst, p.delay, opts...).Run(ctx); err != nil {
+		return err
+	}
+
+	// the delayed pipe also returns without error if the connection was closed, so check why it returned
+	select {
+	case <-p.state.done:
+	default:
+		return nil
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	log.Info().Msg("tls handshake complete. switching to simple pipe.")
+	return NewSimplePipe(p.src, p.dst, p.opts...).Run(ctx)
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"time"
+)
+
+// defines named presets of common network conditions, so that "make it feel like 3G" is a single setting. the numbers
+// are typical rather than exact, and each is meant to be combined with the other settings as usual.
+
+// bandwidth units in bytes per second, for rates given in bits per second as is common for links
+const (
+	Kbps int64 = 1000 / 8
+	Mbps int64 = 1000 * 1000 / 8
+)
+
+// the settings of a preset. bandwidths are in bytes per second, and 0 means no cap.
+type NetworkProfile struct {
+	Name          string
+	Description   string
+	UpDelay       time.Duration
+	DownDelay     time.Duration
+	Jitter        time.Duration
+	UpBandwidth   int64
+	DownBandwidth int64
+}
+
+// the built-in presets
+var NetworkProfiles = []NetworkProfile{
+	{
+		Name:          "3g",
+		Description:   "mobile 3G connection",
+		UpDelay:       150 * time.Millisecond,
+		DownDelay:     150 * time.Millisecond,
+		Jitter:        30 * time.Millisecond,
+		UpBandwidth:   768 * Kbps,
+		DownBandwidth: 1600 * Kbps,
+	},
+	{
+		Name:          "dsl",
+		Description:   "residential DSL line",
+		UpDelay:       20 * time.Millisecond,
+		DownDelay:     20 * time.Millisecond,
+		Jitter:        5 * time.Millisecond,
+		UpBandwidth:   1 * Mbps,
+		DownBandwidth: 8 * Mbps,
+	},
+	{
+		Name:          "satellite",
+		Description:   "geostationary satellite link",
+		UpDelay:       300 * time.Millisecond,
+		DownDelay:     300 * time.Millisecond,
+		Jitter:        20 * time.Millisecond,
+		UpBandwidth:   2 * Mbps,
+		DownBandwidth: 10 * Mbps,
+	},
+	{
+		Name:        "transatlantic",
+		Description: "well connected hosts on either side of the Atlantic",
+		UpDelay:     40 * time.Millisecond,
+		DownDelay:   40 * time.Millisecond,
+		Jitter:      2 * time.Millisecond,
+	},
+}
+
+// returns the built-in preset with the given name
+func LookupNetworkProfile(name string) (NetworkProfile, bool) {
+	for _, p := range NetworkProfiles {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return NetworkProfile{}, false
+}
@@ -0,0 +1,267 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// generates PROXY protocol headers so that the upstream (e.g. HAProxy or nginx) learns the real client address, and
+// parses them from clients behind a load balancer.
+// see https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt for the spec.
+
+// PROXY protocol versions
+const (
+	ProxyProtoV1 = 1
+	ProxyProtoV2 = 2
+)
+
+// signature starting every v2 header
+var proxyProtoV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// the longest possible v1 header including the trailing CRLF
+const proxyProtoV1MaxLen = 107
+
+// how long a client may take to send its PROXY protocol header
+const proxyProtoHeaderTimeout = 10 * time.Second
+
+// v2 TLV types used by the proxy, see section 2.2 of the spec
+const (
+	pp2TypeSSL           = 0x20
+	pp2SubtypeSSLVersion = 0x21
+	pp2SubtypeSSLCN      = 0x22
+)
+
+// bits of the client field of a PP2_TYPE_SSL TLV
+const (
+	pp2ClientSSL      = 0x01
+	pp2ClientCertConn = 0x02
+	pp2ClientCertSess = 0x04
+)
+
+// a type-length-value field appended to a v2 header
+type proxyProtoTLV struct {
+	typ   byte
+	value []byte
+}
+
+// appends the encoded TLV to b
+func (t proxyProtoTLV) appendTo(b []byte) []byte {
+	b = append(b, t.typ, byte(len(t.value)>>8), byte(len(t.value)))
+	return append(b, t.value...)
+}
+
+// builds a PP2_TYPE_SSL TLV describing a terminated TLS connection, so that an upstream that understands it can
+// recover the client's identity. the verify field is 0 only if the client presented a certificate that was verified.
+func proxyProtoSSLTLV(state tls.ConnectionState) proxyProtoTLV {
+	client := byte(pp2ClientSSL)
+	if len(state.PeerCertificates) > 0 {
+		// a resumed session doesn't present the certificate again
+		client |= pp2ClientCertSess
+		if !state.DidResume {
+			client |= pp2ClientCertConn
+		}
+	}
+	verify := uint32(1)
+	if len(state.VerifiedChains) > 0 {
+		verify = 0
+	}
+	value := []byte{client, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(value[1:], verify)
+	value = proxyProtoTLV{pp2SubtypeSSLVersion, []byte("TLSv" + tlsVersionName(state.Version))}.appendTo(value)
+	if len(state.PeerCertificates) > 0 && state.PeerCertificates[0].Subject.CommonName != "" {
+		value = proxyProtoTLV{pp2SubtypeSSLCN, []byte(state.PeerCertificates[0].Subject.CommonName)}.appendTo(value)
+	}
+	return proxyProtoTLV{pp2TypeSSL, value}
+}
+
+// the addresses conveyed by a PROXY protocol header. both are nil if the header didn't carry addresses (e.g. a v1
+// UNKNOWN or v2 LOCAL header).
+type proxyProtoAddrs struct {
+	src net.Addr
+	dst net.Addr
+}
+
+// builds a PROXY protocol header of the given version for a connection from src to dst. if either address isn't a
+// TCP address (e.g. a unix socket client), a header without address information is generated. the TLVs are appended
+// to a v2 header and ignored for v1, which has no room for them.
+func proxyProtoHeader(version int, src net.Addr, dst net.Addr, tlvs []proxyProtoTLV) ([]byte, error) {
+	srcTCP, srcOK := src.(*net.TCPAddr)
+	dstTCP, dstOK := dst.(*net.TCPAddr)
+	known := srcOK && dstOK
+
+	// use the IPv4 form only if both addresses are IPv4. otherwise, both are encoded as IPv6.
+	var srcIP, dstIP net.IP
+	v4 := false
+	if known {
+		srcIP, dstIP = srcTCP.IP.To4(), dstTCP.IP.To4()
+		v4 = srcIP != nil && dstIP != nil
+		if !v4 {
+			srcIP, dstIP = srcTCP.IP.To16(), dstTCP.IP.To16()
+			known = srcIP != nil && dstIP != nil
+		}
+	}
+
+	switch version {
+	case ProxyProtoV1:
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		proto := "TCP6"
+		if v4 {
+			proto = "TCP4"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, srcIP, dstIP, srcTCP.Port, dstTCP.Port)), nil
+
+	case ProxyProtoV2:
+		var tlvBytes []byte
+		for _, t := range tlvs {
+			tlvBytes = t.appendTo(tlvBytes)
+		}
+		buf := bytes.Buffer{}
+		buf.Write(proxyProtoV2Sig)
+		// version 2, PROXY command
+		buf.WriteByte(0x21)
+		// the length covers the addresses and the TLVs
+		switch {
+		case !known:
+			// unspecified family, no addresses
+			buf.WriteByte(0x00)
+			binary.Write(&buf, binary.BigEndian, uint16(len(tlvBytes)))
+		case v4:
+			// TCP over IPv4
+			buf.WriteByte(0x11)
+			binary.Write(&buf, binary.BigEndian, uint16(12+len(tlvBytes)))
+		default:
+			// TCP over IPv6
+			buf.WriteByte(0x21)
+			binary.Write(&buf, binary.BigEndian, uint16(36+len(tlvBytes)))
+		}
+		if known {
+			buf.Write(srcIP)
+			buf.Write(dstIP)
+			binary.Write(&buf, binary.BigEndian, uint16(srcTCP.Port))
+			binary.Write(&buf, binary.BigEndian, uint16(dstTCP.Port))
+		}
+		buf.Write(tlvBytes)
+		return buf.Bytes(), nil
+	}
+
+	return nil, fmt.Errorf("unsupported PROXY protocol version %d", version)
+}
+
+// reads a v1 or v2 PROXY protocol header from the start of the connection and returns the source and destination
+// addresses it carries. nothing beyond the header is consumed, so the connection can be used as usual afterwards.
+func readProxyProtoHeader(conn net.Conn) (net.Addr, net.Addr, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(proxyProtoHeaderTimeout)); err != nil {
+		return nil, nil, err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	// both versions are at least this long, so it's safe to read this much before knowing which one it is
+	prefix := make([]byte, len(proxyProtoV2Sig))
+	if _, err := io.ReadFull(conn, prefix); err != nil {
+		return nil, nil, fmt.Errorf("error while reading PROXY protocol header: %w", err)
+	}
+	if bytes.Equal(prefix, proxyProtoV2Sig) {
+		return readProxyProtoV2(conn)
+	}
+	if bytes.HasPrefix(prefix, []byte("PROXY ")) {
+		return readProxyProtoV1(conn, prefix)
+	}
+	return nil, nil, fmt.Errorf("connection doesn't start with a PROXY protocol header")
+}
+
+// reads the remainder of a v1 header. the header is read a byte at a time so as not to consume any data after it.
+func readProxyProtoV1(conn net.Conn, prefix []byte) (net.Addr, net.Addr, error) {
+	line := prefix
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyProtoV1MaxLen {
+			return nil, nil, fmt.Errorf("PROXY protocol v1 header too long")
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil, nil, fmt.Errorf("error while reading PROXY protocol header: %w", err)
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("malformed PROXY protocol v1 header %q", line)
+	}
+	src, err := parseProxyProtoV1Addr(fields[2], fields[4], fields[1] == "TCP4")
+	if err != nil {
+		return nil, nil, fmt.Errorf("malformed PROXY protocol v1 header %q: %w", line, err)
+	}
+	dst, err := parseProxyProtoV1Addr(fields[3], fields[5], fields[1] == "TCP4")
+	if err != nil {
+		return nil, nil, fmt.Errorf("malformed PROXY protocol v1 header %q: %w", line, err)
+	}
+	return src, dst, nil
+}
+
+func parseProxyProtoV1Addr(ip string, port string, v4 bool) (*net.TCPAddr, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil || (addr.To4() != nil) != v4 {
+		return nil, fmt.Errorf("invalid address %s", ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %s", port)
+	}
+	return &net.TCPAddr{IP: addr, Port: int(p)}, nil
+}
+
+// reads the remainder of a v2 header after the signature
+func readProxyProtoV2(conn net.Conn) (net.Addr, net.Addr, error) {
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return nil, nil, fmt.Errorf("error while reading PROXY protocol header: %w", err)
+	}
+	if hdr[0]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported PROXY protocol v2 version %d", hdr[0]>>4)
+	}
+	cmd, fam := hdr[0]&0x0f, hdr[1]
+	body := make([]byte, binary.BigEndian.Uint16(hdr[2:]))
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return nil, nil, fmt.Errorf("error while reading PROXY protocol header: %w", err)
+	}
+
+	switch cmd {
+	case 0x0:
+		// LOCAL, e.g. a health check from the load balancer itself. there are no addresses to use.
+		return nil, nil, nil
+	case 0x1:
+		// PROXY
+	default:
+		return nil, nil, fmt.Errorf("unsupported PROXY protocol v2 command %d", cmd)
+	}
+
+	// only TCP and UDP over IPv4/IPv6 carry addresses we can use. anything else (e.g. unix sockets) is treated like
+	// an UNKNOWN header. any TLVs after the addresses are ignored.
+	ipLen := 0
+	switch fam {
+	case 0x11, 0x12:
+		ipLen = 4
+	case 0x21, 0x22:
+		ipLen = 16
+	default:
+		return nil, nil, nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, nil, fmt.Errorf("PROXY protocol v2 header too short for its address family")
+	}
+	src := &net.TCPAddr{IP: net.IP(body[:ipLen]), Port: int(binary.BigEndian.Uint16(body[2*ipLen:]))}
+	dst := &net.TCPAddr{IP: net.IP(body[ipLen : 2*ipLen]), Port: int(binary.BigEndian.Uint16(body[2*ipLen+2:]))}
+	return src, dst, nil
+}
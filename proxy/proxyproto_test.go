@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// decodes hex with spaces between the fields, for readable expected headers
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// the signature, version and command common to all v2 headers
+const proxyProtoV2Prefix = "0d0a0d0a000d0a515549540a 21"
+
+var (
+	clientV4 = &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 56324}
+	proxyV4  = &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}
+	clientV6 = &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}
+	proxyV6  = &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 80}
+)
+
+// a client certificate verified during the handshake
+var verifiedClientTLS = tls.ConnectionState{
+	Version:          tls.VersionTLS13,
+	PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "client.example"}}},
+	VerifiedChains:   [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "client.example"}}}},
+}
+
+func TestProxyProtoV2Header(t *testing.T) {
+	tests := []struct {
+		name string
+		src  net.Addr
+		dst  net.Addr
+		tlvs []proxyProtoTLV
+		want string
+	}{
+		{
+			name: "ipv4",
+			src:  clientV4,
+			dst:  proxyV4,
+			want: proxyProtoV2Prefix + " 11 000c c0a8010a 0a000001 dc04 01bb",
+		},
+		{
+			name: "ipv6",
+			src:  clientV6,
+			dst:  proxyV6,
+			want: proxyProtoV2Prefix + " 21 0024 20010db8000000000000000000000001 20010db8000000000000000000000002 04d2 0050",
+		},
+		{
+			// one IPv6 address makes both IPv6
+			name: "mixed",
+			src:  clientV4,
+			dst:  proxyV6,
+			want: proxyProtoV2Prefix + " 21 0024 00000000000000000000ffffc0a8010a 20010db8000000000000000000000002 dc04 0050",
+		},
+		{
+			name: "unix client",
+			src:  &net.UnixAddr{Name: "/run/client.sock", Net: "unix"},
+			dst:  proxyV4,
+			want: proxyProtoV2Prefix + " 00 0000",
+		},
+		{
+			// client SSL, certificate in the connection and the session, verified, TLSv1.3 and the common name
+			name: "ipv4 with ssl tlv",
+			src:  clientV4,
+			dst:  proxyV4,
+			tlvs: []proxyProtoTLV{proxyProtoSSLTLV(verifiedClientTLS)},
+			want: proxyProtoV2Prefix + " 11 002f c0a8010a 0a000001 dc04 01bb" +
+				" 20 0020 07 00000000 21 0007 544c5376312e33 22 000e 636c69656e742e6578616d706c65",
+		},
+	}
+	for _, test := range tests {
+		got, err := proxyProtoHeader(ProxyProtoV2, test.src, test.dst, test.tlvs)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if want := unhex(t, test.want); !bytes.Equal(got, want) {
+			t.Errorf("%s: got\n%x\nwant\n%x", test.name, got, want)
+		}
+	}
+}
+
+func TestProxyProtoSSLTLV(t *testing.T) {
+	tests := []struct {
+		name  string
+		state tls.ConnectionState
+		want  string
+	}{
+		{
+			name:  "verified client certificate",
+			state: verifiedClientTLS,
+			want:  "20 0020 07 00000000 21 0007 544c5376312e33 22 000e 636c69656e742e6578616d706c65",
+		},
+		{
+			// no certificate, so verification failed and there is no common name
+			name:  "no client certificate",
+			state: tls.ConnectionState{Version: tls.VersionTLS12},
+			want:  "20 000f 01 00000001 21 0007 544c5376312e32",
+		},
+		{
+			// the certificate isn't presented again on resumption
+			name: "resumed session",
+			state: tls.ConnectionState{
+				Version:          tls.VersionTLS12,
+				DidResume:        true,
+				PeerCertificates: verifiedClientTLS.PeerCertificates,
+				VerifiedChains:   verifiedClientTLS.VerifiedChains,
+			},
+			want: "20 0020 05 00000000 21 0007 544c5376312e32 22 000e 636c69656e742e6578616d706c65",
+		},
+	}
+	for _, test := range tests {
+		tlv := proxyProtoSSLTLV(test.state)
+		if got, want := tlv.appendTo(nil), unhex(t, test.want); !bytes.Equal(got, want) {
+			t.Errorf("%s: got\n%x\nwant\n%x", test.name, got, want)
+		}
+	}
+}
+
+func TestProxyProtoV1Header(t *testing.T) {
+	got, err := proxyProtoHeader(ProxyProtoV1, clientV4, proxyV4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "PROXY TCP4 192.168.1.10 10.0.0.1 56324 443\r\n"; string(got) != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	got, err = proxyProtoHeader(ProxyProtoV1, clientV6, proxyV6, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "PROXY TCP6 2001:db8::1 2001:db8::2 1234 80\r\n"; string(got) != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+// the reader skips the TLVs, leaving the data after the header for the session
+func TestReadProxyProtoV2WithTLV(t *testing.T) {
+	header, err := proxyProtoHeader(ProxyProtoV2, clientV6, proxyV6, []proxyProtoTLV{proxyProtoSSLTLV(verifiedClientTLS)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, conn := tcpPair(t)
+	go client.Write(append(header, "hello"...))
+
+	src, dst, err := readProxyProtoHeader(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src.String() != clientV6.String() || dst.String() != proxyV6.String() {
+		t.Fatalf("got %s -> %s, want %s -> %s", src, dst, clientV6, proxyV6)
+	}
+	rest := make([]byte, 5)
+	if _, err := io.ReadFull(conn, rest); err != nil || string(rest) != "hello" {
+		t.Fatalf("got %q (%v) after the header, want %q", rest, err, "hello")
+	}
+}
@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// defines recording of sessions to files so that their traffic can be inspected or replayed later.
+// each session gets its own directory below the recording directory, named after its start time and connection number.
+// it holds the raw bytes read from the client (up.bin) and from the upstream (down.bin), one JSON line per chunk in the
+// order they were read (chunks.jsonl) and a summary written once the session ends (meta.json). chunk times are relative
+// to when the upstream connection was established.
+//
+// recording must not perturb the delays, so chunks are copied and handed to a routine writing them in the background.
+// if it falls behind, the recording of the session stops and is marked as truncated rather than holding up the pipes.
+
+// the number of chunks that may wait to be written before a recording is truncated
+const recordingBacklog = 4096
+
+// a chunk as listed in chunks.jsonl
+type RecordedChunk struct {
+	// "up" for bytes read from the client and "down" for bytes read from the upstream
+	Direction string `json:"dir"`
+	// when the chunk was read, relative to when the upstream connection was established
+	Time time.Duration `json:"t"`
+	Len  int           `json:"len"`
+}
+
+// the summary of a recorded session as written to meta.json
+type RecordingMeta struct {
+	Start        time.Time     `json:"start"`
+	ClientAddr   string        `json:"clientAddr"`
+	UpstreamAddr string        `json:"upstreamAddr"`
+	Duration     time.Duration `json:"duration"`
+	UpBytes      int64         `json:"upBytes"`
+	DownBytes    int64         `json:"downBytes"`
+	// the recording ended early because writing it couldn't keep up. the files hold a consistent prefix.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// records every session of the server in its own directory below dir, which is created if needed
+func WithRecording(dir string) ServerOption {
+	return func(s *tcpDelayServer) {
+		s.recordDir = dir
+	}
+}
+
+type recordedData struct {
+	chunk RecordedChunk
+	b     []byte
+}
+
+// records one session
+type recorder struct {
+	dir   string
+	meta  RecordingMeta
+	start time.Time
+
+	// chunks waiting to be written. both pipes send to it, and it is closed and set to nil once the recording is
+	// closed or truncated.
+	mu        sync.Mutex
+	pending   chan recordedData
+	truncated bool
+
+	done chan struct{}
+	err  error
+}
+
+// creates the session's directory and starts writing
+func newRecorder(baseDir string, connNum int64, clientAddr string, upstreamAddr string) (*recorder, error) {
+	now := time.Now()
+	dir := filepath.Join(baseDir, fmt.Sprintf("%s-%d", now.Format("20060102T150405.000"), connNum))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating recording directory: %w", err)
+	}
+	r := &recorder{
+		dir:     dir,
+		meta:    RecordingMeta{Start: now, ClientAddr: clientAddr, UpstreamAddr: upstreamAddr},
+		start:   now,
+		pending: make(chan recordedData, recordingBacklog),
+		done:    make(chan struct{}),
+	}
+	files := make([]*os.File, 0, 3)
+	for _, name := range []string{"up.bin", "down.bin", "chunks.jsonl"} {
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, fmt.Errorf("error creating recording file: %w", err)
+		}
+		files = append(files, f)
+	}
+	go r.run(files[0], files[1], files[2])
+	return r, nil
+}
+
+// hands a chunk read by the given direction over to the writing routine. never blocks.
+func (r *recorder) record(direction string, b []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pending == nil {
+		return
+	}
+	d := recordedData{chunk: RecordedChunk{Direction: direction, Time: time.Since(r.start), Len: len(b)}, b: append([]byte(nil), b...)}
+	select {
+	case r.pending <- d:
+	default:
+		r.truncated = true
+		close(r.pending)
+		r.pending = nil
+	}
+}
+
+// writes the chunks until the recording is closed or truncated
+func (r *recorder) run(up *os.File, down *os.File, chunks *os.File) {
+	defer close(r.done)
+	upW, downW, chunksW := bufio.NewWriter(up), bufio.NewWriter(down), bufio.NewWriter(chunks)
+	enc := json.NewEncoder(chunksW)
+	var err error
+	for d := range r.pending {
+		if err != nil {
+			continue
+		}
+		w := upW
+		if d.chunk.Direction == "down" {
+			w = downW
+			r.meta.DownBytes += int64(len(d.b))
+		} else {
+			r.meta.UpBytes += int64(len(d.b))
+		}
+		if _, err = w.Write(d.b); err == nil {
+			err = enc.Encode(d.chunk)
+		}
+	}
+	for _, f := range []struct {
+		w *bufio.Writer
+		f *os.File
+	}{{upW, up}, {downW, down}, {chunksW, chunks}} {
+		if ferr := f.w.Flush(); err == nil {
+			err = ferr
+		}
+		if cerr := f.f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	r.err = err
+}
+
+// finishes the recording and writes its summary. returns the first error writing it.
+func (r *recorder) close() error {
+	r.mu.Lock()
+	if r.pending != nil {
+		close(r.pending)
+		r.pending = nil
+	}
+	r.meta.Truncated = r.truncated
+	r.mu.Unlock()
+	<-r.done
+
+	r.meta.Duration = time.Since(r.start)
+	b, err := json.MarshalIndent(r.meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(r.dir, "meta.json"), append(b, '\n'), 0644); err != nil && r.err == nil {
+		r.err = err
+	}
+	return r.err
+}
+
+// makes the pipe record the chunks it reads
+func withRecorder(r *recorder) PipeOption {
+	return func(o *pipeOptions) {
+		o.recorder = r
+	}
+}
+
+// records a chunk read from the source, if recording
+func (o *pipeOptions) recordChunk(b []byte) {
+	if o.recorder != nil {
+		o.recorder.record(o.direction, b)
+	}
+}
@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// defines replaying the client side of a recorded session against an upstream, without needing the original client.
+// the recorded chunks are sent through a regular session, so the delays and pipe options apply just as they would to
+// a real client.
+
+// a session recorded with WithRecording, as loaded by LoadRecording
+type Recording struct {
+	RecordingMeta
+
+	// the chunks read from the client, in order, and their bytes
+	upChunks []RecordedChunk
+	up       []byte
+}
+
+// loads the recording of a session from its directory
+func LoadRecording(dir string) (*Recording, error) {
+	rec := &Recording{}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "meta.json"))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &rec.RecordingMeta); err != nil {
+		return nil, fmt.Errorf("invalid meta.json: %w", err)
+	}
+	if rec.up, err = ioutil.ReadFile(filepath.Join(dir, "up.bin")); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(filepath.Join(dir, "chunks.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var total int
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var c RecordedChunk
+		if err := dec.Decode(&c); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("invalid chunks.jsonl: %w", err)
+		}
+		if c.Direction == "up" {
+			rec.upChunks = append(rec.upChunks, c)
+			total += c.Len
+		}
+	}
+	if total != len(rec.up) {
+		return nil, fmt.Errorf("chunks.jsonl lists %d bytes from the client but up.bin has %d", total, len(rec.up))
+	}
+	return rec, nil
+}
+
+// the outcome of a replay
+type ReplayResult struct {
+	// bytes sent to the upstream and bytes received back
+	SentBytes     int64
+	ReceivedBytes int64
+	// bytes the upstream sent in the recording
+	RecordedBytes int64
+}
+
+// indicates whether the upstream responded with a different number of bytes than in the recording
+func (r ReplayResult) Diverged() bool {
+	return r.ReceivedBytes != r.RecordedBytes
+}
+
+// replays the client side of rec against upstreamAddr. each chunk is sent at its recorded time multiplied by scale,
+// so a scale of 2 replays at half speed and a scale of 0 sends everything right away. once the recorded duration has
+// passed, the sending direction is half-closed, and the replay ends once the upstream closes its side or the session
+// ends otherwise, e.g. after the half-close timeout. the returned error is that of the session.
+func Replay(ctx context.Context, rec *Recording, upstreamAddr string, scale float64, upDelay time.Duration, downDelay time.Duration, pipeOpts ...PipeOption) (ReplayResult, error) {
+	result := ReplayResult{RecordedBytes: rec.DownBytes}
+
+	// the session's client connection is one end of a loopback connection and the replay drives the other
+	near, far, err := loopbackPair(ctx)
+	if err != nil {
+		return result, fmt.Errorf("error setting up replay connection: %w", err)
+	}
+	defer far.Close()
+	c := newSession(upDelay, downDelay, near, upstreamAddr, pipeOpts)
+	connected := make(chan struct{})
+	c.hooks = &Hooks{OnUpstreamConnected: func(net.Addr, net.Addr) { close(connected) }}
+	sessionErr := make(chan error, 1)
+	go func() {
+		sessionErr <- c.Run(ctx)
+	}()
+
+	// count what comes back until the session closes its end
+	received := make(chan struct{})
+	go func() {
+		result.ReceivedBytes, _ = io.Copy(ioutil.Discard, far)
+		close(received)
+	}()
+
+	// the recorded times are relative to when the upstream connection was established
+	select {
+	case <-connected:
+	case <-received:
+	}
+	start := time.Now()
+	at := func(d time.Duration) time.Time {
+		return start.Add(time.Duration(float64(d) * scale))
+	}
+	sleepUntil := func(t time.Time) bool {
+		wait := time.Until(t)
+		if wait <= 0 {
+			return true
+		}
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return false
+		case <-received:
+			return false
+		case <-timer.C:
+			return true
+		}
+	}
+
+	offset := 0
+	for _, chunk := range rec.upChunks {
+		if !sleepUntil(at(chunk.Time)) {
+			break
+		}
+		n, err := far.Write(rec.up[offset : offset+chunk.Len])
+		result.SentBytes += int64(n)
+		if err != nil {
+			break
+		}
+		offset += chunk.Len
+	}
+	// half-close even if the upstream is done already, so that the session doesn't wait for more from the client
+	sleepUntil(at(rec.Duration))
+	closeWrite(far)
+
+	err = <-sessionErr
+	far.Close()
+	<-received
+	return result, err
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package proxy
+
+import (
+	"golang.org/x/sys/unix"
+	"syscall"
+)
+
+// sets SO_REUSEPORT on a listening socket so that several listeners can share a port
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,11 @@
+package proxy
+
+import (
+	"errors"
+	"syscall"
+)
+
+// windows has no equivalent of SO_REUSEPORT
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT is not supported on windows")
+}
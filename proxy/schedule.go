@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	"time"
+)
+
+// defines time of day schedules for the delays, e.g. for day-long simulations where the network conditions follow a
+// diurnal pattern. sessions started within a window get its delays instead of the server's. outside of all windows,
+// the server's delay settings apply.
+
+// a window of the day and its delays. Start and End are offsets from midnight in the schedule's location. a window
+// ending before it starts wraps around midnight, e.g. 22:00-06:00.
+type ScheduleWindow struct {
+	// identifies the window in logs and stats. defaults to the window's times, e.g. "09:00-17:00".
+	Name      string
+	Start     time.Duration
+	End       time.Duration
+	UpDelay   time.Duration
+	DownDelay time.Duration
+}
+
+// a set of windows that don't overlap
+type DelaySchedule struct {
+	windows []ScheduleWindow
+	loc     *time.Location
+}
+
+// checks the windows and returns a schedule evaluating them in loc, or in local time if loc is nil. overlapping
+// windows are rejected.
+func NewDelaySchedule(windows []ScheduleWindow, loc *time.Location) (*DelaySchedule, error) {
+	if loc == nil {
+		loc = time.Local
+	}
+	s := &DelaySchedule{loc: loc}
+	for _, w := range windows {
+		if w.Start < 0 || w.Start >= 24*time.Hour || w.End < 0 || w.End > 24*time.Hour {
+			return nil, fmt.Errorf("window %s: times must be within the day", windowName(w))
+		}
+		if w.Start == w.End {
+			return nil, fmt.Errorf("window %s: must not be empty", windowName(w))
+		}
+		if w.UpDelay < 0 || w.DownDelay < 0 {
+			return nil, fmt.Errorf("window %s: delays must not be negative", windowName(w))
+		}
+		if w.Name == "" {
+			w.Name = windowName(w)
+		}
+		for _, other := range s.windows {
+			if windowsOverlap(w, other) {
+				return nil, fmt.Errorf("window %s overlaps window %s", w.Name, other.Name)
+			}
+		}
+		s.windows = append(s.windows, w)
+	}
+	if len(s.windows) == 0 {
+		return nil, errors.New("no windows")
+	}
+	return s, nil
+}
+
+// formats a window's times as hh:mm-hh:mm, with seconds if needed
+func windowName(w ScheduleWindow) string {
+	return formatTimeOfDay(w.Start) + "-" + formatTimeOfDay(w.End)
+}
+
+func formatTimeOfDay(d time.Duration) string {
+	h, m, s := int(d/time.Hour), int(d/time.Minute)%60, int(d/time.Second)%60
+	if s != 0 {
+		return fmt.Sprintf("%02d:%02d:%02d", h, m, s)
+	}
+	return fmt.Sprintf("%02d:%02d", h, m)
+}
+
+// splits a window into the parts before and after midnight
+func windowRanges(w ScheduleWindow) [][2]time.Duration {
+	if w.Start < w.End {
+		return [][2]time.Duration{{w.Start, w.End}}
+	}
+	return [][2]time.Duration{{w.Start, 24 * time.Hour}, {0, w.End}}
+}
+
+func windowsOverlap(a ScheduleWindow, b ScheduleWindow) bool {
+	for _, ra := range windowRanges(a) {
+		for _, rb := range windowRanges(b) {
+			if ra[0] < rb[1] && rb[0] < ra[1] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// returns the window containing t, if any
+func (s *DelaySchedule) Active(t time.Time) (ScheduleWindow, bool) {
+	t = t.In(s.loc)
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second +
+		time.Duration(t.Nanosecond())
+	for _, w := range s.windows {
+		for _, r := range windowRanges(w) {
+			if offset >= r[0] && offset < r[1] {
+				return w, true
+			}
+		}
+	}
+	return ScheduleWindow{}, false
+}
+
+// makes sessions take their delays from the schedule's window at the time they start. with a positive interval, the
+// schedule is evaluated again at that interval and running sessions pick up the delays of a new window once it starts.
+// randomization still applies to the window's delays, and a delay policy takes precedence over the schedule.
+func WithDelaySchedule(schedule *DelaySchedule, interval time.Duration) ServerOption {
+	return func(s *tcpDelayServer) {
+		s.schedule = schedule
+		s.scheduleInterval = interval
+	}
+}
+
+// returns the settings with the delays of the active window, if any, and the window's name
+func (s *tcpDelayServer) scheduled(settings DelaySettings) (DelaySettings, string) {
+	if s.schedule == nil {
+		return settings, ""
+	}
+	w, ok := s.schedule.Active(time.Now())
+	if !ok {
+		return settings, ""
+	}
+	settings.UpDelay, settings.DownDelay = w.UpDelay, w.DownDelay
+	return settings, w.Name
+}
+
+// the name of the active window, or empty if there is none
+func (s *tcpDelayServer) activeWindow() string {
+	_, name := s.scheduled(DelaySettings{})
+	return name
+}
+
+// evaluates the schedule every interval and moves the running sessions to the delays of a new window once it starts
+func (s *tcpDelayServer) followSchedule(ctx context.Context, log zerolog.Logger) {
+	t := time.NewTicker(s.scheduleInterval)
+	defer t.Stop()
+	window := s.activeWindow()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if w := s.activeWindow(); w != window {
+			window = w
+			log.Info().Str("window", window).Msg("schedule window changed. applying to running sessions.")
+			s.SetDelaySettings(s.DelaySettings(), true)
+		}
+	}
+}
@@ -2,117 +2,1121 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"golang.org/x/exp/rand"
 	"gonum.org/v1/gonum/stat/distuv"
 	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 // defines a generic proxy server object
 // a server represents a single proxy server instance that will listen for incoming connections and proxy those to
 // a specified upstream.
-// for now, we just have a single server implementation so it is defined in this file.
+// the TCP server implementation is defined in this file. see udp_server.go for the UDP one.
 
 type Server interface {
 	Run(context.Context) error
+
+	// returns the address the server is actually listening on, or nil if it isn't listening yet. this is useful
+	// when listening on port 0 and letting the OS choose.
+	Addr() net.Addr
+
+	// returns a channel that is closed once the server is listening
+	Ready() <-chan struct{}
+
+	// returns a channel that is closed once Run has returned. Ready is never closed if the server fails to listen, so
+	// anything waiting for it should wait for Done as well.
+	Done() <-chan struct{}
+
+	// stops the server without cancelling the context passed to Run. the server stops accepting new connections and
+	// waits for running sessions to finish. once ctx is done, the remaining sessions stop reading, deliver what they
+	// have already read as set with WithShutdownFlush and are then closed, and ctx's error is returned. Shutdown
+	// returns after Run has returned, so Run must have been called.
+	Shutdown(ctx context.Context) error
+}
+
+// implemented by servers that can also run on a listener supplied by the caller instead of their listen address
+type ListenerServer interface {
+	Server
+	Serve(ctx context.Context, ln net.Listener) error
 }
 
 type tcpDelayServer struct {
-	listenPort     int
-	upDelay        time.Duration
-	downDelay      time.Duration
-	randomizeDelay bool
-	upstreamAddr   string
+	listenAddr string
+	delaysMu   sync.RWMutex
+	delays     DelaySettings
+	// the address new sessions dial. it can be changed while the server runs.
+	upstreamMu   sync.RWMutex
+	upstreamAddr string
+	seed         uint64
+	pipeOpts     []PipeOption
+
+	rerandomizeInterval time.Duration
+	randomizeMax        float64
+	dial                dialConfig
+	clientNoDelay       *bool
+	acceptWorkers       int
+	tcpFastOpen         bool
+	multipathTCP        bool
+	socketMode          os.FileMode
+	listenNetwork       string
+	tlsConfig           *tls.Config
+	upstreamTLS         *tls.Config
+	upstreamALPNCopy    bool
+	sendProxy           int
+	acceptProxy         bool
+	sniRoutes           map[string]string
+	rejectUnknownSNI    bool
+	tlsHandshakeOnly    bool
+	statsInterval       time.Duration
+	statsBytes          int64
+	logger              *zerolog.Logger
+	delayPolicy         DelayPolicy
+	upDelayFunc         DelayFunc
+	downDelayFunc       DelayFunc
+	halfCloseTimeout    time.Duration
+	shutdownFlush       FlushMode
+	latency             *latencyMeter
+	recordDir           string
+	traceOut            *DelayTraceWriter
+	traceIn             *DelayTrace
+	traceFallback       time.Duration
+	ttfbDelay           time.Duration
+	schedule            *DelaySchedule
+	scheduleInterval    time.Duration
+	upBandwidth         int64
+	downBandwidth       int64
+	upReadRate          int64
+	downReadRate        int64
+
+	// set by ServeStream, whose only session's error is kept in streamErr
+	stream    bool
+	streamErr error
+
+	// rng state shared by the accept workers
+	rngMu   sync.Mutex
+	rng     *rand.Rand
+	logNorm distuv.LogNormal
+
+	// optional callbacks for library users
+	hooks *Hooks
+
+	// the running sessions, so that changed delays can be applied to them and so that shutdown can wait for them
+	sessionsMu sync.Mutex
+	sessions   map[*session]struct{}
+	sessionsWg sync.WaitGroup
+
+	// counters for Stats. the bytes of finished sessions are guarded by sessionsMu so that they move over from the
+	// running sessions atomically.
+	totalSessions     int64
+	dialFailures      int64
+	acceptFailures    int64
+	panics            int64
+	failedSessions    int64
+	finishedUpBytes   int64
+	finishedDownBytes int64
+
+	// closed by Shutdown to stop accepting, and once its context is done to tear down the remaining sessions
+	draining   chan struct{}
+	drainOnce  sync.Once
+	expired    chan struct{}
+	expireOnce sync.Once
+
+	// closed once Run returns
+	done chan struct{}
+
+	// the resolved listen address once listening
+	addrMu sync.Mutex
+	addr   net.Addr
+	ready  chan struct{}
+}
+
+// a ServerOption customizes optional behavior of the server
+type ServerOption func(*tcpDelayServer)
+
+// decides the up and down delays of a session from the address of its client, e.g. to delay clients from one network
+// more than others
+type DelayPolicy func(clientAddr net.Addr) (up time.Duration, down time.Duration)
+
+// seeds the random number generator used for delay randomization. each session's pipes are in turn seeded from this
+// generator, so runs with the same seed and the same connection order are reproducible. without a seed, a time based
+// seed is used.
+func WithSeed(seed uint64) ServerOption {
+	return func(s *tcpDelayServer) {
+		s.seed = seed
+	}
+}
+
+// randomized delays scale the configured delays by a factor drawn from a log-normal distribution. mu is chosen so that
+// the factor averages 1, which makes the configured delay the mean. the median is e^(-sigma²/2) ≈ 0.61 times the
+// configured delay.
+const randomizeSigma = 1.0
+
+// the largest factor a randomized delay is scaled by unless set with WithRandomizeMax. about 0.3% of draws are
+// clamped, which lowers the mean by about 1%.
+const DefaultRandomizeMax = 10.0
+
+func newRandomizeDist(src rand.Source) distuv.LogNormal {
+	return distuv.LogNormal{
+		Mu:    -randomizeSigma * randomizeSigma / 2,
+		Sigma: randomizeSigma,
+		Src:   src,
+	}
+}
+
+// with randomized delay, clamps the factor the configured delays are scaled by to max, so that a rare huge draw can't
+// stall a session. 0 means no limit. the default is DefaultRandomizeMax.
+func WithRandomizeMax(max float64) ServerOption {
+	return func(s *tcpDelayServer) {
+		s.randomizeMax = max
+	}
+}
+
+// with randomized delay, draws new up/down delays for each session at the given interval. the new delays apply to
+// chunks read after the change. chunks already queued keep their original delay.
+func WithRerandomizeInterval(interval time.Duration) ServerOption {
+	return func(s *tcpDelayServer) {
+		s.rerandomizeInterval = interval
+	}
+}
+
+// limits how long a single attempt to connect to the upstream may take. 0 means no timeout beyond the OS default.
+func WithDialTimeout(timeout time.Duration) ServerOption {
+	return func(s *tcpDelayServer) {
+		s.dial.timeout = timeout
+	}
+}
+
+// establishes upstream connections (and connections to a SOCKS5 or HTTP proxy) with the given dialer instead of a
+// net.Dialer, e.g. to use an in-memory transport in tests or set special socket options. the dial timeout still
+// applies via the context.
+func WithDialer(dialer Dialer) ServerOption {
+	return func(s *tcpDelayServer) {
+		s.dial.dialer = dialer
+	}
 }
 
-func NewTcpDelayServer(listenPort int, upDelay time.Duration, downDelay time.Duration, randomizeDelay bool, upstreamAddr string) Server {
-	return &tcpDelayServer{
-		listenPort:     listenPort,
-		upDelay:        upDelay,
-		downDelay:      downDelay,
-		randomizeDelay: randomizeDelay,
-		upstreamAddr:   upstreamAddr,
+// serves every session with the given handler instead of connecting to the upstream address, which is then only used
+// as a label in the logs. EchoHandler turns the server into a delayed echo server.
+func WithUpstreamHandler(handler UpstreamHandler) ServerOption {
+	return func(s *tcpDelayServer) {
+		s.dial.handler = handler
+	}
+}
+
+// retries transient upstream dial failures (e.g. refused connections or timeouts) up to the given number of times,
+// waiting backoff before the first retry and doubling it for each subsequent one
+func WithDialRetries(retries int, backoff time.Duration) ServerOption {
+	return func(s *tcpDelayServer) {
+		s.dial.retries = retries
+		s.dial.backoff = backoff
+	}
+}
+
+// selects the network direct upstream connections are dialed with: "tcp" (the default, which tries both address
+// families of a dual-stack upstream), "tcp4" or "tcp6", e.g. for deterministic tests against a dual-stack host.
+// connections to a SOCKS5 or HTTP proxy aren't affected.
+func WithUpstreamNetwork(network string) ServerOption {
+	return func(s *tcpDelayServer) {
+		s.dial.network = network
+	}
+}
+
+// makes direct upstream connections originate from the given local address, e.g. to pick the NIC whose routing
+// policy applies. a port of 0 lets the OS choose the port. a fixed port allows only one upstream connection at a time.
+// it has no effect with WithDialer.
+func WithUpstreamLocalAddr(addr *net.TCPAddr) ServerOption {
+	return func(s *tcpDelayServer) {
+		s.dial.localAddr = addr
+	}
+}
+
+// sets how long dialing a dual-stack upstream waits for the preferred address family before racing the other one.
+// 0, the default, uses Go's default of 300ms, and a negative delay disables the fallback. it has no effect with
+// WithDialer.
+func WithDialFallbackDelay(delay time.Duration) ServerOption {
+	return func(s *tcpDelayServer) {
+		s.dial.fallbackDelay = delay
+	}
+}
+
+// controls TCP_NODELAY (i.e. disables Nagle's algorithm if true) on accepted client connections. without this option,
+// Go's default (no delay) is used.
+func WithClientNoDelay(noDelay bool) ServerOption {
+	return func(s *tcpDelayServer) {
+		s.clientNoDelay = &noDelay
+	}
+}
+
+// controls TCP_NODELAY on upstream connections. without this option, Go's default (no delay) is used.
+func WithUpstreamNoDelay(noDelay bool) ServerOption {
+	return func(s *tcpDelayServer) {
+		s.dial.noDelay = &noDelay
+	}
+}
+
+// connects to the upstream through the SOCKS5 proxy at proxyAddr instead of directly. if user is non-empty, username/
+// password authentication is used. failures reaching the proxy are reported separately from the proxy's failures
+// reaching the upstream.
+func WithSocks5(proxyAddr string, user string, password string) ServerOption {
+	return func(s *tcpDelayServer) {
+		s.dial.socks5 = &socks5Config{addr: proxyAddr, user: user, password: password}
+	}
+}
+
+// tunnels upstream connections through the HTTP proxy at proxyAddr using CONNECT. if user is non-empty, basic auth is
+// sent. failures reaching the proxy are reported separately from the proxy refusing the tunnel.
+func WithHTTPProxy(proxyAddr string, user string, password string) ServerOption {
+	return func(s *tcpDelayServer) {
+		s.dial.http = &httpProxyConfig{addr: proxyAddr, user: user, password: password}
+	}
+}
+
+// logs to the given logger instead of the one stored in the context passed to Run. sessions and pipes add their
+// fields to it as usual.
+func WithLogger(logger zerolog.Logger) ServerOption {
+	return func(s *tcpDelayServer) {
+		s.logger = &logger
+	}
+}
+
+// picks the delays of each session with the given policy instead of the server's static or randomized delays. the
+// policy is called in the accept loop, so it should be quick. sessions get no re-randomization, and changing the delay
+// settings with applyExisting calls the policy again for each running session.
+func WithDelayPolicy(policy DelayPolicy) ServerOption {
+	return func(s *tcpDelayServer) {
+		s.delayPolicy = policy
+	}
+}
+
+// replaces the delays of every session with the given delay models, consulted for each chunk. either may be nil to
+// keep the configured delays for that direction. the models are shared by all sessions, so they must be safe for
+// concurrent use. the built-in ones (StaticDelay, NewJitteredDelay and NewLogNormalDelay) are.
+func WithDelayFuncs(up DelayFunc, down DelayFunc) ServerOption {
+	return func(s *tcpDelayServer) {
+		s.upDelayFunc = up
+		s.downDelayFunc = down
+	}
+}
+
+// adds d to the delay of the first chunk of each session's response, i.e. the first chunk flowing from the upstream to
+// the client, to inflate the time to first byte. see WithFirstChunkDelay.
+func WithTTFBDelay(d time.Duration) ServerOption {
+	return func(s *tcpDelayServer) {
+		s.ttfbDelay = d
+	}
+}
+
+// once a client or upstream has closed its sending side, the close is passed on to the other connection and the
+// opposite direction keeps running, e.g. so that the upstream can still respond. this limits how long it may run
+// before the session is closed. 0 means no limit. the default is DefaultHalfCloseTimeout.
+func WithHalfCloseTimeout(timeout time.Duration) ServerOption {
+	return func(s *tcpDelayServer) {
+		s.halfCloseTimeout = timeout
+	}
+}
+
+// what sessions still running when the Shutdown deadline hits do with data they have read but not yet written, e.g.
+// because it is still being delayed. cancelling the context passed to Run always discards it.
+type FlushMode int
+
+const (
+	// write pending data once its delay has passed. this is the default.
+	FlushDelayed FlushMode = iota
+	// write pending data right away
+	FlushImmediately
+	// discard pending data and close the sessions right away
+	FlushDiscard
+)
+
+// sets what sessions do with pending data when the Shutdown deadline hits. the default is FlushDelayed.
+func WithShutdownFlush(mode FlushMode) ServerOption {
+	return func(s *tcpDelayServer) {
+		s.shutdownFlush = mode
+	}
+}
+
+// runs the given number of accept loops, each with its own listener bound to the same address via SO_REUSEPORT, so
+// that accepting isn't a bottleneck at high connection rates. not supported on all platforms.
+func WithAcceptWorkers(workers int) ServerOption {
+	return func(s *tcpDelayServer) {
+		s.acceptWorkers = workers
+	}
+}
+
+// selects the network passed to net.Listen for TCP listen addresses: "tcp" (the default, which on dual-stack hosts
+// binds wildcard addresses for both IPv4 and IPv6), "tcp4" or "tcp6"
+func WithListenNetwork(network string) ServerOption {
+	return func(s *tcpDelayServer) {
+		s.listenNetwork = network
+	}
+}
+
+// sets the file permissions of the socket when listening on a Unix domain socket. without this option, the
+// permissions are determined by the umask.
+func WithSocketMode(mode os.FileMode) ServerOption {
+	return func(s *tcpDelayServer) {
+		s.socketMode = mode
+	}
+}
+
+// terminates TLS on accepted client connections using the given config, which must contain at least one certificate.
+// the upstream connection stays plain TCP and the delays apply to the decrypted byte stream.
+func WithTLSConfig(config *tls.Config) ServerOption {
+	return func(s *tcpDelayServer) {
+		s.tlsConfig = config
+	}
+}
+
+// originates TLS to the upstream using the given config. if the config doesn't set a server name, the upstream host
+// is used.
+func WithUpstreamTLS(config *tls.Config) ServerOption {
+	return func(s *tcpDelayServer) {
+		s.upstreamTLS = config
+	}
+}
+
+// with both TLS termination and upstream TLS, offers the upstream only the protocol negotiated with the client via
+// ALPN, e.g. h2, instead of the NextProtos of the upstream TLS config. sessions where the client negotiated none use
+// the config as is.
+func WithUpstreamALPNFromClient() ServerOption {
+	return func(s *tcpDelayServer) {
+		s.upstreamALPNCopy = true
+	}
+}
+
+// sends a PROXY protocol header (ProxyProtoV1 or ProxyProtoV2) with the client's address on each upstream connection
+// before any other data
+func WithSendProxy(version int) ServerOption {
+	return func(s *tcpDelayServer) {
+		s.sendProxy = version
+	}
+}
+
+// expects each client connection to start with a PROXY protocol header (v1 or v2), e.g. from a load balancer. the
+// real client address is added to the session's log fields and, with WithSendProxy, passed on to the upstream.
+// connections without a valid header are closed.
+func WithAcceptProxy() ServerOption {
+	return func(s *tcpDelayServer) {
+		s.acceptProxy = true
+	}
+}
+
+// routes sessions to upstreams based on the server name (SNI) in the client's TLS ClientHello. routes maps server
+// names to upstream addresses. without TLS termination, the ClientHello is peeked and then passed through to the chosen
+// upstream. sessions with an unknown or missing server name use the server's upstream, or are closed if
+// rejectUnknown is set.
+func WithSNIRoutes(routes map[string]string, rejectUnknown bool) ServerOption {
+	return func(s *tcpDelayServer) {
+		s.sniRoutes = make(map[string]string, len(routes))
+		for name, upstream := range routes {
+			s.sniRoutes[strings.ToLower(name)] = upstream
+		}
+		s.rejectUnknownSNI = rejectUnknown
+	}
+}
+
+// only delays the TLS handshake of passed through TLS traffic. once application data has been seen in both
+// directions, the session continues without delay.
+func WithTLSHandshakeDelayOnly() ServerOption {
+	return func(s *tcpDelayServer) {
+		s.tlsHandshakeOnly = true
+	}
+}
+
+// logs the bytes and chunks transferred and the throughput in each direction of every session at the given interval
+func WithStatsInterval(interval time.Duration) ServerOption {
+	return func(s *tcpDelayServer) {
+		s.statsInterval = interval
+	}
+}
+
+// additionally logs the stats of a direction as soon as it has transferred the given number of bytes since its last
+// report, so that fast transfers are reported more often than the interval. 0 means only at the interval.
+func WithStatsBytes(bytes int64) ServerOption {
+	return func(s *tcpDelayServer) {
+		s.statsBytes = bytes
+	}
+}
+
+// calls the given hooks for every connection. see Hooks for when they are called.
+func WithHooks(hooks Hooks) ServerOption {
+	return func(s *tcpDelayServer) {
+		s.hooks = &hooks
+	}
+}
+
+// sets options applied to the pipes of every session
+func WithPipeOptions(opts ...PipeOption) ServerOption {
+	return func(s *tcpDelayServer) {
+		s.pipeOpts = append(s.pipeOpts, opts...)
+	}
+}
+
+// listenAddr is in host:port form as accepted by net.Listen. an empty host (e.g. ":8080") listens on all interfaces.
+// alternatively, "unix:/path/to.sock" listens on a Unix domain socket. the socket file is removed on shutdown. on linux,
+// "unix-abstract:name" or "@name" listens on a socket in the abstract namespace. upstreamAddr takes the same Unix socket
+// forms.
+func NewTcpDelayServer(listenAddr string, upDelay time.Duration, downDelay time.Duration, randomizeDelay bool, upstreamAddr string, opts ...ServerOption) Server {
+	s := &tcpDelayServer{
+		listenAddr:   listenAddr,
+		delays:       DelaySettings{UpDelay: upDelay, DownDelay: downDelay, RandomizeDelay: randomizeDelay},
+		upstreamAddr: upstreamAddr,
+		sessions:     map[*session]struct{}{},
+		draining:     make(chan struct{}),
+		expired:      make(chan struct{}),
+		done:         make(chan struct{}),
+		ready:        make(chan struct{}),
+
+		halfCloseTimeout: DefaultHalfCloseTimeout,
+		randomizeMax:     DefaultRandomizeMax,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+func (s *tcpDelayServer) DelaySettings() DelaySettings {
+	s.delaysMu.RLock()
+	defer s.delaysMu.RUnlock()
+	return s.delays
+}
+
+func (s *tcpDelayServer) SetDelaySettings(settings DelaySettings, applyExisting bool) {
+	s.delaysMu.Lock()
+	s.delays = settings
+	s.delaysMu.Unlock()
+	if !applyExisting {
+		return
+	}
+
+	// draw new delays for each running session as if it had just been created
+	settings, _ = s.scheduled(settings)
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	for session := range s.sessions {
+		session.setDelays(s.sessionDelays(settings, session.clientConn.RemoteAddr()))
+	}
+}
+
+func (s *tcpDelayServer) Addr() net.Addr {
+	s.addrMu.Lock()
+	defer s.addrMu.Unlock()
+	return s.addr
+}
+
+func (s *tcpDelayServer) Ready() <-chan struct{} {
+	return s.ready
+}
+
+func (s *tcpDelayServer) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *tcpDelayServer) Shutdown(ctx context.Context) error {
+	s.drainOnce.Do(func() { close(s.draining) })
+	select {
+	case <-s.done:
+		return nil
+
+	case <-ctx.Done():
+		s.expireOnce.Do(func() { close(s.expired) })
+		<-s.done
+		return ctx.Err()
 	}
 }
 
+// embeds the logger given with WithLogger in the context, so that everything run under it logs there
+func (s *tcpDelayServer) logContext(ctx context.Context) context.Context {
+	if s.logger == nil {
+		return ctx
+	}
+	return s.logger.WithContext(ctx)
+}
+
+// whether Shutdown has been called
+func (s *tcpDelayServer) isDraining() bool {
+	select {
+	case <-s.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// Run should only be called once per server
 func (s *tcpDelayServer) Run(ctx context.Context) error {
+	defer close(s.done)
+
 	// use the log object from the context with additional fields
+	ctx = s.logContext(ctx)
 	log := log.Ctx(ctx).With().Str("func", "tcpDelayServer.Run").Logger()
 
-	// use a ListenConfig so it can be torn down via context
-	lc := net.ListenConfig{}
-
-	// establish the listener on all interfaces
-	ln, err := lc.Listen(ctx, "tcp", fmt.Sprintf(":%d", s.listenPort))
+	listeners, err := s.listen(ctx, log)
 	if err != nil {
-		log.Error().Err(err).Msg("error while establishing listener")
 		return err
 	}
-	defer ln.Close()
-	log.Info().Stringer("addr", ln.Addr()).Msg("listener established")
+	return s.serve(ctx, log, listeners)
+}
+
+// runs the server on a listener supplied by the caller instead of listening on the listen address, e.g. one on a
+// random port, a tls.Listener or an in-memory fake. the listener is closed once Serve returns. like Run, Serve should
+// only be called once per server, and not together with Run.
+func (s *tcpDelayServer) Serve(ctx context.Context, ln net.Listener) error {
+	defer close(s.done)
+
+	// use the log object from the context with additional fields
+	ctx = s.logContext(ctx)
+	log := log.Ctx(ctx).With().Str("func", "tcpDelayServer.Serve").Logger()
+	log.Info().Stringer("addr", ln.Addr()).Msg("serving on supplied listener")
+
+	return s.serve(ctx, log, []net.Listener{ln})
+}
+
+// establishes the listeners for Run, one per accept worker
+func (s *tcpDelayServer) listen(ctx context.Context, log zerolog.Logger) ([]net.Listener, error) {
+	// use a ListenConfig so it can be torn down via context. with multiple accept workers, each gets its own
+	// listener on the same port via SO_REUSEPORT.
+	lc := net.ListenConfig{}
+	workers := s.acceptWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > 1 {
+		lc.Control = reusePortControl
+	}
+	network, listenAddr := splitListenAddr(s.listenAddr)
+	if network == "tcp" && s.listenNetwork != "" {
+		network = s.listenNetwork
+	}
+	if s.tcpFastOpen && network != "unix" && checkTFO(log, false) {
+		lc.Control = chainControl(lc.Control, tfoListenControl(log))
+	}
+	if s.multipathTCP && network != "unix" {
+		checkMPTCP(log, false)
+		setListenMultipathTCP(&lc)
+	}
+	if network == "unix" {
+		if workers > 1 {
+			return nil, fmt.Errorf("accept workers aren't supported for unix socket %s", s.listenAddr)
+		}
+		// abstract sockets have no file that could be left behind
+		if !isAbstractUnixAddr(listenAddr) {
+			if err := removeStaleSocket(listenAddr); err != nil {
+				log.Error().Err(err).Str("listenAddr", s.listenAddr).Msg("error while establishing listener")
+				return nil, err
+			}
+		}
+	}
+
+	// establish the listeners. additional listeners use the resolved address of the first in case it was port 0.
+	listeners := make([]net.Listener, 0, workers)
+	closeListeners := func() {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+	}
+	for i := 0; i < workers; i++ {
+		addr := listenAddr
+		if i > 0 {
+			addr = listeners[0].Addr().String()
+		}
+		ln, err := lc.Listen(ctx, network, addr)
+		if err != nil {
+			err = printableUnixErr(err)
+			log.Error().Err(err).Str("listenAddr", s.listenAddr).Msg("error while establishing listener")
+			closeListeners()
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+	}
+
+	// closing a unix listener also removes its socket file, so only the permissions need handling here
+	if network == "unix" && !isAbstractUnixAddr(listenAddr) && s.socketMode != 0 {
+		if err := os.Chmod(listenAddr, s.socketMode); err != nil {
+			log.Error().Err(err).Str("listenAddr", s.listenAddr).Msg("error while setting socket permissions")
+			closeListeners()
+			return nil, err
+		}
+	}
+	log.Info().Stringer("addr", listeners[0].Addr()).Str("family", addrFamily(network, listeners[0].Addr())).
+		Int("acceptWorkers", workers).Msg("listener established")
+	return listeners, nil
+}
 
-	// for some reason, the listener is staying open even after the context is cancelled. force it closed.
+// runs an accept loop per listener until the context is cancelled or the server is shut down. the listeners are
+// closed on return.
+func (s *tcpDelayServer) serve(ctx context.Context, log zerolog.Logger, listeners []net.Listener) error {
+	closeListeners := func() {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+	}
+	defer closeListeners()
+
+	// record the resolved address and signal readiness
+	s.addrMu.Lock()
+	s.addr = listeners[0].Addr()
+	s.addrMu.Unlock()
+	close(s.ready)
+
+	// for some reason, the listener is staying open even after the context is cancelled. force it closed. shutting
+	// down closes it as well.
 	go func() {
-		<-ctx.Done()
-		ln.Close()
+		select {
+		case <-ctx.Done():
+		case <-s.draining:
+		}
+		closeListeners()
 	}()
 
-	// initialize rng
-	logNorm := distuv.LogNormal{
-		Mu:    0,
-		Sigma: 1.0,
-		Src:   rand.NewSource(uint64(time.Now().Unix())),
+	// initialize rng. it is shared by all accept workers, so access is guarded by rngMu.
+	seed := s.seed
+	if seed == 0 {
+		seed = uint64(time.Now().Unix())
 	}
+	src := rand.NewSource(seed)
+	s.rng = rand.New(src)
+	s.logNorm = newRandomizeDist(src)
 
 	// warn if delays are unreasonably small
 	// this is totally arbitrary, but my understanding is that time.Sleep takes several hundred microseconds. thus, if
 	// the user is specifying delays less than 1ms, they might not be getting the result they think they are as
 	// time.Sleep merely guarantees sleeping *at least* the specified duration.
-	if s.upDelay != 0 && s.upDelay.Milliseconds() == 0 {
-		log.Warn().Dur("upDelay", s.upDelay).Msg("upstream delay less than 1ms. actual delay might be longer. be careful.")
+	delays := s.DelaySettings()
+	if delays.UpDelay != 0 && delays.UpDelay.Milliseconds() == 0 {
+		log.Warn().Dur("upDelay", delays.UpDelay).Msg("upstream delay less than 1ms. actual delay might be longer. be careful.")
+	}
+	if delays.DownDelay != 0 && delays.DownDelay.Milliseconds() == 0 {
+		log.Warn().Dur("downDelay", delays.DownDelay).Msg("downstream delay less than 1ms. actual delay might be longer. be careful.")
+	}
+
+	// upstream connections without fast open still work, so an unsupported platform or kernel only disables it
+	if s.dial.fastOpen && s.dial.dialer == nil && s.dial.handler == nil && !checkTFO(log, true) {
+		s.dial.fastOpen = false
+	}
+	if s.dial.multipathTCP && s.dial.dialer == nil && s.dial.handler == nil {
+		checkMPTCP(log, true)
+	}
+
+	// sessions get their own context so that they can outlive the accept loops while draining
+	sessionCtx, cancelSessions := context.WithCancel(ctx)
+	defer cancelSessions()
+
+	if s.schedule != nil && s.scheduleInterval > 0 {
+		go s.followSchedule(sessionCtx, log)
+	}
+
+	// run an accept loop per listener. they share the connection counter so connNum stays unique.
+	var connNum int64
+	wg := sync.WaitGroup{}
+	for i, ln := range listeners {
+		wg.Add(1)
+		go func(worker int, ln net.Listener) {
+			log := log
+			if len(listeners) > 1 {
+				log = log.With().Int("acceptWorker", worker).Logger()
+			}
+			s.acceptLoop(sessionCtx, log, ln, &connNum)
+			wg.Done()
+		}(i, ln)
+	}
+	wg.Wait()
+
+	// when shutting down, wait for the running sessions to finish until the shutdown context is done
+	if s.isDraining() && ctx.Err() == nil {
+		finished := make(chan struct{})
+		go func() {
+			s.sessionsWg.Wait()
+			close(finished)
+		}()
+		log.Info().Int("sessions", s.numSessions()).Msg("stopped accepting. draining sessions.")
+		select {
+		case <-finished:
+			log.Info().Msg("all sessions finished")
+
+		case <-s.expired:
+			if s.shutdownFlush == FlushDiscard {
+				log.Warn().Int("sessions", s.numSessions()).Msg("drain deadline hit. closing remaining sessions.")
+				cancelSessions()
+				<-finished
+				break
+			}
+			// the sessions stop reading once expired is closed and finish after writing what they have read
+			log.Warn().Int("sessions", s.numSessions()).Msg("drain deadline hit. flushing remaining sessions.")
+			select {
+			case <-finished:
+			case <-ctx.Done():
+			}
+
+		case <-ctx.Done():
+		}
+	}
+
+	return nil
+}
+
+// sessions are listed from the time they start connecting to the upstream, in no particular order. the snapshots are
+// taken after letting go of the session list, so that accepting isn't held up by them.
+func (s *tcpDelayServer) Sessions() []SessionSnapshot {
+	s.sessionsMu.Lock()
+	sessions := make([]*session, 0, len(s.sessions))
+	for session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	s.sessionsMu.Unlock()
+	snapshots := make([]SessionSnapshot, 0, len(sessions))
+	for _, session := range sessions {
+		snapshots = append(snapshots, session.snapshot())
 	}
-	if s.downDelay != 0 && s.downDelay.Milliseconds() == 0 {
-		log.Warn().Dur("downDelay", s.downDelay).Msg("downstream delay less than 1ms. actual delay might be longer. be careful.")
+	return snapshots
+}
+
+func (s *tcpDelayServer) numSessions() int {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	return len(s.sessions)
+}
+
+// the wait after consecutive accept errors doubles from the min to the max
+const (
+	minAcceptBackoff = 10 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+func nextAcceptBackoff(backoff time.Duration) time.Duration {
+	if backoff == 0 {
+		return minAcceptBackoff
+	}
+	if backoff *= 2; backoff > maxAcceptBackoff {
+		return maxAcceptBackoff
 	}
+	return backoff
+}
 
-	i := 0
+// accepts client connections and spawns a session for each. only returns once the context is cancelled.
+func (s *tcpDelayServer) acceptLoop(ctx context.Context, log zerolog.Logger, ln net.Listener, connNum *int64) {
+	// the wait after the last of a run of consecutive accept errors
+	var backoff time.Duration
 	for {
-		i++
-		log := log.With().Int("connNum", i).Logger()
 		log.Debug().Msg("waiting for client connection")
 		clientConn, err := ln.Accept()
 		if err != nil {
-			// suppress any final error messages if the context has been cancelled
-			if ctx.Err() != nil {
-				return nil
+			// suppress any final error messages if the context has been cancelled or the server is shutting down
+			if ctx.Err() != nil || s.isDraining() {
+				return
+			}
+			// otherwise, log error and retry after a while, so that a persistent error doesn't spin
+			atomic.AddInt64(&s.acceptFailures, 1)
+			atomic.AddInt64(&debugAcceptFailures, 1)
+			backoff = nextAcceptBackoff(backoff)
+			e := log.Error().Err(err).Dur("backoff", backoff)
+			if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) {
+				e = e.Str("hint", "out of file descriptors. raise the limit, e.g. with ulimit -n, or lower the number of connections.")
 			}
-			// otherwise, log error and continue
-			log.Error().Err(err).Msg("error while accepting client connection")
+			e.Msg("error while accepting client connection")
+			t := time.NewTimer(backoff)
+			select {
+			case <-ctx.Done():
+			case <-s.draining:
+			case <-t.C:
+			}
+			t.Stop()
 			continue
 		}
-		log = log.With().Stringer("clientAddr", clientConn.RemoteAddr()).Logger()
-		log.Info().Msg("accepted client connection")
+		backoff = 0
+		atomic.AddInt64(&debugAccepts, 1)
+		num := atomic.AddInt64(connNum, 1)
+		atomic.AddInt64(&s.totalSessions, 1)
 
-		// put logger in context
-		ctx := log.WithContext(ctx)
+		// with TLS termination, the session only ever sees the decrypted stream
+		rawConn := clientConn
+		var tlsConn *tls.Conn
+		if s.tlsConfig != nil {
+			tlsConn = tls.Server(clientConn, s.tlsConfig)
+			clientConn = tlsConn
+		}
 
-		// calculate up and down delays for this session
-		upDelay := s.upDelay
-		downDelay := s.downDelay
-		if s.randomizeDelay {
-			upDelay = time.Duration(uint64(logNorm.Rand() * float64(uint64(upDelay))))
-			downDelay = time.Duration(uint64(logNorm.Rand() * float64(uint64(downDelay))))
+		session := s.newSession(clientConn)
+		session.connNum = num
+		// every line logged for the session from here on carries its id, including those of the pipes
+		log := log.With().Int64("connNum", num).Str("sessionId", session.id).Str("clientAddr", canonicalAddr(rawConn.RemoteAddr())).
+			Logger()
+		e := log.Info()
+		if s.multipathTCP {
+			e = e.Bool("multipathTCP", usesMultipathTCP(rawConn))
+		}
+		e.Msg("accepted client connection")
+
+		if s.clientNoDelay != nil {
+			if err := setNoDelay(rawConn, *s.clientNoDelay); err != nil {
+				log.Warn().Err(err).Bool("noDelay", *s.clientNoDelay).Msg("error while setting TCP_NODELAY on client connection")
+			}
+		}
+		if s.dial.recvBuf > 0 || s.dial.sendBuf > 0 {
+			if err := setConnSocketBuffers(rawConn, s.dial.recvBuf, s.dial.sendBuf); err != nil {
+				log.Warn().Err(err).Msg("error while setting socket buffers on client connection")
+			} else {
+				logSocketBuffers(log, rawConn, "client", s.dial.recvBuf, s.dial.sendBuf)
+			}
+		}
+		if s.delayPolicy != nil {
+			log.Info().Dur("upDelay", session.upDelay).Dur("downDelay", session.downDelay).Msg("delays chosen by policy")
 		}
 
 		// set up and run session in a routine
-		go func(ctx context.Context, upDelay time.Duration, downDelay time.Duration) {
-			session := NewDelayedSession(upDelay, downDelay, clientConn, s.upstreamAddr)
-			err = session.Run(ctx)
-			if err != nil {
-				log.Error().Err(err).Msg("session exited with error")
+		s.sessionsWg.Add(1)
+		go s.serveConn(log.WithContext(ctx), log, rawConn, tlsConn, session)
+	}
+}
+
+// prepares the client connection of a new session and runs it. an accepted PROXY protocol header is read from the raw
+// connection first, followed by the TLS handshake if terminating TLS. failures in either close the connection before
+// the upstream is contacted.
+func (s *tcpDelayServer) serveConn(ctx context.Context, log zerolog.Logger, rawConn net.Conn, tlsConn *tls.Conn, session *session) {
+	defer s.sessionsWg.Done()
+
+	// the error that ended the session, for the end of session hook and the stats. it is local to this routine so
+	// that a failing session can't interfere with the accept loop or other sessions.
+	var err error
+	defer func() {
+		if err != nil {
+			atomic.AddInt64(&s.failedSessions, 1)
+		}
+		if s.stream {
+			s.streamErr = err
+		}
+	}()
+	if s.hooks != nil {
+		if s.hooks.OnAccept != nil {
+			s.hooks.OnAccept(session.snapshot())
+		}
+		if s.hooks.OnSessionEnd != nil {
+			defer func() {
+				s.hooks.OnSessionEnd(SessionStats{SessionSnapshot: session.snapshot(), EndTime: time.Now(), Err: err})
+			}()
+		}
+	}
+	// a panic outside the pipes, e.g. while setting up the session, ends the session as well
+	defer func() {
+		if r := recover(); r != nil {
+			err = panicked(log, r)
+			session.clientConn.Close()
+		}
+		if errors.Is(err, ErrPanic) {
+			atomic.AddInt64(&s.panics, 1)
+		}
+	}()
+
+	if s.acceptProxy {
+		var src, dst net.Addr
+		src, dst, err = readProxyProtoHeader(rawConn)
+		if err != nil {
+			log.Error().Err(err).Msg("invalid PROXY protocol header from client. closing connection.")
+			rawConn.Close()
+			return
+		}
+		session.proxyAddrs = &proxyProtoAddrs{src: src, dst: dst}
+		if src != nil {
+			log = log.With().Stringer("realClientAddr", src).Logger()
+			ctx = log.WithContext(ctx)
+		}
+		log.Debug().Msg("read PROXY protocol header from client")
+	}
+
+	// when passing TLS through, peek at the ClientHello to learn the server name for routing
+	serverName := ""
+	if s.sniRoutes != nil && tlsConn == nil {
+		var name string
+		var replay net.Conn
+		name, replay, err = peekClientHello(rawConn)
+		if err != nil {
+			log.Error().Err(err).Msg("error while reading TLS ClientHello from client. closing connection.")
+			rawConn.Close()
+			return
+		}
+		serverName = name
+		session.clientConn = replay
+	}
+
+	// complete the TLS handshake before any pipes start so that failures are reported as such
+	if tlsConn != nil {
+		if err = tlsHandshake(tlsConn); err != nil {
+			l := log.Error().Err(err)
+			if subject := presentedSubject(err); subject != "" {
+				l = l.Str("clientSubject", subject)
 			}
-		}(ctx, upDelay, downDelay)
+			l.Msg("tls handshake with client failed")
+			tlsConn.Close()
+			return
+		}
+		state := tlsConn.ConnectionState()
+		log.Info().Str("tlsVersion", tlsVersionName(state.Version)).Str("alpn", state.NegotiatedProtocol).
+			Msg("tls handshake with client complete")
+		serverName = state.ServerName
+		session.clientTLS = &state
 	}
+
+	// pick the upstream based on the server name
+	if s.sniRoutes != nil {
+		log = log.With().Str("sni", serverName).Logger()
+		ctx = log.WithContext(ctx)
+		if upstream, ok := routeSNI(s.sniRoutes, serverName); ok {
+			session.upstreamAddr = upstream
+		} else if s.rejectUnknownSNI {
+			log.Warn().Msg("no route for server name. closing connection.")
+			session.clientConn.Close()
+			err = fmt.Errorf("no route for server name %q", serverName)
+			return
+		}
+		log.Debug().Str("upstreamAddr", session.upstreamAddr).Msg("routed session by server name")
+	}
+
+	s.sessionsMu.Lock()
+	s.sessions[session] = struct{}{}
+	s.sessionsMu.Unlock()
+	defer func() {
+		s.sessionsMu.Lock()
+		delete(s.sessions, session)
+		s.finishedUpBytes += atomic.LoadInt64(&session.upCounters.written)
+		s.finishedDownBytes += atomic.LoadInt64(&session.downCounters.written)
+		s.sessionsMu.Unlock()
+	}()
+
+	err = session.Run(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("session exited with error")
+		if !session.upstreamConnected {
+			atomic.AddInt64(&s.dialFailures, 1)
+		}
+	}
+}
+
+// sets up a session for a newly accepted client connection, including its randomized delays and seeds
+func (s *tcpDelayServer) newSession(clientConn net.Conn) *session {
+	// calculate up and down delays for this session
+	delays, window := s.scheduled(s.DelaySettings())
+	upDelay, downDelay := s.sessionDelays(delays, clientConn.RemoteAddr())
+
+	s.rngMu.Lock()
+	defer s.rngMu.Unlock()
+
+	// derive a pipe seed for this session so that impairment models are reproducible
+	pipeOpts := append(s.pipeOpts[:len(s.pipeOpts):len(s.pipeOpts)], WithPipeSeed(s.rng.Uint64()))
+
+	session := newSession(upDelay, downDelay, clientConn, s.UpstreamAddr(), pipeOpts)
+	session.dial = s.dial
+	session.upstreamTLS = s.upstreamTLS
+	session.upstreamALPNCopy = s.upstreamALPNCopy
+	session.sendProxy = s.sendProxy
+	session.delayTLSHandshakeOnly = s.tlsHandshakeOnly
+	session.statsInterval = s.statsInterval
+	session.statsBytes = s.statsBytes
+	session.hooks = s.hooks
+	session.halfCloseTimeout = s.halfCloseTimeout
+	session.upDelayFunc = s.upDelayFunc
+	session.downDelayFunc = s.downDelayFunc
+	session.latency = s.latency
+	session.recordDir = s.recordDir
+	session.ttfbDelay = s.ttfbDelay
+	session.scheduleWindow = window
+	session.upBandwidth = s.upBandwidth
+	session.downBandwidth = s.downBandwidth
+	session.upReadRate = s.upReadRate
+	session.downReadRate = s.downReadRate
+	if s.traceOut != nil || s.traceIn != nil {
+		session.tracing = &delayTracing{in: s.traceIn, fallback: s.traceFallback, out: s.traceOut}
+	}
+	if s.shutdownFlush != FlushDiscard {
+		session.flush = s.expired
+		session.collapseDelays = s.shutdownFlush == FlushImmediately
+	}
+	if delays.RandomizeDelay && s.rerandomizeInterval > 0 && s.delayPolicy == nil {
+		session.rerandomizeInterval = s.rerandomizeInterval
+		session.redraw = s.newRedraw(s.rng.Uint64())
+	}
+	return session
+}
+
+// returns a function drawing new randomized up/down delays. the function has its own rng, seeded from the given seed,
+// so it can safely be called from a session's routine.
+func (s *tcpDelayServer) newRedraw(seed uint64) func() (time.Duration, time.Duration) {
+	logNorm := newRandomizeDist(rand.NewSource(seed))
+	return func() (time.Duration, time.Duration) {
+		// randomization may have been turned off at runtime
+		delays, _ := s.scheduled(s.DelaySettings())
+		if !delays.RandomizeDelay {
+			return delays.UpDelay, delays.DownDelay
+		}
+		return s.randomize(delays.UpDelay, logNorm.Rand()), s.randomize(delays.DownDelay, logNorm.Rand())
+	}
+}
+
+// returns the up and down delays for a session of the given client, either from the delay policy or from the
+// settings
+func (s *tcpDelayServer) sessionDelays(delays DelaySettings, clientAddr net.Addr) (time.Duration, time.Duration) {
+	if s.delayPolicy != nil {
+		return s.delayPolicy(clientAddr)
+	}
+	return s.drawDelays(delays)
+}
+
+// returns the up and down delays for a session with the given settings, randomized if requested
+func (s *tcpDelayServer) drawDelays(delays DelaySettings) (time.Duration, time.Duration) {
+	if !delays.RandomizeDelay {
+		return delays.UpDelay, delays.DownDelay
+	}
+	s.rngMu.Lock()
+	defer s.rngMu.Unlock()
+	return s.randomize(delays.UpDelay, s.logNorm.Rand()), s.randomize(delays.DownDelay, s.logNorm.Rand())
+}
+
+// scales a delay by a factor drawn from the randomize distribution, clamped to the max factor
+func (s *tcpDelayServer) randomize(d time.Duration, factor float64) time.Duration {
+	if s.randomizeMax > 0 && factor > s.randomizeMax {
+		factor = s.randomizeMax
+	}
+	return scaleDelay(d, factor)
+}
+
+// describes the address family a listener actually accepts connections for, or that of a connection's remote address
+func addrFamily(network string, addr net.Addr) string {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return network
+	}
+	switch {
+	case network == "tcp4" || (network != "tcp6" && tcpAddr.IP.To4() != nil):
+		return "ipv4"
+	case network == "tcp" && tcpAddr.IP.IsUnspecified():
+		return "dual-stack"
+	}
+	return "ipv6"
+}
+
+// formats an address for logging. IPv4 clients of a dual-stack listener may show up as IPv4-mapped IPv6 addresses, so
+// those are always written in plain IPv4 form.
+func canonicalAddr(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		if ip4 := tcpAddr.IP.To4(); ip4 != nil {
+			return net.JoinHostPort(ip4.String(), strconv.Itoa(tcpAddr.Port))
+		}
+	}
+	return addr.String()
+}
+
+// scales a delay by a random factor
+func scaleDelay(d time.Duration, factor float64) time.Duration {
+	return time.Duration(uint64(factor * float64(uint64(d))))
 }
\ No newline at end of file
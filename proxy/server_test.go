@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServeProxiesWithDelay(t *testing.T) {
+	const upDelay, downDelay = 50 * time.Millisecond, 30 * time.Millisecond
+	srv := NewTcpDelayServer("", upDelay, downDelay, false, startTCPEcho(t))
+	addr := serveOn(t, srv)
+
+	payload := []byte("hello through the proxy")
+	got, took := roundTrip(t, addr, payload)
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("got %q, want %q", got, payload)
+	}
+	if took < upDelay+downDelay {
+		t.Fatalf("round trip took %s, less than the %s of delay", took, upDelay+downDelay)
+	}
+	if took > upDelay+downDelay+time.Second {
+		t.Fatalf("round trip took %s with %s of delay", took, upDelay+downDelay)
+	}
+}
+
+func TestRunProxiesLargePayload(t *testing.T) {
+	srv := NewTcpDelayServer("127.0.0.1:0", time.Millisecond, time.Millisecond, false, startTCPEcho(t))
+	addr := runServer(t, srv)
+
+	payload := testData(4 * 1024 * 1024)
+	got, _ := roundTrip(t, addr, payload)
+	checkSame(t, got, payload)
+}
+
+// idle pipes block in reads rather than polling, and the shutdown deadline unblocks all of them at once
+func TestShutdownManyIdleSessions(t *testing.T) {
+	const numConns, grace = 1000, 50 * time.Millisecond
+	for _, delay := range []time.Duration{0, 10 * time.Millisecond} {
+		srv := NewTcpDelayServer("", delay, delay, false, startTCPEcho(t))
+		addr := serveOn(t, srv)
+		for i := 0; i < numConns; i++ {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+		}
+		stats := srv.(StatsReporter)
+		waitFor(t, "all sessions to start", func() bool {
+			return stats.Stats().ActiveSessions == numConns
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), grace)
+		start := time.Now()
+		err := srv.Shutdown(ctx)
+		took := time.Since(start)
+		cancel()
+		if err != context.DeadlineExceeded {
+			t.Fatalf("delay %s: got %v from Shutdown, want the deadline error", delay, err)
+		}
+		if took > grace+500*time.Millisecond {
+			t.Fatalf("delay %s: shutdown with %d idle sessions took %s", delay, numConns, took)
+		}
+	}
+}
+
+// sessions failing at the same time must not disturb each other or the accept loop. run with -race.
+func TestServeManyFailingSessions(t *testing.T) {
+	const numConns = 50
+	// the upstream resets connections that start with an x and echoes the others
+	upstreamAddr := startUpstream(t, func(conn net.Conn) {
+		first := make([]byte, 1)
+		if _, err := io.ReadFull(conn, first); err != nil {
+			return
+		}
+		if first[0] == 'x' {
+			reset(conn)
+			return
+		}
+		conn.Write(first)
+		io.Copy(conn, conn)
+	})
+	// nothing listens on the address of a closed listener, so dials to it are refused
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refusedAddr := ln.Addr().String()
+	ln.Close()
+
+	for _, upstream := range []string{upstreamAddr, refusedAddr} {
+		srv := NewTcpDelayServer("", time.Millisecond, time.Millisecond, false, upstream)
+		addr := serveOn(t, srv)
+
+		var wg sync.WaitGroup
+		for i := 0; i < numConns; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				conn, err := net.Dial("tcp", addr)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(testTimeout))
+				conn.Write([]byte("x"))
+				ioutil.ReadAll(conn)
+			}()
+		}
+		wg.Wait()
+
+		stats := srv.(StatsReporter)
+		waitFor(t, "all sessions to fail", func() bool {
+			return stats.Stats().FailedSessions == numConns
+		})
+		s := stats.Stats()
+		if upstream == refusedAddr && s.DialFailures != numConns {
+			t.Fatalf("got %d dial failures, want %d", s.DialFailures, numConns)
+		}
+		if s.AcceptFailures != 0 {
+			t.Fatalf("got %d accept failures from failing sessions", s.AcceptFailures)
+		}
+
+		// the server keeps serving
+		if upstream == upstreamAddr {
+			payload := []byte("still there")
+			if got, _ := roundTrip(t, addr, payload); !bytes.Equal(got, payload) {
+				t.Fatalf("got %q, want %q", got, payload)
+			}
+		} else {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			waitFor(t, "another dial failure", func() bool {
+				return stats.Stats().DialFailures == numConns+1
+			})
+		}
+	}
+}
+
+// a panic in one session's pipes ends that session only
+func TestServePanickingTransformer(t *testing.T) {
+	transformer := func(direction string, chunk []byte) ([]byte, error) {
+		if bytes.HasPrefix(chunk, []byte("boom")) {
+			panic("transformer exploded")
+		}
+		return chunk, nil
+	}
+	for _, delay := range []time.Duration{0, time.Millisecond} {
+		ended := make(chan error, 1)
+		srv := NewTcpDelayServer("", delay, delay, false, startTCPEcho(t),
+			WithPipeOptions(WithTransformer(transformer)),
+			WithHooks(Hooks{
+				OnSessionEnd: func(stats SessionStats) {
+					ended <- stats.Err
+				},
+			}))
+		addr := serveOn(t, srv)
+
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte("boom"))
+		select {
+		case err := <-ended:
+			if !errors.Is(err, ErrPanic) {
+				t.Fatalf("delay %s: session ended with %v, want %v", delay, err, ErrPanic)
+			}
+		case <-time.After(testTimeout):
+			t.Fatalf("delay %s: session with a panicking transformer didn't end", delay)
+		}
+		if panics := srv.(StatsReporter).Stats().Panics; panics != 1 {
+			t.Fatalf("delay %s: got %d panics, want 1", delay, panics)
+		}
+
+		// the server keeps serving
+		payload := []byte("hello")
+		if got, _ := roundTrip(t, addr, payload); !bytes.Equal(got, payload) {
+			t.Fatalf("delay %s: got %q, want %q", delay, got, payload)
+		}
+		<-ended
+	}
+}
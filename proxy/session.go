@@ -2,9 +2,13 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,70 +17,385 @@ import (
 // for now, we just have a single implementation of session so it's contained in this file.
 
 type Session interface {
+	// runs the session until both directions have finished. returns nil if both sides closed cleanly or ctx was
+	// cancelled, and otherwise the first error that ended it. a client resetting its connection rather than closing it
+	// is reported as ErrClientClosed.
 	Run(ctx context.Context) error
 }
 
+// how long the other direction of a session may keep running once one direction has been half-closed, unless set
+// with WithHalfCloseTimeout
+const DefaultHalfCloseTimeout = 60 * time.Second
+
 type session struct {
 	upDelay      time.Duration
 	downDelay    time.Duration
 	clientConn   net.Conn
 	upstreamAddr string
+	pipeOpts     []PipeOption
+	// when the client connection was accepted, and its number as it appears in the logs
+	startTime time.Time
+	connNum   int64
+
+	// optional periodic re-randomization of the delays. redraw returns new up and down delays.
+	rerandomizeInterval time.Duration
+	redraw              func() (time.Duration, time.Duration)
+
+	// the current delays as read by delayed pipes. they start out as upDelay and downDelay.
+	upVar   *variableDelay
+	downVar *variableDelay
+
+	dial dialConfig
+
+	// optional TLS towards the upstream
+	upstreamTLS *tls.Config
+	// offer the upstream the protocol negotiated with the client via ALPN, if any
+	upstreamALPNCopy bool
+	// the state of the client's TLS connection when terminating TLS
+	clientTLS *tls.ConnectionState
+
+	// PROXY protocol version to send to the upstream, or 0 for none
+	sendProxy int
+	// addresses from a PROXY protocol header accepted from the client, if any
+	proxyAddrs *proxyProtoAddrs
+
+	// only delay the TLS handshake of passed through TLS traffic
+	delayTLSHandshakeOnly bool
+
+	// how often to log throughput, or 0 for never, and after how many bytes in a direction, or 0 for regardless
+	statsInterval time.Duration
+	statsBytes    int64
+	// counters maintained by the up and down pipes
+	upCounters   pipeCounters
+	downCounters pipeCounters
+	// optional measurement of the latency added, shared by the sessions of a server
+	latency *latencyMeter
+	// if set, the session is recorded in a directory below it
+	recordDir string
+	// optional tracing of the delay decisions. the session sets its connection number.
+	tracing *delayTracing
+	// extra delay for the first chunk from the upstream
+	ttfbDelay time.Duration
+	// the delay schedule's window the session started in, if any
+	scheduleWindow string
+	// bandwidth caps of the up and down pipes in bytes per second. 0 means no cap.
+	upBandwidth   int64
+	downBandwidth int64
+	// read rate caps of the up and down pipes in bytes per second. 0 means no cap.
+	upReadRate   int64
+	downReadRate int64
+
+	// optional callbacks for library users
+	hooks *Hooks
+
+	// how long the other direction may keep running once one has been half-closed. 0 means no limit. time spent paused
+	// doesn't count.
+	halfCloseTimeout time.Duration
+
+	// identifies the session in logs, hooks and the stats. unlike connNum, it is unique across servers and restarts.
+	id string
+	// holds back the writes of both pipes while the session is paused
+	pause pauseGate
+
+	// optional delay models replacing the delays of each direction
+	upDelayFunc   DelayFunc
+	downDelayFunc DelayFunc
+
+	// once closed, the pipes stop reading and finish after writing what they have read, right away if collapseDelays
+	// is set
+	flush          <-chan struct{}
+	collapseDelays bool
+
+	// for the summary: whether the upstream was reached and which side closed first
+	upstreamConnected bool
+	closeOnce         sync.Once
+	closedBy          string
+
+	// the most recent pipe error, for debugging
+	errMu     sync.Mutex
+	recentErr error
 }
 
-func NewDelayedSession(upDelay time.Duration, downDelay time.Duration, clientConn net.Conn, upStreamAddr string) Session {
+// pipeOpts are applied to both the up and down pipes. if a pipe seed is given, the down pipe uses a derived seed so
+// that the two directions don't see identical random sequences.
+func NewDelayedSession(upDelay time.Duration, downDelay time.Duration, clientConn net.Conn, upStreamAddr string, pipeOpts ...PipeOption) Session {
+	return newSession(upDelay, downDelay, clientConn, upStreamAddr, pipeOpts)
+}
+
+func newSession(upDelay time.Duration, downDelay time.Duration, clientConn net.Conn, upStreamAddr string, pipeOpts []PipeOption) *session {
 	return &session{
 		upDelay:      upDelay,
 		downDelay:    downDelay,
 		clientConn:   clientConn,
 		upstreamAddr: upStreamAddr,
+		pipeOpts:     pipeOpts,
+		startTime:    time.Now(),
+		id:           newSessionID(),
+		upVar:        newVariableDelay(upDelay),
+		downVar:      newVariableDelay(downDelay),
+
+		halfCloseTimeout: DefaultHalfCloseTimeout,
 	}
 }
 
-func (c *session) Run(ctx context.Context) error {
+func (c *session) Run(ctx context.Context) (err error) {
 	// use the log object from the context with additional fields
 	log := log.Ctx(ctx).With().Str("func", "session.Run").Logger()
 
 	// we own the client connection. make sure it's closed.
 	defer c.clientConn.Close()
 
+	// tell the whole story in one line once the session ends
+	defer func() {
+		c.logSummary(log, err)
+	}()
+
+	// make the session visible in the debug vars while it runs
+	id := registerSession(c)
+	defer unregisterSession(id)
+
 	log.Debug().Msg("initiating session")
 
 	// establish upstream session
-	log.Debug().Msg("establishing upstream connection")
-	upstreamConn, err := net.Dial("tcp", c.upstreamAddr)
+	log.Debug().Str("upstreamAddr", c.upstreamAddr).Msg("establishing upstream connection")
+	upstreamConn, err := c.dial.dial(ctx, log, c.upstreamAddr)
 	if err != nil {
 		log.Error().Err(err).Str("upstreamAddr", c.upstreamAddr).Msg("error establishing upstream connection")
-		return err
+		return wrapErr(ErrUpstreamDial, err)
+	}
+	c.upstreamConnected = true
+	if via := c.dial.via(); via != "" {
+		// the connection's remote address is the proxy's, so log the upstream as given
+		log = log.With().Str("upstreamAddr", c.upstreamAddr).Str("via", via).Logger()
+	} else if _, ok := SplitUnixAddr(c.upstreamAddr); ok {
+		log = log.With().Str("upstreamAddr", c.upstreamAddr).Logger()
+	} else {
+		// the address that won, which for a dual-stack upstream may be either family
+		log = log.With().Stringer("upstreamAddr", upstreamConn.RemoteAddr()).
+			Str("upstreamFamily", addrFamily("tcp", upstreamConn.RemoteAddr())).
+			Stringer("upstreamLocalAddr", upstreamConn.LocalAddr()).Logger()
+	}
+	e := log.Info()
+	if c.dial.multipathTCP {
+		e = e.Bool("multipathTCP", usesMultipathTCP(upstreamConn))
 	}
-	log = log.With().Stringer("upstreamAddr", upstreamConn.RemoteAddr()).Logger()
-	log.Info().Msg("upstream connection established")
+	e.Msg("upstream connection established")
 	defer upstreamConn.Close()
+	if c.hooks != nil && c.hooks.OnUpstreamConnected != nil {
+		c.hooks.OnUpstreamConnected(c.clientConn.RemoteAddr(), upstreamConn.RemoteAddr())
+	}
 
-	// set up pipes for handling traffic in both directions. if delay is zero, use a simple pipe.
-	var upPipe, downPipe Pipe
-	if c.upDelay.Nanoseconds() == 0 {
-		log.Debug().Msg("using simple up pipe")
-		upPipe = NewSimplePipe(c.clientConn, upstreamConn)
-	} else {
-		log.Debug().Dur("upDelay", c.upDelay).Msg("using delayed up pipe")
-		upPipe = NewDelayedPipe(c.clientConn, upstreamConn, c.upDelay)
+	// send the PROXY protocol header first. it is written directly rather than through the pipes so it isn't delayed.
+	if c.sendProxy != 0 {
+		src, dst := c.clientConn.RemoteAddr(), c.clientConn.LocalAddr()
+		if c.proxyAddrs != nil {
+			src, dst = c.proxyAddrs.src, c.proxyAddrs.dst
+		}
+		// a v2 header carries the client's TLS identity, if terminated here
+		var tlvs []proxyProtoTLV
+		if c.clientTLS != nil {
+			tlvs = append(tlvs, proxyProtoSSLTLV(*c.clientTLS))
+		}
+		header, err := proxyProtoHeader(c.sendProxy, src, dst, tlvs)
+		if err != nil {
+			log.Error().Err(err).Msg("error while building PROXY protocol header")
+			return wrapErr(ErrProxyHeader, err)
+		}
+		if _, err := upstreamConn.Write(header); err != nil {
+			log.Error().Err(err).Msg("error while sending PROXY protocol header to upstream")
+			return wrapErr(ErrUpstreamClosed, err)
+		}
+		log.Debug().Int("version", c.sendProxy).Int("numBytes", len(header)).Msg("sent PROXY protocol header to upstream")
 	}
-	if c.downDelay.Nanoseconds() == 0 {
-		log.Debug().Msg("using simple down pipe")
-		downPipe = NewSimplePipe(upstreamConn, c.clientConn)
-	} else {
-		log.Debug().Dur("downDelay", c.downDelay).Msg("using delayed down pipe")
-		downPipe = NewDelayedPipe(upstreamConn, c.clientConn, c.downDelay)
+
+	// originate TLS to the upstream if requested. the handshake completes before the pipes start so that failures
+	// are reported as such rather than as a pipe error.
+	if c.upstreamTLS != nil {
+		config := c.upstreamTLS
+		clientALPN := ""
+		if c.clientTLS != nil {
+			clientALPN = c.clientTLS.NegotiatedProtocol
+		}
+		copyALPN := c.upstreamALPNCopy && clientALPN != ""
+		if copyALPN {
+			config = config.Clone()
+			config.NextProtos = []string{clientALPN}
+		}
+		tlsConn := newUpstreamTLSConn(upstreamConn, config, c.upstreamAddr)
+		serverName := upstreamServerName(config, c.upstreamAddr)
+		if err := tlsHandshake(tlsConn); err != nil {
+			// name what was expected and what was presented, so that a wrong --upstream-servername is obvious
+			l := log.Error().Err(err).Str("serverName", serverName)
+			if subject := presentedSubject(err); subject != "" {
+				l = l.Str("upstreamSubject", subject)
+			}
+			if names := presentedNames(err); names != nil {
+				l = l.Strs("upstreamCertNames", names)
+			}
+			l.Msg("tls handshake with upstream failed")
+			return wrapErr(ErrUpstreamTLS, fmt.Errorf("tls handshake with upstream %s (server name %q) failed: %w", c.upstreamAddr, serverName, err))
+		}
+		state := tlsConn.ConnectionState()
+		log.Info().Str("serverName", serverName).Str("tlsVersion", tlsVersionName(state.Version)).Str("alpn", state.NegotiatedProtocol).
+			Msg("tls handshake with upstream complete")
+		if copyALPN && state.NegotiatedProtocol != clientALPN {
+			// the client will speak its protocol regardless, so this is likely to fail further on
+			log.Warn().Str("clientAlpn", clientALPN).Msg("upstream didn't agree to the protocol negotiated with the client")
+		}
+		upstreamConn = tlsConn
+	}
+
+	// resolve the pipe options so we can tell whether a delayed pipe is needed even without a static delay
+	pipeOpts := newPipeOptions(c.pipeOpts)
+	upPipeOpts := c.pipeOpts[:len(c.pipeOpts):len(c.pipeOpts)]
+	downPipeOpts := c.pipeOpts[:len(c.pipeOpts):len(c.pipeOpts)]
+	if pipeOpts.seed != 0 {
+		downPipeOpts = append(downPipeOpts, WithPipeSeed(pipeOpts.seed+1))
+	}
+
+	// the pipes count the bytes they write and tell a transformer their direction
+	upPipeOpts = append(upPipeOpts, withCounters(&c.upCounters), withDirection("up"), withPause(&c.pause))
+	downPipeOpts = append(downPipeOpts, withCounters(&c.downCounters), withDirection("down"), withPause(&c.pause))
+	if c.latency != nil {
+		upPipeOpts = append(upPipeOpts, withLatency(&c.latency.up))
+		downPipeOpts = append(downPipeOpts, withLatency(&c.latency.down))
+	}
+
+	if c.ttfbDelay > 0 {
+		downPipeOpts = append(downPipeOpts, WithFirstChunkDelay(c.ttfbDelay))
+	}
+	if c.upBandwidth > 0 {
+		upPipeOpts = append(upPipeOpts, WithRateLimit(c.upBandwidth))
+	}
+	if c.downBandwidth > 0 {
+		downPipeOpts = append(downPipeOpts, WithRateLimit(c.downBandwidth))
+	}
+	if c.upReadRate > 0 {
+		upPipeOpts = append(upPipeOpts, WithReadRateLimit(c.upReadRate))
+	}
+	if c.downReadRate > 0 {
+		downPipeOpts = append(downPipeOpts, WithReadRateLimit(c.downReadRate))
+	}
+
+	if c.tracing != nil {
+		c.tracing.session = c.connNum
+		upPipeOpts = append(upPipeOpts, withDelayTracing(c.tracing))
+		downPipeOpts = append(downPipeOpts, withDelayTracing(c.tracing))
+	}
+
+	// a session that can't be recorded still runs
+	if c.recordDir != "" {
+		rec, err := newRecorder(c.recordDir, c.connNum, canonicalAddr(c.clientConn.RemoteAddr()), c.upstreamAddr)
+		if err != nil {
+			log.Error().Err(err).Str("recordDir", c.recordDir).Msg("error while starting recording. continuing without.")
+		} else {
+			log.Debug().Str("recording", rec.dir).Msg("recording session")
+			defer func() {
+				if err := rec.close(); err != nil {
+					log.Error().Err(err).Str("recording", rec.dir).Msg("error while writing recording")
+				} else if rec.meta.Truncated {
+					log.Warn().Str("recording", rec.dir).Msg("recording truncated. writing it couldn't keep up.")
+				}
+			}()
+			upPipeOpts = append(upPipeOpts, withRecorder(rec))
+			downPipeOpts = append(downPipeOpts, withRecorder(rec))
+		}
+	}
+
+	// the pipes read their delays from shared variables so that they can be changed while running, e.g. when they
+	// are re-randomized. target rtt brings its own provider.
+	if pipeOpts.targetRTT == 0 {
+		upPipeOpts = append(upPipeOpts, withDelayProvider(c.upVar))
+		downPipeOpts = append(downPipeOpts, withDelayProvider(c.downVar))
+	}
+
+	if c.flush != nil {
+		upPipeOpts = append(upPipeOpts, withFlush(c.flush, c.collapseDelays))
+		downPipeOpts = append(downPipeOpts, withFlush(c.flush, c.collapseDelays))
+	}
+
+	if c.upDelayFunc != nil {
+		upPipeOpts = append(upPipeOpts, WithDelayFunc(c.upDelayFunc))
+	}
+	if c.downDelayFunc != nil {
+		downPipeOpts = append(downPipeOpts, WithDelayFunc(c.downDelayFunc))
+	}
+
+	// set up pipes for handling traffic in both directions. if delay is zero and no impairment or tracing is configured,
+	// use a simple pipe. when only delaying the TLS handshake, both directions need to be inspected regardless.
+	var upPipe, downPipe Pipe
+	switch {
+	case c.delayTLSHandshakeOnly:
+		log.Debug().Dur("upDelay", c.upDelay).Dur("downDelay", c.downDelay).Msg("using tls handshake pipes")
+		state := newTLSHandshakeState()
+		upPipe = newTLSHandshakePipe(c.clientConn, upstreamConn, c.upDelay, state, true, upPipeOpts...)
+		downPipe = newTLSHandshakePipe(upstreamConn, c.clientConn, c.downDelay, state, false, downPipeOpts...)
+	default:
+		if c.upDelay.Nanoseconds() == 0 && !pipeOpts.impaired() && c.upDelayFunc == nil && c.tracing == nil {
+			log.Debug().Msg("using simple up pipe")
+			upPipe = NewSimplePipe(c.clientConn, upstreamConn, upPipeOpts...)
+		} else {
+			log.Debug().Dur("upDelay", c.upDelay).Msg("using delayed up pipe")
+			upPipe = NewDelayedPipe(c.clientConn, upstreamConn, c.upDelay, upPipeOpts...)
+		}
+		if c.downDelay.Nanoseconds() == 0 && !pipeOpts.impaired() && c.downDelayFunc == nil && c.tracing == nil && c.ttfbDelay == 0 {
+			log.Debug().Msg("using simple down pipe")
+			downPipe = NewSimplePipe(upstreamConn, c.clientConn, downPipeOpts...)
+		} else {
+			log.Debug().Dur("downDelay", c.downDelay).Msg("using delayed down pipe")
+			downPipe = NewDelayedPipe(upstreamConn, c.clientConn, c.downDelay, downPipeOpts...)
+		}
 	}
 	log.Info().Msg("pipes established")
 
 	// run the up and down pipes separately
 	// use a context both to tear down the children as well as to encapsulate the logger
+	parentCtx := ctx
 	ctx, cancel := context.WithCancel(ctx)
 	ctx = log.WithContext(ctx)
 
-	// remember the last error
-	var lastErr error
+	// remember the first error. the other pipe usually fails as a consequence of the teardown it causes.
+	var firstErr firstError
+
+	// a pipe whose source closed cleanly has half-closed its destination, so the other direction keeps running until
+	// its own source closes, e.g. while the upstream sends its response to a finished request. a pipe that stopped to
+	// flush leaves the other one to finish flushing as well. anything else tears down the session.
+	var halfCloseOnce sync.Once
+	var halfCloseTimer *time.Timer
+	finish := func(log zerolog.Logger, err error, dst net.Conn) {
+		if err != nil || ctx.Err() != nil {
+			cancel()
+			return
+		}
+		if isClosed(c.flush) {
+			log.Debug().Msg("flushed. waiting for the other direction.")
+			return
+		}
+		if !canCloseWrite(dst) {
+			cancel()
+			return
+		}
+		halfCloseOnce.Do(func() {
+			log.Debug().Dur("halfCloseTimeout", c.halfCloseTimeout).Msg("half-closed. waiting for the other direction.")
+			if c.halfCloseTimeout > 0 {
+				// the timeout is extended by the time spent paused since the half-close
+				halfClosedAt, pausedBefore := time.Now(), c.pause.pausedFor()
+				var expire func()
+				expire = func() {
+					if ctx.Err() != nil {
+						return
+					}
+					if rest := c.halfCloseTimeout + c.pause.pausedFor() - pausedBefore - time.Since(halfClosedAt); rest > 0 {
+						time.AfterFunc(rest, expire)
+						return
+					}
+					log.Info().Dur("halfCloseTimeout", c.halfCloseTimeout).Msg("other direction still open after half-close timeout. closing session.")
+					cancel()
+				}
+				halfCloseTimer = time.AfterFunc(c.halfCloseTimeout, expire)
+			}
+		})
+	}
 
 	// run pipes in separate go routines
 	// note that we don't have to explicitly handle context cancellation here as it's handled by the children
@@ -87,13 +406,21 @@ func (c *session) Run(ctx context.Context) error {
 		log := log.With().Str("direction", "up").Logger()
 		ctx := log.WithContext(ctx)
 		log.Debug().Msg("running up pipe")
-		err := upPipe.Run(ctx)
+		err := runPipe(ctx, log, upPipe)
+		if err != nil {
+			err = classifyPipeErr(err, true)
+		}
+		c.pipeFinished(parentCtx, "client")
 		if err != nil {
 			log.Error().Err(err).Msg("up pipe exited with error")
-			lastErr = err
+			firstErr.set(err)
+			c.recordErr(err)
+			if c.hooks != nil && c.hooks.OnPipeError != nil {
+				c.hooks.OnPipeError(c.clientConn.RemoteAddr(), "up", err)
+			}
 		}
 		log.Debug().Msg("up pipe finished")
-		cancel()
+		finish(log, err, upstreamConn)
 		wg.Done()
 	}()
 	wg.Add(1)
@@ -102,21 +429,217 @@ func (c *session) Run(ctx context.Context) error {
 		log := log.With().Str("direction", "down").Logger()
 		ctx := log.WithContext(ctx)
 		log.Debug().Msg("running down pipe")
-		err := downPipe.Run(ctx)
+		err := runPipe(ctx, log, downPipe)
+		if err != nil {
+			err = classifyPipeErr(err, false)
+		}
+		c.pipeFinished(parentCtx, "upstream")
 		if err != nil {
 			log.Error().Err(err).Msg("down pipe exited with error")
-			lastErr = err
+			firstErr.set(err)
+			c.recordErr(err)
+			if c.hooks != nil && c.hooks.OnPipeError != nil {
+				c.hooks.OnPipeError(c.clientConn.RemoteAddr(), "down", err)
+			}
 		}
 		log.Debug().Msg("down pipe finished")
-		cancel()
+		finish(log, err, c.clientConn)
 		wg.Done()
 	}()
 	log.Info().Msg("all pipes running")
 
+	// periodically draw new delays if requested. this affects chunks read after the change only.
+	if c.rerandomizeInterval > 0 && c.redraw != nil {
+		go func() {
+			t := time.NewTicker(c.rerandomizeInterval)
+			defer t.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+
+				case <-t.C:
+					upDelay, downDelay := c.redraw()
+					log.Info().Dur("oldUpDelay", c.upVar.delay()).Dur("newUpDelay", upDelay).
+						Dur("oldDownDelay", c.downVar.delay()).Dur("newDownDelay", downDelay).Msg("re-randomized delays")
+					c.setDelays(upDelay, downDelay)
+				}
+			}
+		}()
+	}
+
+	// periodically log throughput
+	if c.statsInterval > 0 || c.statsBytes > 0 {
+		go c.logStats(ctx, log)
+	}
+
 	// wait for all pipes to complete
 	log.Debug().Msg("waiting for pipes to finish")
 	wg.Wait()
+	if halfCloseTimer != nil {
+		halfCloseTimer.Stop()
+	}
+	cancel()
 	log.Info().Msg("all pipes finished. closing session.")
 
-	return lastErr
-}
\ No newline at end of file
+	// summarize how late the delayed pipes wrote compared to the configured delays
+	if up, down := c.upCounters.skew.summary(), c.downCounters.skew.summary(); up.Count > 0 || down.Count > 0 {
+		log.Info().Int64("upChunks", up.Count).Dur("upSkewP50", up.P50).Dur("upSkewP95", up.P95).Dur("upSkewP99", up.P99).Dur("upSkewMax", up.Max).
+			Int64("downChunks", down.Count).Dur("downSkewP50", down.P50).Dur("downSkewP95", down.P95).Dur("downSkewP99", down.P99).Dur("downSkewMax", down.Max).
+			Msg("delay skew")
+	}
+
+	return firstErr.get()
+}
+
+// how often the stats are checked against the byte threshold
+const statsPollInterval = 100 * time.Millisecond
+
+// what a direction had transferred at its last stats report
+type statsMark struct {
+	direction string
+	counters  *pipeCounters
+	readRate  int64
+	time      time.Time
+	written   int64
+	chunks    int64
+	read      int64
+}
+
+// logs one line per direction with the bytes and chunks transferred and the throughput since its previous line, every
+// statsInterval and whenever it has transferred statsBytes since
+func (c *session) logStats(ctx context.Context, log zerolog.Logger) {
+	tick := c.statsInterval
+	if c.statsBytes > 0 && (tick == 0 || tick > statsPollInterval) {
+		tick = statsPollInterval
+	}
+	t := time.NewTicker(tick)
+	defer t.Stop()
+	start := time.Now()
+	marks := []*statsMark{
+		{direction: "up", counters: &c.upCounters, readRate: c.upReadRate, time: start},
+		{direction: "down", counters: &c.downCounters, readRate: c.downReadRate, time: start},
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case now := <-t.C:
+			for _, m := range marks {
+				written := atomic.LoadInt64(&m.counters.written)
+				// ticks may come slightly early, so an interval is up within half a tick of it
+				due := c.statsInterval > 0 && now.Sub(m.time) >= c.statsInterval-tick/2
+				if !due && (c.statsBytes == 0 || written-m.written < c.statsBytes) {
+					continue
+				}
+				chunks, read := atomic.LoadInt64(&m.counters.chunks), atomic.LoadInt64(&m.counters.read)
+				secs := now.Sub(m.time).Seconds()
+				e := log.Info().Str("direction", m.direction)
+				if c.scheduleWindow != "" {
+					e = e.Str("scheduleWindow", c.scheduleWindow)
+				}
+				// with a read rate limit, the rate at which the proxy actually takes data from the source
+				if m.readRate > 0 {
+					e = e.Float64("readBytesPerSec", float64(read-m.read)/secs)
+				}
+				e.Int64("bytes", written-m.written).Int64("chunks", chunks-m.chunks).Float64("bytesPerSec", float64(written-m.written)/secs).
+					Msg("session throughput")
+				m.time, m.written, m.chunks, m.read = now, written, chunks, read
+			}
+		}
+	}
+}
+
+// records which side closed first when a pipe finishes. the up pipe reads from the client and the down pipe from the
+// upstream. pipes torn down by the server itself, e.g. on shutdown, are attributed to the proxy.
+func (c *session) pipeFinished(parentCtx context.Context, source string) {
+	c.closeOnce.Do(func() {
+		if parentCtx.Err() != nil {
+			source = "proxy"
+		}
+		c.closedBy = source
+	})
+}
+
+// logs a single line summarizing the session once it has ended
+func (c *session) logSummary(log zerolog.Logger, err error) {
+	upAvg, upMax := c.upCounters.delays()
+	downAvg, downMax := c.downCounters.delays()
+	closedBy := c.closedBy
+	if closedBy == "" {
+		closedBy = "proxy"
+	}
+	e := log.Info()
+	if err != nil {
+		e = e.Err(err)
+	}
+	// data read but not yet written when the session was closed, delivered when flushing and lost otherwise
+	upFlushed, downFlushed := atomic.LoadInt64(&c.upCounters.flushed), atomic.LoadInt64(&c.downCounters.flushed)
+	upDiscarded, downDiscarded := atomic.LoadInt64(&c.upCounters.discarded), atomic.LoadInt64(&c.downCounters.discarded)
+	if upFlushed > 0 || downFlushed > 0 || upDiscarded > 0 || downDiscarded > 0 {
+		e = e.Int64("upFlushedBytes", upFlushed).Int64("downFlushedBytes", downFlushed).
+			Int64("upDiscardedBytes", upDiscarded).Int64("downDiscardedBytes", downDiscarded)
+	}
+	// chunks dropped because a queue limit was reached
+	upTailDrops, downTailDrops := atomic.LoadInt64(&c.upCounters.tailDrops), atomic.LoadInt64(&c.downCounters.tailDrops)
+	if upTailDrops > 0 || downTailDrops > 0 {
+		e = e.Int64("upTailDrops", upTailDrops).Int64("upTailDroppedBytes", atomic.LoadInt64(&c.upCounters.tailDroppedBytes)).
+			Int64("downTailDrops", downTailDrops).Int64("downTailDroppedBytes", atomic.LoadInt64(&c.downCounters.tailDroppedBytes))
+	}
+	// whether the first response chunk got the extra ttfb delay, so tests can check that it was applied exactly once
+	if c.ttfbDelay > 0 {
+		e = e.Dur("ttfbDelay", c.ttfbDelay).Int64("ttfbDelayed", atomic.LoadInt64(&c.downCounters.firstChunkDelayed))
+	}
+	if c.scheduleWindow != "" {
+		e = e.Str("scheduleWindow", c.scheduleWindow)
+	}
+	if paused := c.pause.pausedFor(); paused > 0 {
+		e = e.Dur("pausedDuration", paused)
+	}
+	e.Dur("duration", time.Since(c.startTime)).Bool("upstreamConnected", c.upstreamConnected).
+		Int64("upBytes", atomic.LoadInt64(&c.upCounters.written)).Int64("downBytes", atomic.LoadInt64(&c.downCounters.written)).
+		Int64("upChunks", atomic.LoadInt64(&c.upCounters.chunks)).Int64("downChunks", atomic.LoadInt64(&c.downCounters.chunks)).
+		Dur("upAvgDelay", upAvg).Dur("upMaxDelay", upMax).Dur("downAvgDelay", downAvg).Dur("downMaxDelay", downMax).
+		Str("closedBy", closedBy).Msg("session summary")
+}
+
+// changes the delays of the session's delayed pipes. chunks already queued keep their delay.
+func (c *session) setDelays(upDelay time.Duration, downDelay time.Duration) {
+	c.upVar.set(upDelay)
+	c.downVar.set(downDelay)
+}
+
+// remembers the most recent pipe error
+func (c *session) recordErr(err error) {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	c.recentErr = err
+}
+
+// returns a snapshot of the session's state for the debug vars
+func (c *session) debugInfo() map[string]interface{} {
+	c.errMu.Lock()
+	recentErr := ""
+	if c.recentErr != nil {
+		recentErr = c.recentErr.Error()
+	}
+	c.errMu.Unlock()
+	return map[string]interface{}{
+		"clientAddr":        c.clientConn.RemoteAddr().String(),
+		"upstreamAddr":      c.upstreamAddr,
+		"upBytes":           atomic.LoadInt64(&c.upCounters.written),
+		"downBytes":         atomic.LoadInt64(&c.downCounters.written),
+		"upQueueDepth":      atomic.LoadInt64(&c.upCounters.queued),
+		"downQueueDepth":    atomic.LoadInt64(&c.downCounters.queued),
+		"upBytesInFlight":   atomic.LoadInt64(&c.upCounters.queuedBytes),
+		"downBytesInFlight": atomic.LoadInt64(&c.downCounters.queuedBytes),
+		"upTailDrops":       atomic.LoadInt64(&c.upCounters.tailDrops),
+		"downTailDrops":     atomic.LoadInt64(&c.downCounters.tailDrops),
+		"upDelaySkew":       c.upCounters.skew.summary(),
+		"downDelaySkew":     c.downCounters.skew.summary(),
+		"sessionId":         c.id,
+		"paused":            c.pause.paused(),
+		"lastError":         recentErr,
+	}
+}
@@ -0,0 +1,24 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// the length of a session id in bytes before hex encoding
+const sessionIDBytes = 6
+
+// the fallback in case the system's random source fails
+var sessionIDCounter int64
+
+// returns a short random id for a new session, e.g. "3f9a0c1b7e24"
+func newSessionID() string {
+	b := make([]byte, sessionIDBytes)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + strconv.FormatInt(atomic.AddInt64(&sessionIDCounter, 1), 36)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// a point in time view of a running session, e.g. for finding out where a hanging test is stuck
+type SessionSnapshot struct {
+	// a short random id, e.g. for correlating log lines and pausing the session. unlike ConnNum, it is unique across
+	// servers and restarts.
+	ID string
+	// the connection number as it appears in the logs. it is unique per server.
+	ConnNum      int64
+	ClientAddr   string
+	UpstreamAddr string
+	StartTime    time.Time
+
+	// the delays currently applied to new chunks
+	UpDelay   time.Duration
+	DownDelay time.Duration
+
+	// bytes written to the other side so far and bytes still waiting in the delay buffer
+	UpBytes         int64
+	DownBytes       int64
+	UpChunks        int64
+	DownChunks      int64
+	UpQueuedBytes   int64
+	DownQueuedBytes int64
+
+	// how late delayed chunks were written compared to when they were due
+	UpDelaySkew   DelaySkew
+	DownDelaySkew DelaySkew
+
+	// when each direction last read from its source and wrote to its destination. zero means never.
+	UpLastRead      time.Time
+	UpLastWritten   time.Time
+	DownLastRead    time.Time
+	DownLastWritten time.Time
+
+	// whether the session is paused and the total time it has spent paused
+	Paused         bool
+	PausedDuration time.Duration
+}
+
+// implemented by servers that can list their running sessions
+type SessionLister interface {
+	Sessions() []SessionSnapshot
+}
+
+func (c *session) snapshot() SessionSnapshot {
+	return SessionSnapshot{
+		ID:              c.id,
+		ConnNum:         c.connNum,
+		ClientAddr:      canonicalAddr(c.clientConn.RemoteAddr()),
+		UpstreamAddr:    c.upstreamAddr,
+		StartTime:       c.startTime,
+		UpDelay:         c.upVar.delay(),
+		DownDelay:       c.downVar.delay(),
+		UpBytes:         atomic.LoadInt64(&c.upCounters.written),
+		DownBytes:       atomic.LoadInt64(&c.downCounters.written),
+		UpChunks:        atomic.LoadInt64(&c.upCounters.chunks),
+		DownChunks:      atomic.LoadInt64(&c.downCounters.chunks),
+		UpQueuedBytes:   atomic.LoadInt64(&c.upCounters.queuedBytes),
+		DownQueuedBytes: atomic.LoadInt64(&c.downCounters.queuedBytes),
+		UpDelaySkew:     c.upCounters.skew.summary(),
+		DownDelaySkew:   c.downCounters.skew.summary(),
+		UpLastRead:      unixNanoTime(atomic.LoadInt64(&c.upCounters.lastRead)),
+		UpLastWritten:   unixNanoTime(atomic.LoadInt64(&c.upCounters.lastWritten)),
+		DownLastRead:    unixNanoTime(atomic.LoadInt64(&c.downCounters.lastRead)),
+		DownLastWritten: unixNanoTime(atomic.LoadInt64(&c.downCounters.lastWritten)),
+		Paused:          c.pause.paused(),
+		PausedDuration:  c.pause.pausedFor(),
+	}
+}
+
+// converts unix nanoseconds to a time, with 0 meaning the zero time
+func unixNanoTime(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
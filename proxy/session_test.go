@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// the client half-closes after its request, and the upstream only replies once it has read the whole request, like
+// nc -N or an HTTP/1.0 exchange. the reply must still make it back to the client.
+func TestSessionHalfCloseReplyAfterEOF(t *testing.T) {
+	upstreamAddr := startUpstream(t, func(conn net.Conn) {
+		request, err := ioutil.ReadAll(conn)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(conn, "read %d bytes", len(request))
+	})
+
+	for _, delay := range []time.Duration{0, 20 * time.Millisecond} {
+		t.Run(fmt.Sprintf("delay %s", delay), func(t *testing.T) {
+			addr := serveOn(t, NewTcpDelayServer("", delay, delay, false, upstreamAddr))
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(testTimeout))
+
+			request := testData(100 * 1024)
+			if _, err := conn.Write(request); err != nil {
+				t.Fatal(err)
+			}
+			if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+				t.Fatal(err)
+			}
+			reply, err := ioutil.ReadAll(conn)
+			if err != nil {
+				t.Fatalf("error while reading the reply: %s", err)
+			}
+			if want := fmt.Sprintf("read %d bytes", len(request)); string(reply) != want {
+				t.Fatalf("got reply %q, want %q", reply, want)
+			}
+		})
+	}
+}
+
+// resets the connection instead of closing it cleanly
+func reset(conn net.Conn) {
+	conn.(*net.TCPConn).SetLinger(0)
+	conn.Close()
+}
+
+// the client and the upstream reset their connections at the same time, so both pipes fail. the session still reports
+// a single error. run with -race.
+func TestSessionBothPipesFail(t *testing.T) {
+	for _, delay := range []time.Duration{0, time.Millisecond} {
+		gate := make(chan struct{})
+		upstreamAddr := startUpstream(t, func(conn net.Conn) {
+			io.CopyN(conn, conn, 1)
+			<-gate
+			reset(conn)
+		})
+
+		var mu sync.Mutex
+		var ends []error
+		srv := NewTcpDelayServer("", delay, delay, false, upstreamAddr, WithHooks(Hooks{
+			OnSessionEnd: func(stats SessionStats) {
+				mu.Lock()
+				defer mu.Unlock()
+				ends = append(ends, stats.Err)
+			},
+		}))
+		addr := serveOn(t, srv)
+
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := roundTripConn(t, conn, []byte("x")); string(got) != "x" {
+			t.Fatalf("got %q, want %q", got, "x")
+		}
+		close(gate)
+		reset(conn)
+
+		waitFor(t, "the session to end", func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(ends) > 0
+		})
+		srv.Shutdown(context.Background())
+		mu.Lock()
+		if len(ends) != 1 {
+			t.Fatalf("delay %s: session ended %d times", delay, len(ends))
+		}
+		err = ends[0]
+		mu.Unlock()
+		if !errors.Is(err, ErrClientClosed) && !errors.Is(err, ErrUpstreamClosed) {
+			t.Fatalf("delay %s: session ended with %v, want a client or upstream error", delay, err)
+		}
+	}
+}
+
+// the upstream accepts but never reads, so once the socket buffers fill up every write to it blocks. the write timeout
+// ends the session rather than leaving it stuck.
+func TestSessionNonReadingUpstream(t *testing.T) {
+	const writeTimeout = 200 * time.Millisecond
+	for _, delay := range []time.Duration{0, time.Millisecond} {
+		t.Run(fmt.Sprintf("delay %s", delay), func(t *testing.T) {
+			gate := make(chan struct{})
+			defer close(gate)
+			upstreamAddr := startUpstream(t, func(conn net.Conn) {
+				<-gate
+			})
+
+			ended := make(chan SessionStats, 1)
+			srv := NewTcpDelayServer("", delay, delay, false, upstreamAddr,
+				WithPipeOptions(WithWriteTimeout(writeTimeout)),
+				WithHooks(Hooks{
+					OnSessionEnd: func(stats SessionStats) {
+						ended <- stats
+					},
+				}))
+			addr := serveOn(t, srv)
+
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			start := time.Now()
+			go func() {
+				chunk := testData(64 * 1024)
+				for {
+					if _, err := conn.Write(chunk); err != nil {
+						return
+					}
+				}
+			}()
+
+			select {
+			case stats := <-ended:
+				took := time.Since(start)
+				if !errors.Is(stats.Err, ErrPipeAborted) {
+					t.Fatalf("session ended with %v, want %v", stats.Err, ErrPipeAborted)
+				}
+				// filling the loopback buffers takes next to no time, so the session ends soon after the timeout
+				if took < writeTimeout || took > writeTimeout+2*time.Second {
+					t.Fatalf("session ended after %s with a %s write timeout", took, writeTimeout)
+				}
+			case <-time.After(testTimeout):
+				t.Fatalf("session with a non-reading upstream didn't end")
+			}
+		})
+	}
+}
+
+// collects the lines logged by a session, which may log from several goroutines
+type logLines struct {
+	mu    sync.Mutex
+	lines [][]byte
+}
+
+func (l *logLines) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+// returns the fields of the first line logged with the given message, or nil if there is none yet
+func (l *logLines) find(msg string) map[string]interface{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, line := range l.lines {
+		var fields map[string]interface{}
+		if json.Unmarshal(line, &fields) == nil && fields["message"] == msg {
+			return fields
+		}
+	}
+	return nil
+}
+
+// only the first response of a session gets the extra ttfb delay
+func TestSessionTTFBDelayOnce(t *testing.T) {
+	const delay, ttfbDelay = 5 * time.Millisecond, 200 * time.Millisecond
+	logs := &logLines{}
+	srv := NewTcpDelayServer("", delay, delay, false, startTCPEcho(t),
+		WithTTFBDelay(ttfbDelay), WithLogger(zerolog.New(logs)))
+	addr := serveOn(t, srv)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		_, took := roundTripConn(t, conn, []byte("ping"))
+		if i == 0 && took < ttfbDelay {
+			t.Fatalf("first round trip took %s with a %s ttfb delay", took, ttfbDelay)
+		}
+		if i > 0 && took >= ttfbDelay {
+			t.Fatalf("round trip %d took %s, as if it got the %s ttfb delay as well", i+1, took, ttfbDelay)
+		}
+	}
+	conn.Close()
+
+	var summary map[string]interface{}
+	waitFor(t, "the session summary", func() bool {
+		summary = logs.find("session summary")
+		return summary != nil
+	})
+	if got := summary["ttfbDelayed"]; got != 1.0 {
+		t.Fatalf("session summary has ttfbDelayed %v, want 1", got)
+	}
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// a histogram of how late delayed chunks were written compared to when they were due, i.e. read time plus delay. the
+// difference comes from timer granularity, queueing and the polling of the read loop. buckets are logarithmic with
+// four sub-buckets per power of two, so percentiles are accurate to within about 25%. the maximum is exact.
+// WithLatencyMeasurement uses it for the overhead on top of the delay as well.
+type skewHistogram struct {
+	mu     sync.Mutex
+	counts [256]int64
+	count  int64
+	max    time.Duration
+}
+
+// summarizes the skew of a pipe's delayed chunks
+type DelaySkew struct {
+	Count int64
+	P50   time.Duration
+	P95   time.Duration
+	P99   time.Duration
+	Max   time.Duration
+}
+
+func skewBucket(d time.Duration) int {
+	v := uint64(d)
+	if v < 4 {
+		return int(v)
+	}
+	l := bits.Len64(v)
+	sub := (v >> uint(l-3)) & 3
+	return (l-2)*4 + int(sub)
+}
+
+// the largest duration falling into bucket i
+func skewBucketMax(i int) time.Duration {
+	if i < 4 {
+		return time.Duration(i)
+	}
+	l := i/4 + 2
+	sub := uint64(i % 4)
+	return time.Duration(((4|sub)+1)<<uint(l-3) - 1)
+}
+
+func (h *skewHistogram) record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[skewBucket(d)]++
+	h.count++
+	if d > h.max {
+		h.max = d
+	}
+}
+
+func (h *skewHistogram) summary() DelaySkew {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.summarize()
+}
+
+// summarizes the durations recorded so far and starts over
+func (h *skewHistogram) take() DelaySkew {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sum := h.summarize()
+	h.counts = [len(h.counts)]int64{}
+	h.count = 0
+	h.max = 0
+	return sum
+}
+
+// h.mu must be held
+func (h *skewHistogram) summarize() DelaySkew {
+	return DelaySkew{
+		Count: h.count,
+		P50:   h.percentile(0.50),
+		P95:   h.percentile(0.95),
+		P99:   h.percentile(0.99),
+		Max:   h.max,
+	}
+}
+
+// returns the upper bound of the bucket holding the given percentile, capped at the maximum. h.mu must be held.
+func (h *skewHistogram) percentile(p float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	rank := int64(p*float64(h.count-1)) + 1
+	var seen int64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= rank {
+			if d := skewBucketMax(i); d < h.max {
+				return d
+			}
+			return h.max
+		}
+	}
+	return h.max
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// routes sessions to different upstreams based on the server name (SNI) the client asks for in its TLS ClientHello.
+// when passing TLS through, the ClientHello is peeked from the client connection and then replayed to the chosen
+// upstream, so the proxy never needs a certificate.
+
+// used to abort the peeking handshake once the ClientHello has been seen
+var errClientHelloSeen = errors.New("client hello seen")
+
+// a connection that can only be read from. the bytes read are recorded so that they can be replayed.
+type recordingConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// reads the TLS ClientHello from the connection and returns the requested server name, which is empty if the client
+// didn't send one, along with a connection that replays the ClientHello before continuing with the original stream.
+// the ClientHello is parsed by crypto/tls itself by starting a server handshake that is aborted as soon as the hello
+// has been seen.
+func peekClientHello(conn net.Conn) (string, net.Conn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(tlsHandshakeTimeout)); err != nil {
+		return "", nil, err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	buf := &bytes.Buffer{}
+	var serverName string
+	seen := false
+	peek := tls.Server(&recordingConn{Conn: conn, r: io.TeeReader(conn, buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			seen = true
+			return nil, errClientHelloSeen
+		},
+	})
+	err := peek.Handshake()
+	if !seen {
+		return "", nil, err
+	}
+
+	replay := &bufferedConn{Conn: conn, r: bufio.NewReader(io.MultiReader(buf, conn))}
+	return serverName, replay, nil
+}
+
+// looks up the upstream for a server name. names are matched case insensitively.
+func routeSNI(routes map[string]string, serverName string) (string, bool) {
+	upstream, ok := routes[strings.ToLower(serverName)]
+	return upstream, ok
+}
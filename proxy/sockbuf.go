@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"github.com/rs/zerolog"
+	"net"
+	"syscall"
+)
+
+// defines socket buffer sizes, e.g. to emulate small TCP windows or to bound kernel memory with thousands of
+// connections. the kernel may clamp the requested size or, like linux, double it for bookkeeping overhead, so the
+// effective sizes are read back and logged.
+
+// sets SO_RCVBUF and SO_SNDBUF of the client and upstream connections to the given sizes in bytes. 0 leaves the
+// kernel's default in that direction. upstream connections get them before connecting, so that the window scale
+// negotiated in the handshake matches, unless a dialer is set with WithDialer.
+func WithSocketBuffers(recv int, send int) ServerOption {
+	return func(s *tcpDelayServer) {
+		s.dial.recvBuf = recv
+		s.dial.sendBuf = send
+	}
+}
+
+// returns a dialer control func setting the socket buffers before connecting
+func socketBuffersControl(recv int, send int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return setSocketBuffers(c, recv, send)
+	}
+}
+
+// sets the socket buffers of an accepted connection
+func setConnSocketBuffers(conn net.Conn, recv int, send int) error {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if recv > 0 {
+		if err := tc.SetReadBuffer(recv); err != nil {
+			return err
+		}
+	}
+	if send > 0 {
+		return tc.SetWriteBuffer(send)
+	}
+	return nil
+}
+
+// logs the requested and effective socket buffer sizes of a connection at debug level
+func logSocketBuffers(log zerolog.Logger, conn net.Conn, side string, recv int, send int) {
+	if recv <= 0 && send <= 0 {
+		return
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return
+	}
+	effRecv, effSend, err := socketBuffers(raw)
+	if err != nil {
+		log.Debug().Err(err).Str("side", side).Msg("error while reading socket buffer sizes")
+		return
+	}
+	log.Debug().Str("side", side).Int("recvBuf", recv).Int("sendBuf", send).Int("effectiveRecvBuf", effRecv).
+		Int("effectiveSendBuf", effSend).Msg("set socket buffers")
+}
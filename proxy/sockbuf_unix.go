@@ -0,0 +1,44 @@
+//go:build !windows
+// +build !windows
+
+package proxy
+
+import (
+	"golang.org/x/sys/unix"
+	"syscall"
+)
+
+// sets SO_RCVBUF and SO_SNDBUF on a socket. sizes of 0 are left alone.
+func setSocketBuffers(c syscall.RawConn, recv int, send int) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		if recv > 0 {
+			if sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF, recv); sockErr != nil {
+				return
+			}
+		}
+		if send > 0 {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF, send)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// reads SO_RCVBUF and SO_SNDBUF of a socket
+func socketBuffers(c syscall.RawConn) (int, int, error) {
+	var recv, send int
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		if recv, sockErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF); sockErr != nil {
+			return
+		}
+		send, sockErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return recv, send, sockErr
+}
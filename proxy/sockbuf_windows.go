@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"syscall"
+)
+
+// sets SO_RCVBUF and SO_SNDBUF on a socket. sizes of 0 are left alone.
+func setSocketBuffers(c syscall.RawConn, recv int, send int) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		if recv > 0 {
+			if sockErr = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, recv); sockErr != nil {
+				return
+			}
+		}
+		if send > 0 {
+			sockErr = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, send)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// reads SO_RCVBUF and SO_SNDBUF of a socket
+func socketBuffers(c syscall.RawConn) (int, int, error) {
+	var recv, send int
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		if recv, sockErr = syscall.GetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF); sockErr != nil {
+			return
+		}
+		send, sockErr = syscall.GetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return recv, send, sockErr
+}
@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// a minimal SOCKS5 client (RFC 1928) for reaching the upstream through a bastion. supports no authentication and
+// username/password authentication (RFC 1929) and the CONNECT command only.
+
+type socks5Config struct {
+	addr     string
+	user     string
+	password string
+}
+
+// returned when the SOCKS5 proxy reports a failure to connect to the upstream, as opposed to a failure reaching the
+// proxy itself
+type socks5ReplyError struct {
+	proxyAddr string
+	code      byte
+}
+
+var socks5ReplyMessages = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+func (e *socks5ReplyError) Error() string {
+	msg, ok := socks5ReplyMessages[e.code]
+	if !ok {
+		msg = fmt.Sprintf("unknown reply code %d", e.code)
+	}
+	return fmt.Sprintf("socks5 proxy %s couldn't reach upstream: %s", e.proxyAddr, msg)
+}
+
+// indicates whether the proxy's failure to reach the upstream might go away on retry
+func (e *socks5ReplyError) transient() bool {
+	return e.code >= 3 && e.code <= 6
+}
+
+// performs the SOCKS5 handshake on a connection to the proxy, asking it to connect to addr. the handshake is bounded
+// by timeout unless it is 0.
+func (sc *socks5Config) connect(conn net.Conn, addr string, timeout time.Duration) error {
+	if timeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			return err
+		}
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %s", portStr)
+	}
+
+	// negotiate the authentication method
+	method := byte(0x00)
+	if sc.user != "" {
+		method = 0x02
+	}
+	if _, err := conn.Write([]byte{0x05, 1, method}); err != nil {
+		return err
+	}
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	if resp[0] != 0x05 {
+		return fmt.Errorf("socks5 proxy %s: unexpected protocol version %d", sc.addr, resp[0])
+	}
+	if resp[1] != method {
+		return fmt.Errorf("socks5 proxy %s: no acceptable authentication method", sc.addr)
+	}
+
+	// authenticate if needed
+	if method == 0x02 {
+		if len(sc.user) > 255 || len(sc.password) > 255 {
+			return errors.New("socks5 username and password must be at most 255 bytes")
+		}
+		req := []byte{0x01, byte(len(sc.user))}
+		req = append(req, sc.user...)
+		req = append(req, byte(len(sc.password)))
+		req = append(req, sc.password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return err
+		}
+		if resp[1] != 0x00 {
+			return fmt.Errorf("socks5 proxy %s: authentication failed", sc.addr)
+		}
+	}
+
+	// request the connection to the upstream
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name %s too long for socks5", host)
+		}
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, 0x01)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, 0x04)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// read the reply, including the bound address, which we don't need
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0x00 {
+		return &socks5ReplyError{proxyAddr: sc.addr, code: reply[1]}
+	}
+	var addrLen int
+	switch reply[3] {
+	case 0x01:
+		addrLen = 4
+	case 0x04:
+		addrLen = 16
+	case 0x03:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return err
+		}
+		addrLen = int(l[0])
+	default:
+		return fmt.Errorf("socks5 proxy %s: unexpected address type %d in reply", sc.addr, reply[3])
+	}
+	bound := make([]byte, addrLen+2)
+	if _, err := io.ReadFull(conn, bound); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"sync/atomic"
+)
+
+// a snapshot of a server's counters, e.g. for assertions in tests. byte counts include sessions that are still
+// running.
+type ServerStats struct {
+	// sessions accepted so far and sessions currently connecting to or connected to the upstream
+	TotalSessions  int64
+	ActiveSessions int
+
+	UpBytes   int64
+	DownBytes int64
+
+	// sessions that failed because the upstream couldn't be reached
+	DialFailures int64
+
+	// errors accepting client connections, e.g. because the process ran out of file descriptors
+	AcceptFailures int64
+
+	// sessions ended by a panic, e.g. in a Transformer
+	Panics int64
+
+	// sessions that ended with an error of any kind, including dial failures
+	FailedSessions int64
+
+	// the active sessions, in no particular order
+	Sessions []SessionSnapshot
+
+	// the name of the delay schedule's active window, or empty if there is no schedule or no window is active
+	ScheduleWindow string
+}
+
+// implemented by servers that keep stats
+type StatsReporter interface {
+	Stats() ServerStats
+}
+
+func (s *tcpDelayServer) Stats() ServerStats {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	stats := ServerStats{
+		TotalSessions:  atomic.LoadInt64(&s.totalSessions),
+		ActiveSessions: len(s.sessions),
+		UpBytes:        s.finishedUpBytes,
+		DownBytes:      s.finishedDownBytes,
+		DialFailures:   atomic.LoadInt64(&s.dialFailures),
+		AcceptFailures: atomic.LoadInt64(&s.acceptFailures),
+		Panics:         atomic.LoadInt64(&s.panics),
+		FailedSessions: atomic.LoadInt64(&s.failedSessions),
+		Sessions:       make([]SessionSnapshot, 0, len(s.sessions)),
+		ScheduleWindow: s.activeWindow(),
+	}
+	for session := range s.sessions {
+		ss := session.snapshot()
+		stats.UpBytes += ss.UpBytes
+		stats.DownBytes += ss.DownBytes
+		stats.Sessions = append(stats.Sessions, ss)
+	}
+	return stats
+}
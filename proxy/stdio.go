@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net"
+	"sync"
+)
+
+// defines serving a single session over a pair of streams rather than a listener, e.g. stdin and stdout to run as an
+// SSH ProxyCommand or from inetd. the streams are bridged to a loopback connection, so that the session sees a TCP
+// client with deadlines and half-closes as usual. the end of the reader is passed on to the session as a half-close,
+// so the upstream's response still arrives. once the session half-closes the client, i.e. the upstream is done
+// sending, the writer is closed, if it can be, and so is the client, ending the session. the client on the other end
+// of the streams may well keep its end open, and the session would otherwise wait for the half-close timeout.
+
+// implemented by servers that can serve a single session over a pair of streams instead of listening
+type StreamServer interface {
+	Server
+	ServeStream(ctx context.Context, r io.Reader, w io.Writer) error
+}
+
+// returned by the listener of ServeStream once it has been closed
+var errStreamListenerClosed = errors.New("stream listener closed")
+
+// serves a single session whose client sends what is read from r and receives what is written to w, and returns once
+// the session has ended, with its error if it failed. like Run, ServeStream should only be called once per server,
+// and not together with Run or Serve. a read from r still pending once the session has ended is left behind, since a
+// blocking read can't be interrupted in general.
+func (s *tcpDelayServer) ServeStream(ctx context.Context, r io.Reader, w io.Writer) error {
+	defer close(s.done)
+
+	// use the log object from the context with additional fields
+	ctx = s.logContext(ctx)
+	log := log.Ctx(ctx).With().Str("func", "tcpDelayServer.ServeStream").Logger()
+
+	bridge, client, err := loopbackPair(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("error while connecting streams")
+		return err
+	}
+	defer bridge.Close()
+	go func() {
+		if _, err := io.Copy(bridge, r); err != nil {
+			log.Debug().Err(err).Msg("error while reading from stream")
+		}
+		closeWrite(bridge)
+	}()
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		if _, err := io.Copy(w, bridge); err != nil {
+			log.Debug().Err(err).Msg("error while writing to stream")
+		}
+		if c, ok := w.(io.Closer); ok {
+			c.Close()
+		}
+		bridge.Close()
+	}()
+
+	// once the session has started, stop accepting as soon as it has ended
+	ln := newSingleConnListener(client)
+	go func() {
+		<-ln.handedOut
+		s.sessionsWg.Wait()
+		s.drainOnce.Do(func() { close(s.draining) })
+	}()
+
+	log.Info().Msg("serving single session on streams")
+	s.stream = true
+	if err := s.serve(ctx, log, []net.Listener{ln}); err != nil {
+		return err
+	}
+	// serve doesn't wait for the session if the context is done. what the session wrote to the client last may still
+	// be on its way to w.
+	s.sessionsWg.Wait()
+	select {
+	case <-written:
+	case <-ctx.Done():
+	}
+	return s.streamErr
+}
+
+// a listener handing out a single connection. after that, Accept blocks until the listener is closed.
+type singleConnListener struct {
+	conns chan net.Conn
+	addr  net.Addr
+	// closed once Accept is called after handing out the connection, i.e. once the accept loop has started the
+	// connection's session
+	handedOut chan struct{}
+	// closed once the listener is closed
+	closed    chan struct{}
+	waitOnce  sync.Once
+	closeOnce sync.Once
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	l := &singleConnListener{
+		conns:     make(chan net.Conn, 1),
+		addr:      conn.LocalAddr(),
+		handedOut: make(chan struct{}),
+		closed:    make(chan struct{}),
+	}
+	l.conns <- conn
+	return l
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	default:
+	}
+	l.waitOnce.Do(func() { close(l.handedOut) })
+	<-l.closed
+	return nil, errStreamListenerClosed
+}
+
+func (l *singleConnListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"github.com/rs/zerolog"
+	"io"
+	"time"
+)
+
+// a delay provider that aims for a target end-to-end round trip time rather than a fixed added delay.
+// the network RTT of both legs of the session (client <-> proxy and proxy <-> upstream) is measured from TCP_INFO and
+// the delay for this direction is set to half of whatever remains of the target, clamped at zero. the measurement is
+// refreshed lazily once the configured interval has elapsed. if measurement isn't available, the target is treated
+// as a plain added delay, again split evenly between the two directions.
+
+type targetRTTDelay struct {
+	target      time.Duration
+	interval    time.Duration
+	src         io.ReadWriteCloser
+	dst         io.ReadWriteCloser
+	log         zerolog.Logger
+	residual    time.Duration
+	lastMeasure time.Time
+	fallback    bool
+}
+
+func newTargetRTTDelay(target time.Duration, interval time.Duration, src io.ReadWriteCloser, dst io.ReadWriteCloser, log zerolog.Logger) *targetRTTDelay {
+	return &targetRTTDelay{
+		target:   target,
+		interval: interval,
+		src:      src,
+		dst:      dst,
+		log:      log.With().Str("func", "targetRTTDelay").Logger(),
+		residual: target / 2,
+	}
+}
+
+func (d *targetRTTDelay) delay() time.Duration {
+	// once we've fallen back there is no point in trying again
+	if d.fallback {
+		return d.residual
+	}
+	if !d.lastMeasure.IsZero() && time.Since(d.lastMeasure) < d.interval {
+		return d.residual
+	}
+	d.lastMeasure = time.Now()
+
+	srcRTT, srcErr := tcpRTT(d.src)
+	dstRTT, dstErr := tcpRTT(d.dst)
+	if srcErr != nil || dstErr != nil {
+		d.fallback = true
+		d.residual = d.target / 2
+		d.log.Info().AnErr("srcErr", srcErr).AnErr("dstErr", dstErr).Dur("targetRTT", d.target).Dur("residualDelay", d.residual).
+			Msg("rtt measurement unavailable. treating target rtt as added delay.")
+		return d.residual
+	}
+
+	residual := (d.target - srcRTT - dstRTT) / 2
+	if residual < 0 {
+		residual = 0
+	}
+	d.log.Debug().Dur("targetRTT", d.target).Dur("srcRTT", srcRTT).Dur("dstRTT", dstRTT).Dur("residualDelay", residual).
+		Msg("recomputed delay from measured rtt")
+	d.residual = residual
+	return d.residual
+}
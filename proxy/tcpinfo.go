@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+)
+
+// returned by tcpRTT if the kernel's RTT estimate can't be obtained for a connection, either because the platform
+// doesn't support TCP_INFO or because the connection isn't a TCP connection
+var errRTTUnavailable = errors.New("tcp rtt measurement unavailable")
+
+// returns the socket underneath the wrappers the proxy puts around connections, e.g. for TLS, data read ahead from a
+// PROXY protocol header, ClientHello or CONNECT response, or watching TLS records. returns nil if there is none.
+func rawSocket(conn io.ReadWriteCloser) syscall.Conn {
+	for {
+		switch c := conn.(type) {
+		case syscall.Conn:
+			return c
+		case *bufferedConn:
+			conn = c.Conn
+		case *recordingConn:
+			conn = c.Conn
+		case *tlsRecordWatcher:
+			conn = c.Conn
+		// a *tls.Conn, which has NetConn since go 1.18
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+}
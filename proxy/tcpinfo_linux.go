@@ -0,0 +1,38 @@
+//go:build linux
+// +build linux
+
+package proxy
+
+import (
+	"golang.org/x/sys/unix"
+	"io"
+	"time"
+)
+
+// returns the kernel's smoothed round trip time estimate for a TCP connection as reported by TCP_INFO. wrapped
+// connections are measured on the socket underneath.
+func tcpRTT(conn io.ReadWriteCloser) (time.Duration, error) {
+	sc := rawSocket(conn)
+	if sc == nil {
+		return 0, errRTTUnavailable
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var info *unix.TCPInfo
+	var infoErr error
+	err = rc.Control(func(fd uintptr) {
+		info, infoErr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if infoErr != nil {
+		return 0, infoErr
+	}
+
+	// rtt is reported in microseconds
+	return time.Duration(info.Rtt) * time.Microsecond, nil
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/rs/zerolog"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// returns a TLS server and client config trusting a fresh self-signed certificate for localhost
+func testTLSConfigs(t *testing.T) (*tls.Config, *tls.Config) {
+	t.Helper()
+	cert, err := NewSelfSignedCert([]string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, &tls.Config{RootCAs: roots, ServerName: "localhost"}
+}
+
+// the RTT is measured on the socket underneath the wrappers the proxy puts around connections
+func TestTCPRTTWrappedConns(t *testing.T) {
+	serverConfig, clientConfig := testTLSConfigs(t)
+	wrappers := map[string]func(conn net.Conn, peer net.Conn) io.ReadWriteCloser{
+		"tcp": func(conn net.Conn, peer net.Conn) io.ReadWriteCloser {
+			return conn
+		},
+		"tls": func(conn net.Conn, peer net.Conn) io.ReadWriteCloser {
+			tc := tls.Server(conn, serverConfig)
+			go tls.Client(peer, clientConfig).Handshake()
+			if err := tc.Handshake(); err != nil {
+				t.Fatal(err)
+			}
+			return tc
+		},
+		"buffered": func(conn net.Conn, peer net.Conn) io.ReadWriteCloser {
+			return &bufferedConn{Conn: conn, r: bufio.NewReader(conn)}
+		},
+		"recording": func(conn net.Conn, peer net.Conn) io.ReadWriteCloser {
+			return &recordingConn{Conn: conn, r: conn}
+		},
+		"tls record watcher": func(conn net.Conn, peer net.Conn) io.ReadWriteCloser {
+			return &tlsRecordWatcher{Conn: conn}
+		},
+		// upstream TLS through a CONNECT proxy
+		"tls over buffered": func(conn net.Conn, peer net.Conn) io.ReadWriteCloser {
+			tc := tls.Client(&bufferedConn{Conn: conn, r: bufio.NewReader(conn)}, clientConfig)
+			go tls.Server(peer, serverConfig).Handshake()
+			if err := tc.Handshake(); err != nil {
+				t.Fatal(err)
+			}
+			return tc
+		},
+	}
+	for name, wrap := range wrappers {
+		conn, peer := tcpPair(t)
+		if _, err := tcpRTT(wrap(conn, peer)); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+}
+
+// with TLS termination, the client leg is a *tls.Conn. target rtt still measures it instead of falling back to a
+// plain added delay.
+func TestTargetRTTWithTLSTermination(t *testing.T) {
+	const target = 100 * time.Millisecond
+	serverConfig, clientConfig := testTLSConfigs(t)
+	logs := &logLines{}
+	srv := NewTcpDelayServer("", 0, 0, false, startTCPEcho(t),
+		WithTLSConfig(serverConfig), WithPipeOptions(WithTargetRTT(target, time.Second)), WithLogger(zerolog.New(logs)))
+	addr := serveOn(t, srv)
+
+	conn, err := tls.Dial("tcp", addr, clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	payload := []byte("hello over tls")
+	got, took := roundTripConn(t, conn, payload)
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("got %q, want %q", got, payload)
+	}
+	// the loopback rtt is next to nothing, so nearly all of the target is added
+	if took < target*9/10 {
+		t.Fatalf("round trip took %s with a target rtt of %s", took, target)
+	}
+	if logs.find("rtt measurement unavailable. treating target rtt as added delay.") != nil {
+		t.Fatal("target rtt fell back to a plain added delay")
+	}
+	if logs.find("recomputed delay from measured rtt") == nil {
+		t.Fatal("target rtt didn't measure the rtt")
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import (
+	"io"
+	"time"
+)
+
+// TCP_INFO is only plumbed through on linux
+func tcpRTT(conn io.ReadWriteCloser) (time.Duration, error) {
+	return 0, errRTTUnavailable
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"github.com/rs/zerolog"
+	"syscall"
+)
+
+// defines TCP Fast Open (RFC 7413), which lets a client that has connected before send its first data in the SYN and
+// saves a round trip per connection. it only takes effect where the kernel allows it, i.e. on linux with the server
+// bit (2) of net.ipv4.tcp_fastopen set for listeners and the client bit (1) set for upstream connections. on other
+// platforms, the options log a warning and the server runs without.
+
+// the number of pending fast open connections a listener accepts before falling back to the regular handshake
+const tfoQueueLen = 256
+
+// enables TCP Fast Open on TCP listeners, so that clients using it don't have it disabled by the proxy. it has no
+// effect with Serve.
+func WithTCPFastOpen() ServerOption {
+	return func(s *tcpDelayServer) {
+		s.tcpFastOpen = true
+	}
+}
+
+// enables TCP Fast Open on upstream connections via TCP_FASTOPEN_CONNECT. the kernel then defers the handshake until
+// the first write, so the dial succeeds before the upstream has been reached, and an upstream that speaks first only
+// gets connected once the client has sent something. it has no effect with WithDialer.
+func WithUpstreamTCPFastOpen() ServerOption {
+	return func(s *tcpDelayServer) {
+		s.dial.fastOpen = true
+	}
+}
+
+// returns a listener control func enabling fast open, which logs failures instead of failing the listen
+func tfoListenControl(log zerolog.Logger) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		if err := setTFOListen(c); err != nil {
+			log.Warn().Err(err).Str("listenAddr", address).Msg("error while enabling TCP Fast Open on listener. continuing without.")
+		}
+		return nil
+	}
+}
+
+// a dialer control func enabling fast open
+func tfoConnectControl(network, address string, c syscall.RawConn) error {
+	return setTFOConnect(c)
+}
+
+// checks fast open support for listeners or upstream connections and warns if it won't take effect. returns false if
+// the socket option can't be set at all.
+func checkTFO(log zerolog.Logger, upstream bool) bool {
+	side := "listeners"
+	if upstream {
+		side = "upstream connections"
+	}
+	ok, err := tfoAvailable(upstream)
+	if err != nil {
+		log.Warn().Err(err).Bool("enabled", ok).Msgf("TCP Fast Open won't take effect for %s", side)
+	}
+	return ok
+}
+
+// combines socket control funcs, e.g. for a net.ListenConfig or net.Dialer. nil funcs are skipped.
+func chainControl(fns ...func(network, address string, c syscall.RawConn) error) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		for _, fn := range fns {
+			if fn == nil {
+				continue
+			}
+			if err := fn(network, address, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,70 @@
+//go:build linux
+// +build linux
+
+package proxy
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// sets TCP_FASTOPEN on a listening socket
+func setTFOListen(c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN, tfoQueueLen)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// sets TCP_FASTOPEN_CONNECT on a socket before connecting
+func setTFOConnect(c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// checks net.ipv4.tcp_fastopen and, for upstream connections, that the kernel knows TCP_FASTOPEN_CONNECT (4.11 and
+// later). returns false if the socket option can't be set, and an error if fast open won't take effect. a sysctl that
+// can't be read isn't an error, since the kernel has the final say anyway.
+func tfoAvailable(upstream bool) (bool, error) {
+	if upstream {
+		fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+		if err == nil {
+			err = unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1)
+			unix.Close(fd)
+		}
+		if err != nil {
+			return false, fmt.Errorf("TCP_FASTOPEN_CONNECT isn't supported by the kernel: %w", err)
+		}
+	}
+
+	b, err := ioutil.ReadFile("/proc/sys/net/ipv4/tcp_fastopen")
+	if err != nil {
+		return true, nil
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return true, nil
+	}
+	bit, role := 2, "servers"
+	if upstream {
+		bit, role = 1, "clients"
+	}
+	if v&bit == 0 {
+		return true, fmt.Errorf("net.ipv4.tcp_fastopen is %d, which doesn't enable it for %s", v, role)
+	}
+	return true, nil
+}
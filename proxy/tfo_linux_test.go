@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"github.com/rs/zerolog"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// skips the test unless net.ipv4.tcp_fastopen enables fast open for the given role, i.e. servers for the listener and
+// clients for upstream connections
+func requireTFO(t *testing.T, upstream bool) {
+	t.Helper()
+	b, err := ioutil.ReadFile("/proc/sys/net/ipv4/tcp_fastopen")
+	if err != nil {
+		t.Skipf("can't read the TCP Fast Open sysctl: %s", err)
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		t.Skipf("invalid TCP Fast Open sysctl %q", b)
+	}
+	if ok, err := tfoAvailable(upstream); !ok || err != nil {
+		t.Skipf("TCP Fast Open isn't available with net.ipv4.tcp_fastopen = %d: %v", v, err)
+	}
+}
+
+// returns the value of the given TCP socket option of conn
+func tcpSockopt(t *testing.T, conn syscall.Conn, opt int) int {
+	t.Helper()
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	var sockErr error
+	if err := rc.Control(func(fd uintptr) {
+		v, sockErr = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, opt)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if sockErr != nil {
+		t.Fatal(sockErr)
+	}
+	return v
+}
+
+func TestTFOListener(t *testing.T) {
+	requireTFO(t, false)
+	lc := net.ListenConfig{Control: tfoListenControl(zerolog.Nop())}
+	ln, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if got := tcpSockopt(t, ln.(*net.TCPListener), unix.TCP_FASTOPEN); got != tfoQueueLen {
+		t.Fatalf("got a fast open queue length of %d, want %d", got, tfoQueueLen)
+	}
+
+	addr := runServer(t, NewTcpDelayServer("127.0.0.1:0", 0, 0, false, startTCPEcho(t), WithTCPFastOpen()))
+	payload := []byte("hello over a fast open listener")
+	if got, _ := roundTrip(t, addr, payload); !bytes.Equal(got, payload) {
+		t.Fatalf("got %q, want %q", got, payload)
+	}
+}
+
+func TestTFOUpstream(t *testing.T) {
+	requireTFO(t, true)
+	upstreamAddr := startTCPEcho(t)
+	conn, err := dialConfig{fastOpen: true}.dial(context.Background(), zerolog.Nop(), upstreamAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := tcpSockopt(t, conn.(*net.TCPConn), unix.TCP_FASTOPEN_CONNECT); got != 1 {
+		t.Fatalf("got TCP_FASTOPEN_CONNECT %d on the upstream connection, want 1", got)
+	}
+
+	// the handshake is deferred until the first write, which the proxy has to handle like any other connection
+	addr := runServer(t, NewTcpDelayServer("127.0.0.1:0", 0, 0, false, upstreamAddr, WithUpstreamTCPFastOpen()))
+	payload := []byte("hello over a fast open upstream connection")
+	if got, _ := roundTrip(t, addr, payload); !bytes.Equal(got, payload) {
+		t.Fatalf("got %q, want %q", got, payload)
+	}
+}
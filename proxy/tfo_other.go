@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import (
+	"errors"
+	"syscall"
+)
+
+var errTFOUnsupported = errors.New("TCP Fast Open is only supported on linux")
+
+func setTFOListen(c syscall.RawConn) error {
+	return errTFOUnsupported
+}
+
+func setTFOConnect(c syscall.RawConn) error {
+	return errTFOUnsupported
+}
+
+func tfoAvailable(upstream bool) (bool, error) {
+	return false, errTFOUnsupported
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// upper bound on how long a TLS handshake may take before the connection is given up on
+const tlsHandshakeTimeout = 10 * time.Second
+
+// performs the handshake on a TLS connection, bounded by tlsHandshakeTimeout
+func tlsHandshake(conn *tls.Conn) error {
+	if err := conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout)); err != nil {
+		return err
+	}
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+// wraps an upstream connection in a TLS client. if the config doesn't name a server, the host part of the upstream
+// address is used for verification and SNI.
+func newUpstreamTLSConn(conn net.Conn, config *tls.Config, upstreamAddr string) *tls.Conn {
+	if name := upstreamServerName(config, upstreamAddr); name != config.ServerName {
+		config = config.Clone()
+		config.ServerName = name
+	}
+	return tls.Client(conn, config)
+}
+
+// the name sent as SNI and verified against the upstream's certificate
+func upstreamServerName(config *tls.Config, upstreamAddr string) string {
+	if config.ServerName != "" {
+		return config.ServerName
+	}
+	if host, _, err := net.SplitHostPort(upstreamAddr); err == nil {
+		return host
+	}
+	return ""
+}
+
+// returns the subject of the certificate presented by the peer if a handshake error carries it (e.g. because it was
+// signed by an unknown authority), or an empty string otherwise
+func presentedSubject(err error) string {
+	var unknownAuthErr x509.UnknownAuthorityError
+	if errors.As(err, &unknownAuthErr) && unknownAuthErr.Cert != nil {
+		return unknownAuthErr.Cert.Subject.String()
+	}
+	var invalidErr x509.CertificateInvalidError
+	if errors.As(err, &invalidErr) && invalidErr.Cert != nil {
+		return invalidErr.Cert.Subject.String()
+	}
+	var hostnameErr x509.HostnameError
+	if errors.As(err, &hostnameErr) && hostnameErr.Certificate != nil {
+		return hostnameErr.Certificate.Subject.String()
+	}
+	return ""
+}
+
+// returns the names the peer's certificate is valid for if a handshake error is due to its names not matching, or nil
+// otherwise
+func presentedNames(err error) []string {
+	var hostnameErr x509.HostnameError
+	if !errors.As(err, &hostnameErr) || hostnameErr.Certificate == nil {
+		return nil
+	}
+	cert := hostnameErr.Certificate
+	names := append([]string{}, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	if len(names) == 0 && cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	return names
+}
+
+// returns a readable name for a TLS protocol version
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "1.0"
+	case tls.VersionTLS11:
+		return "1.1"
+	case tls.VersionTLS12:
+		return "1.2"
+	case tls.VersionTLS13:
+		return "1.3"
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+)
+
+// defines self-signed certificates for TLS termination in quick tests, where minting a certificate is more trouble
+// than it is worth. the key never leaves the process, so clients can only trust the certificate itself.
+
+// how long a self-signed certificate is valid. its validity starts a little in the past to allow for clock skew.
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// generates a self-signed certificate for the given hostnames. IP addresses, optionally in brackets like [::1], become
+// IP SANs and everything else DNS SANs. empty hostnames are skipped. the first hostname is the subject's common name.
+// the certificate is returned as Leaf as well.
+func NewSelfSignedCert(hostnames []string) (tls.Certificate, error) {
+	var names []string
+	var ips []net.IP
+	commonName := ""
+	for _, h := range hostnames {
+		h = strings.TrimSuffix(strings.TrimPrefix(h, "["), "]")
+		if h == "" {
+			continue
+		}
+		if commonName == "" {
+			commonName = h
+		}
+		if ip := net.ParseIP(h); ip != nil {
+			ips = append(ips, ip)
+		} else {
+			names = append(names, h)
+		}
+	}
+	if commonName == "" {
+		return tls.Certificate{}, errors.New("no hostnames")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName, Organization: []string{"tcp-delay-proxy"}},
+		DNSNames:              names,
+		IPAddresses:           ips,
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		// clients can trust the certificate as its own CA, e.g. with curl --cacert
+		IsCA: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// returns the SHA-256 fingerprint of a certificate in the usual colon separated hex form
+func CertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// encodes the certificate chain of cert as PEM, without the key
+func CertPEM(cert tls.Certificate) []byte {
+	var b []byte
+	for _, der := range cert.Certificate {
+		b = append(b, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	return b
+}
@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNewSelfSignedCertSANs(t *testing.T) {
+	tests := []struct {
+		name      string
+		hostnames []string
+		cn        string
+		dnsNames  []string
+		ips       []string
+		err       bool
+	}{
+		{
+			name:      "names and ips",
+			hostnames: []string{"localhost", "127.0.0.1", "proxy.example", "::1"},
+			cn:        "localhost",
+			dnsNames:  []string{"localhost", "proxy.example"},
+			ips:       []string{"127.0.0.1", "::1"},
+		},
+		{
+			name:      "bracketed ipv6",
+			hostnames: []string{"[::1]", "localhost"},
+			cn:        "::1",
+			dnsNames:  []string{"localhost"},
+			ips:       []string{"::1"},
+		},
+		{
+			name:      "empty entries",
+			hostnames: []string{"", "proxy.example", "", "10.0.0.1"},
+			cn:        "proxy.example",
+			dnsNames:  []string{"proxy.example"},
+			ips:       []string{"10.0.0.1"},
+		},
+		{
+			name:      "ip only",
+			hostnames: []string{"192.0.2.1"},
+			cn:        "192.0.2.1",
+			ips:       []string{"192.0.2.1"},
+		},
+		{
+			name: "no hostnames",
+			err:  true,
+		},
+		{
+			name:      "only empty hostnames",
+			hostnames: []string{"", ""},
+			err:       true,
+		},
+	}
+	for _, test := range tests {
+		cert, err := NewSelfSignedCert(test.hostnames)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: got a certificate, want an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		leaf := cert.Leaf
+		if leaf.Subject.CommonName != test.cn {
+			t.Errorf("%s: got common name %q, want %q", test.name, leaf.Subject.CommonName, test.cn)
+		}
+		if !reflect.DeepEqual(leaf.DNSNames, test.dnsNames) {
+			t.Errorf("%s: got DNS SANs %q, want %q", test.name, leaf.DNSNames, test.dnsNames)
+		}
+		var ips []string
+		for _, ip := range leaf.IPAddresses {
+			ips = append(ips, ip.String())
+		}
+		if !reflect.DeepEqual(ips, test.ips) {
+			t.Errorf("%s: got IP SANs %q, want %q", test.name, ips, test.ips)
+		}
+
+		// clients trust the certificate as its own root, e.g. with curl --cacert
+		roots := x509.NewCertPool()
+		roots.AddCert(leaf)
+		for _, h := range append(test.dnsNames, test.ips...) {
+			if err := leaf.VerifyHostname(h); err != nil {
+				t.Errorf("%s: %s", test.name, err)
+			}
+			if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots, DNSName: h}); err != nil {
+				t.Errorf("%s: verifying for %s: %s", test.name, h, err)
+			}
+		}
+	}
+}
+
+// the PEM written by --tls-cert-out holds the certificate whose fingerprint is logged
+func TestSelfSignedCertPEMAndFingerprint(t *testing.T) {
+	cert, err := NewSelfSignedCert([]string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, rest := pem.Decode(CertPEM(cert))
+	if block == nil || block.Type != "CERTIFICATE" || len(rest) != 0 {
+		t.Fatalf("got PEM block %v with %d bytes left over, want a single certificate", block, len(rest))
+	}
+	parsed, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.Equal(cert.Leaf) {
+		t.Fatal("PEM holds a different certificate than Leaf")
+	}
+
+	fingerprint := CertFingerprint(parsed)
+	if want := fmt.Sprintf("%X", sha256.Sum256(block.Bytes)); strings.Replace(fingerprint, ":", "", -1) != want {
+		t.Fatalf("got fingerprint %s, want the SHA-256 %s", fingerprint, want)
+	}
+	if parts := strings.Split(fingerprint, ":"); len(parts) != sha256.Size {
+		t.Fatalf("got %d fingerprint parts, want %d", len(parts), sha256.Size)
+	}
+	if CertFingerprint(cert.Leaf) != fingerprint {
+		t.Fatal("fingerprint of Leaf differs from that of the PEM")
+	}
+}
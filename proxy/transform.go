@@ -0,0 +1,53 @@
+package proxy
+
+// defines an optional stage rewriting chunks between reading and writing them, e.g. to inject faults, scrub secrets
+// or rewrite a protocol header.
+
+// transforms a chunk read by a pipe before it is written. direction is "up" or "down" for the pipes of a session and
+// empty for pipes created directly. the returned chunk may differ in length from the one passed in and is written
+// instead of it. an empty chunk writes nothing. an error aborts the pipe with ErrTransform.
+type Transformer func(direction string, chunk []byte) ([]byte, error)
+
+// returns a Transformer running the given ones in order, each on the output of the previous one. nil transformers are
+// skipped.
+func ChainTransformers(ts ...Transformer) Transformer {
+	return func(direction string, chunk []byte) ([]byte, error) {
+		for _, t := range ts {
+			if t == nil {
+				continue
+			}
+			var err error
+			chunk, err = t(direction, chunk)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return chunk, nil
+	}
+}
+
+// runs every chunk through the given transformer. nil means passthrough. use ChainTransformers to combine several.
+func WithTransformer(t Transformer) PipeOption {
+	return func(o *pipeOptions) {
+		o.transformer = t
+	}
+}
+
+// tells the transformer which direction a session's pipe is for
+func withDirection(direction string) PipeOption {
+	return func(o *pipeOptions) {
+		o.direction = direction
+	}
+}
+
+// runs a chunk through the transformer, if any
+func (o *pipeOptions) transform(chunk []byte) ([]byte, error) {
+	if o.transformer == nil {
+		return chunk, nil
+	}
+	out, err := o.transformer(o.direction, chunk)
+	if err != nil {
+		return nil, wrapErr(ErrTransform, err)
+	}
+	return out, nil
+}
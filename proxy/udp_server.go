@@ -0,0 +1,292 @@
+package proxy
+
+import (
+	"context"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defines a UDP proxy server.
+// the server binds a single UDP socket and tracks client "flows" by source address. each flow gets its own socket
+// connected to the upstream so that responses can be relayed back to the right client. datagrams are forwarded with
+// the up delay and responses relayed with the down delay, preserving message boundaries. unlike the TCP server,
+// datagrams are scheduled independently and may be reordered, which is realistic for UDP.
+// flows that see no traffic in either direction for the idle timeout are expired.
+
+type udpDelayServer struct {
+	listenAddr   string
+	delaysMu     sync.RWMutex
+	delays       DelaySettings
+	upstreamAddr string
+	idleTimeout  time.Duration
+
+	// the resolved listen address once listening
+	addrMu sync.Mutex
+	addr   net.Addr
+	ready  chan struct{}
+
+	// closed by Shutdown, and once Run returns
+	stopping chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// a single client flow
+type udpFlow struct {
+	clientAddr   net.Addr
+	upstreamConn *net.UDPConn
+	log          zerolog.Logger
+	lastActive   int64
+}
+
+func (f *udpFlow) touch() {
+	atomic.StoreInt64(&f.lastActive, time.Now().UnixNano())
+}
+
+func (f *udpFlow) idleSince() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&f.lastActive))
+}
+
+// idle flows are looked for at half the idle timeout, but no more often than this
+const minUdpExpireInterval = 10 * time.Millisecond
+
+// listenAddr and upstreamAddr are in host:port form. a flow is expired after idleTimeout without traffic. an
+// idleTimeout of 0 keeps flows until the server stops.
+func NewUdpDelayServer(listenAddr string, upDelay time.Duration, downDelay time.Duration, upstreamAddr string, idleTimeout time.Duration) Server {
+	return &udpDelayServer{
+		listenAddr:   listenAddr,
+		delays:       DelaySettings{UpDelay: upDelay, DownDelay: downDelay},
+		upstreamAddr: upstreamAddr,
+		idleTimeout:  idleTimeout,
+		ready:        make(chan struct{}),
+		stopping:     make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+}
+
+func (s *udpDelayServer) DelaySettings() DelaySettings {
+	s.delaysMu.RLock()
+	defer s.delaysMu.RUnlock()
+	return s.delays
+}
+
+// every datagram is scheduled with the delays current when it was read, so existing flows always pick up the new
+// settings. randomization isn't supported in udp mode and is ignored.
+func (s *udpDelayServer) SetDelaySettings(settings DelaySettings, applyExisting bool) {
+	s.delaysMu.Lock()
+	defer s.delaysMu.Unlock()
+	s.delays = DelaySettings{UpDelay: settings.UpDelay, DownDelay: settings.DownDelay}
+}
+
+func (s *udpDelayServer) Addr() net.Addr {
+	s.addrMu.Lock()
+	defer s.addrMu.Unlock()
+	return s.addr
+}
+
+func (s *udpDelayServer) Ready() <-chan struct{} {
+	return s.ready
+}
+
+func (s *udpDelayServer) Done() <-chan struct{} {
+	return s.done
+}
+
+// there are no sessions to drain, so flows are closed right away
+func (s *udpDelayServer) Shutdown(ctx context.Context) error {
+	s.stopOnce.Do(func() { close(s.stopping) })
+	<-s.done
+	return nil
+}
+
+// Run should only be called once per server
+func (s *udpDelayServer) Run(ctx context.Context) error {
+	defer close(s.done)
+
+	// use the log object from the context with additional fields
+	log := log.Ctx(ctx).With().Str("func", "udpDelayServer.Run").Logger()
+
+	// shutting down tears the server down just like cancelling the context
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-s.stopping:
+			cancel()
+		}
+	}()
+
+	upstreamAddr, err := net.ResolveUDPAddr("udp", s.upstreamAddr)
+	if err != nil {
+		log.Error().Err(err).Str("upstreamAddr", s.upstreamAddr).Msg("error while resolving upstream address")
+		return err
+	}
+
+	// use a ListenConfig so it can be torn down via context
+	lc := net.ListenConfig{}
+	pc, err := lc.ListenPacket(ctx, "udp", s.listenAddr)
+	if err != nil {
+		log.Error().Err(err).Str("listenAddr", s.listenAddr).Msg("error while establishing listener")
+		return err
+	}
+	defer pc.Close()
+	log.Info().Stringer("addr", pc.LocalAddr()).Msg("udp listener established")
+
+	// record the resolved address and signal readiness
+	s.addrMu.Lock()
+	s.addr = pc.LocalAddr()
+	s.addrMu.Unlock()
+	close(s.ready)
+
+	// flows by client address
+	flowsMu := sync.Mutex{}
+	flows := map[string]*udpFlow{}
+	closeFlow := func(key string, f *udpFlow) {
+		delete(flows, key)
+		f.upstreamConn.Close()
+	}
+
+	// tear everything down once the context is cancelled
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+		flowsMu.Lock()
+		for key, f := range flows {
+			closeFlow(key, f)
+		}
+		flowsMu.Unlock()
+	}()
+
+	// periodically expire idle flows
+	if s.idleTimeout > 0 {
+		go func() {
+			interval := s.idleTimeout / 2
+			if interval < minUdpExpireInterval {
+				interval = minUdpExpireInterval
+			}
+			t := time.NewTicker(interval)
+			defer t.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+
+				case <-t.C:
+					flowsMu.Lock()
+					for key, f := range flows {
+						if time.Since(f.idleSince()) > s.idleTimeout {
+							f.log.Info().Msg("flow idle. expiring.")
+							closeFlow(key, f)
+						}
+					}
+					flowsMu.Unlock()
+				}
+			}
+		}()
+	}
+
+	// largest possible datagram
+	bbuf := make([]byte, 64*1024)
+
+	flowNum := 0
+	// the wait after the last of a run of consecutive read errors
+	var backoff time.Duration
+	for {
+		nb, clientAddr, err := pc.ReadFrom(bbuf)
+		if err != nil {
+			// suppress any final error messages if the context has been cancelled
+			if ctx.Err() != nil {
+				return nil
+			}
+			// like net/http, give up on errors that won't go away and retry temporary ones after a while, so that a
+			// persistent error doesn't spin
+			if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+				log.Error().Err(err).Msg("error while reading datagram. stopping.")
+				return err
+			}
+			backoff = nextAcceptBackoff(backoff)
+			log.Error().Err(err).Dur("backoff", backoff).Msg("error while reading datagram")
+			t := time.NewTimer(backoff)
+			select {
+			case <-ctx.Done():
+			case <-t.C:
+			}
+			t.Stop()
+			continue
+		}
+		backoff = 0
+
+		// find or create the flow for this client
+		flowsMu.Lock()
+		f, ok := flows[clientAddr.String()]
+		if !ok {
+			flowNum++
+			f, err = s.newFlow(ctx, log.With().Int("flowNum", flowNum).Stringer("clientAddr", clientAddr).Logger(), pc, clientAddr, upstreamAddr)
+			if err != nil {
+				flowsMu.Unlock()
+				continue
+			}
+			flows[clientAddr.String()] = f
+		}
+		flowsMu.Unlock()
+		f.touch()
+
+		// copy the datagram and send it after the delay. each datagram has its own timer, so they may be reordered.
+		dgram := make([]byte, nb)
+		copy(dgram, bbuf[:nb])
+		f.log.Trace().Int("numBytes", nb).Msg("read datagram from client")
+		time.AfterFunc(s.DelaySettings().UpDelay, func() {
+			if _, err := f.upstreamConn.Write(dgram); err != nil {
+				f.log.Debug().Err(err).Msg("error while forwarding datagram to upstream")
+			}
+		})
+	}
+}
+
+// creates a flow with its own upstream socket and starts relaying responses back to the client
+func (s *udpDelayServer) newFlow(ctx context.Context, log zerolog.Logger, pc net.PacketConn, clientAddr net.Addr, upstreamAddr *net.UDPAddr) (*udpFlow, error) {
+	upstreamConn, err := net.DialUDP("udp", nil, upstreamAddr)
+	if err != nil {
+		log.Error().Err(err).Msg("error establishing upstream socket for flow")
+		return nil, err
+	}
+	f := &udpFlow{
+		clientAddr:   clientAddr,
+		upstreamConn: upstreamConn,
+		log:          log.With().Stringer("upstreamAddr", upstreamAddr).Logger(),
+		// active from the start, so that a flow isn't expired before its first datagram touches it
+		lastActive: time.Now().UnixNano(),
+	}
+	f.log.Info().Msg("new udp flow")
+
+	// relay responses until the flow's socket is closed
+	go func() {
+		bbuf := make([]byte, 64*1024)
+		for {
+			nb, err := upstreamConn.Read(bbuf)
+			if err != nil {
+				if ctx.Err() == nil {
+					f.log.Debug().Err(err).Msg("flow upstream socket closed")
+				}
+				return
+			}
+			f.touch()
+
+			dgram := make([]byte, nb)
+			copy(dgram, bbuf[:nb])
+			f.log.Trace().Int("numBytes", nb).Msg("read datagram from upstream")
+			time.AfterFunc(s.DelaySettings().DownDelay, func() {
+				if _, err := pc.WriteTo(dgram, clientAddr); err != nil {
+					f.log.Debug().Err(err).Msg("error while relaying datagram to client")
+				}
+			})
+		}
+	}()
+
+	return f, nil
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"context"
+	"github.com/rs/zerolog"
+	"net"
+	"testing"
+	"time"
+)
+
+// starts a UDP server echoing every datagram back to its sender
+func startUdpEcho(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestUdpIdleTimeouts(t *testing.T) {
+	echoAddr := startUdpEcho(t)
+	// a tiny timeout used to make the expiry ticker panic, and 0 never expires
+	for _, idleTimeout := range []time.Duration{time.Nanosecond, 0, time.Minute} {
+		srv := NewUdpDelayServer("127.0.0.1:0", 0, 10*time.Millisecond, echoAddr, idleTimeout)
+		addr := runServer(t, srv)
+
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, 16)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("idle timeout %s: %s", idleTimeout, err)
+		}
+		if string(buf[:n]) != "ping" {
+			t.Fatalf("idle timeout %s: got %q, want %q", idleTimeout, buf[:n], "ping")
+		}
+	}
+}
+
+func TestUdpFlowActiveFromStart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	upstreamAddr, err := net.ResolveUDPAddr("udp", startUdpEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	s := NewUdpDelayServer("127.0.0.1:0", 0, 0, upstreamAddr.String(), time.Minute).(*udpDelayServer)
+	f, err := s.newFlow(ctx, zerolog.Nop(), pc, pc.LocalAddr(), upstreamAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.upstreamConn.Close()
+	// the expiry loop may see the flow before the first datagram has touched it
+	if idle := time.Since(f.idleSince()); idle > time.Second {
+		t.Fatalf("new flow has been idle for %s", idle)
+	}
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// listen and upstream addresses of the form "unix:/path/to.sock" use a Unix domain socket rather than TCP
+const unixAddrPrefix = "unix:"
+
+// addresses of the form "unix-abstract:name", or "@name" for short, use a socket in the linux abstract namespace. it
+// has no file to clean up and goes away with the last socket bound to the name.
+const unixAbstractPrefix = "unix-abstract:"
+
+// splits a listen address into the network and address to pass to net.Listen
+func splitListenAddr(listenAddr string) (string, string) {
+	if addr, ok := SplitUnixAddr(listenAddr); ok {
+		return "unix", addr
+	}
+	return "tcp", listenAddr
+}
+
+// returns the path or, for abstract sockets, the name with a leading NUL byte to pass to net.Listen or net.Dial with
+// network "unix", or false if the address isn't a Unix socket address
+func SplitUnixAddr(addr string) (string, bool) {
+	switch {
+	case strings.HasPrefix(addr, unixAddrPrefix):
+		return strings.TrimPrefix(addr, unixAddrPrefix), true
+	case strings.HasPrefix(addr, unixAbstractPrefix):
+		return "\x00" + strings.TrimPrefix(addr, unixAbstractPrefix), true
+	case strings.HasPrefix(addr, "@"):
+		return "\x00" + strings.TrimPrefix(addr, "@"), true
+	}
+	return "", false
+}
+
+// reports whether a socket address returned by splitUnixAddr is in the abstract namespace
+func isAbstractUnixAddr(addr string) bool {
+	return strings.HasPrefix(addr, "\x00")
+}
+
+// replaces the NUL byte of an abstract socket address in a listen or dial error by the conventional @, so that the
+// error can be logged as it is
+func printableUnixErr(err error) error {
+	opErr, ok := err.(*net.OpError)
+	if !ok {
+		return err
+	}
+	ua, ok := opErr.Addr.(*net.UnixAddr)
+	if !ok || !isAbstractUnixAddr(ua.Name) {
+		return err
+	}
+	fixed := *opErr
+	fixed.Addr = &net.UnixAddr{Name: "@" + ua.Name[1:], Net: ua.Net}
+	return &fixed
+}
+
+// removes a socket file left behind by a previous run that didn't shut down cleanly. fails if the file isn't a
+// socket or if something is still accepting connections on it.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("socket %s is in use by another process", path)
+	}
+	return os.Remove(path)
+}
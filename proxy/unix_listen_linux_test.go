@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/rs/zerolog"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// returns an abstract socket name unique to the test, since abstract names are shared by the whole network namespace
+func abstractName(what string) string {
+	return fmt.Sprintf("tcp-delay-proxy-test-%d-%s-%d", os.Getpid(), what, time.Now().UnixNano())
+}
+
+// errors about abstract sockets name them with an @ instead of the NUL byte
+func TestPrintableUnixErr(t *testing.T) {
+	name := abstractName("missing")
+	_, err := net.Dial("unix", "\x00"+name)
+	if err == nil {
+		t.Fatalf("dial to unused abstract socket %s succeeded", name)
+	}
+	msg := printableUnixErr(err).Error()
+	if strings.Contains(msg, "\x00") || !strings.Contains(msg, "@"+name) {
+		t.Fatalf("got %q, want the name with an @", msg)
+	}
+}
+
+func TestAbstractUnixListen(t *testing.T) {
+	for _, prefix := range []string{unixAbstractPrefix, "@"} {
+		name := abstractName("listen")
+		logs := &logLines{}
+		srv := NewTcpDelayServer(prefix+name, time.Millisecond, time.Millisecond, false, startTCPEcho(t),
+			WithLogger(zerolog.New(logs)))
+		runServer(t, srv)
+		if addr := srv.Addr().String(); addr != "@"+name {
+			t.Fatalf("%s: server listens on %q, want %q", prefix, addr, "@"+name)
+		}
+
+		conn, err := net.Dial("unix", "\x00"+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload := []byte("hello over an abstract socket")
+		got, _ := roundTripConn(t, conn, payload)
+		conn.Close()
+		if !bytes.Equal(got, payload) {
+			t.Fatalf("%s: got %q, want %q", prefix, got, payload)
+		}
+		checkNoNUL(t, logs)
+	}
+}
+
+func TestAbstractUnixUpstream(t *testing.T) {
+	name := abstractName("upstream")
+	ln, err := net.Listen("unix", "\x00"+name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	for _, prefix := range []string{unixAbstractPrefix, "@"} {
+		logs := &logLines{}
+		srv := NewTcpDelayServer("127.0.0.1:0", time.Millisecond, time.Millisecond, false, prefix+name,
+			WithLogger(zerolog.New(logs)))
+		addr := runServer(t, srv)
+		payload := []byte("hello to an abstract socket")
+		if got, _ := roundTrip(t, addr, payload); !bytes.Equal(got, payload) {
+			t.Fatalf("%s: got %q, want %q", prefix, got, payload)
+		}
+		checkNoNUL(t, logs)
+	}
+}
+
+// fails the test if a log line contains a NUL byte, which JSON escapes as \u0000
+func checkNoNUL(t *testing.T, logs *logLines) {
+	t.Helper()
+	logs.mu.Lock()
+	defer logs.mu.Unlock()
+	for _, line := range logs.lines {
+		if bytes.Contains(line, []byte(`\u0000`)) || bytes.IndexByte(line, 0) >= 0 {
+			t.Fatalf("log line contains a NUL byte: %s", line)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package proxy
+
+import (
+	"testing"
+)
+
+func TestSplitUnixAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+		ok   bool
+	}{
+		{"unix:/run/proxy.sock", "/run/proxy.sock", true},
+		{"unix-abstract:proxy", "\x00proxy", true},
+		{"@proxy", "\x00proxy", true},
+		{"127.0.0.1:8080", "", false},
+		{"[::1]:8080", "", false},
+	}
+	for _, test := range tests {
+		got, ok := SplitUnixAddr(test.addr)
+		if got != test.want || ok != test.ok {
+			t.Errorf("%s: got %q, %t, want %q, %t", test.addr, got, ok, test.want, test.ok)
+		}
+	}
+}
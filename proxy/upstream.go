@@ -0,0 +1,21 @@
+package proxy
+
+// implemented by servers whose upstream address can be changed at runtime, e.g. to repoint a proxy during failover
+// tests. sessions accepted after the change dial the new address, while running sessions keep their connections. with
+// an upstream handler, the address is only used in logs. SNI routes take precedence as before.
+type UpstreamConfigurable interface {
+	UpstreamAddr() string
+	SetUpstreamAddr(addr string)
+}
+
+func (s *tcpDelayServer) UpstreamAddr() string {
+	s.upstreamMu.RLock()
+	defer s.upstreamMu.RUnlock()
+	return s.upstreamAddr
+}
+
+func (s *tcpDelayServer) SetUpstreamAddr(addr string) {
+	s.upstreamMu.Lock()
+	defer s.upstreamMu.Unlock()
+	s.upstreamAddr = addr
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"github.com/rs/zerolog/log"
+	"github.com/wfscot/tcp-delay-proxy/proxy"
+	"time"
+)
+
+// the exit status of a replay whose upstream responded differently than in the recording
+const exitReplayDiverged = 3
+
+// replays a recorded session against the upstream, or the recorded upstream if none is given, and returns the exit
+// status
+func runReplay(ctx context.Context, dir string, upstreamAddr string, scale float64, upDelay time.Duration, downDelay time.Duration, writeTimeout time.Duration) int {
+	rec, err := proxy.LoadRecording(dir)
+	if err != nil {
+		log.Error().Err(err).Str("recording", dir).Msg("error while loading recording")
+		return 1
+	}
+	if upstreamAddr == "" {
+		upstreamAddr = rec.UpstreamAddr
+	}
+	if rec.Truncated {
+		log.Warn().Str("recording", dir).Msg("recording is truncated. replaying what was recorded.")
+	}
+
+	log.Info().Str("recording", dir).Str("upstreamAddr", upstreamAddr).Float64("scale", scale).Dur("recordedDuration", rec.Duration).Msg("replaying recording")
+	start := time.Now()
+	result, err := proxy.Replay(ctx, rec, upstreamAddr, scale, upDelay, downDelay, proxy.WithWriteTimeout(writeTimeout))
+	if err != nil {
+		log.Error().Err(err).Str("recording", dir).Msg("error while replaying recording")
+		return 1
+	}
+	if ctx.Err() != nil {
+		return 0
+	}
+
+	e := log.Info()
+	if result.Diverged() {
+		e = log.Warn()
+	}
+	e.Int64("sentBytes", result.SentBytes).Int64("receivedBytes", result.ReceivedBytes).Int64("recordedBytes", result.RecordedBytes).
+		Dur("duration", time.Since(start)).Bool("diverged", result.Diverged()).Msg("replay finished")
+	if result.Diverged() {
+		return exitReplayDiverged
+	}
+	return 0
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"github.com/wfscot/tcp-delay-proxy/proxy"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how long proxies removed from the config file get to finish their sessions before they are closed
+const reloadDrainTimeout = 30 * time.Second
+
+// a proxy definition and the server running it
+type runningProxy struct {
+	def proxyDef
+	srv proxy.Server
+
+	// whether the proxy was added by a config reload. failing to listen then only rejects the proxy.
+	added bool
+
+	// whether the proxy has been removed from the config and is draining
+	removed bool
+}
+
+// the upstream new sessions of the proxy dial, which may have been changed since it was started
+func (rp *runningProxy) upstreamAddr() string {
+	if uc, ok := rp.srv.(proxy.UpstreamConfigurable); ok {
+		return uc.UpstreamAddr()
+	}
+	return rp.def.upstreamAddr
+}
+
+// reported once a server's Run returns
+type proxyExit struct {
+	rp  *runningProxy
+	err error
+}
+
+// keeps track of the running proxies. all servers run under the same context and report to exits once they stop.
+type proxyRunner struct {
+	ctx       context.Context
+	newServer func(def proxyDef) proxy.Server
+	// runs a server until it stops. nil uses its Run method.
+	run   func(ctx context.Context, srv proxy.Server) error
+	exits chan proxyExit
+
+	mu      sync.Mutex
+	proxies []*runningProxy
+	// set once shutdown has been called
+	draining bool
+}
+
+func newProxyRunner(ctx context.Context, newServer func(def proxyDef) proxy.Server) *proxyRunner {
+	return &proxyRunner{ctx: ctx, newServer: newServer, exits: make(chan proxyExit)}
+}
+
+// creates a server for def and runs it in a routine
+func (r *proxyRunner) start(def proxyDef, added bool) *runningProxy {
+	rp := &runningProxy{def: def, srv: r.newServer(def), added: added}
+	r.mu.Lock()
+	r.proxies = append(r.proxies, rp)
+	r.mu.Unlock()
+	go func() {
+		var err error
+		if r.run != nil {
+			err = r.run(r.ctx, rp.srv)
+		} else {
+			err = rp.srv.Run(r.ctx)
+		}
+		r.exits <- proxyExit{rp, err}
+	}()
+	return rp
+}
+
+// forgets a proxy whose server has stopped
+func (r *proxyRunner) remove(rp *runningProxy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, p := range r.proxies {
+		if p == rp {
+			r.proxies = append(r.proxies[:i], r.proxies[i+1:]...)
+			return
+		}
+	}
+}
+
+// the number of servers that haven't stopped yet, including draining ones
+func (r *proxyRunner) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.proxies)
+}
+
+// shuts down every server, including ones already draining after a reload, and gives their sessions until timeout to
+// finish. returns false if the deadline was hit before all of them did.
+func (r *proxyRunner) shutdown(timeout time.Duration) bool {
+	r.mu.Lock()
+	r.draining = true
+	proxies := append([]*runningProxy(nil), r.proxies...)
+	r.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var expired int32
+	wg := sync.WaitGroup{}
+	for _, rp := range proxies {
+		wg.Add(1)
+		go func(rp *runningProxy) {
+			if rp.srv.Shutdown(ctx) != nil {
+				atomic.StoreInt32(&expired, 1)
+			}
+			wg.Done()
+		}(rp)
+	}
+	wg.Wait()
+	return atomic.LoadInt32(&expired) == 0
+}
+
+// whether shutdown has been called
+func (r *proxyRunner) isDraining() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.draining
+}
+
+// the number of open sessions of all servers that can list them
+func (r *proxyRunner) numSessions() int {
+	r.mu.Lock()
+	proxies := append([]*runningProxy(nil), r.proxies...)
+	r.mu.Unlock()
+	n := 0
+	for _, rp := range proxies {
+		if lister, ok := rp.srv.(proxy.SessionLister); ok {
+			n += len(lister.Sessions())
+		}
+	}
+	return n
+}
+
+// the proxies that are part of the current config, in definition order
+func (r *proxyRunner) active() []*runningProxy {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	active := make([]*runningProxy, 0, len(r.proxies))
+	for _, rp := range r.proxies {
+		if !rp.removed {
+			active = append(active, rp)
+		}
+	}
+	return active
+}
+
+// applies a new set of proxy definitions. proxies are identified by their listen address: new ones are started,
+// removed ones are drained and closed, and changed delays and upstreams apply to sessions accepted from now on. other
+// changes to a running proxy are rejected. the whole set is validated first, so a rejected definition leaves the running proxies
+// untouched.
+func (r *proxyRunner) apply(defs []proxyDef, checkDef func(def proxyDef) error) error {
+	running := map[string]*runningProxy{}
+	for _, rp := range r.active() {
+		running[rp.def.listenAddr] = rp
+	}
+
+	seen := map[string]bool{}
+	for _, def := range defs {
+		if seen[def.listenAddr] {
+			return fmt.Errorf("%s: listen address %s is used more than once", def.name, def.listenAddr)
+		}
+		seen[def.listenAddr] = true
+		if err := checkDef(def); err != nil {
+			return fmt.Errorf("%s: %s", def.name, err)
+		}
+		// only the delays and the upstream can be changed on a running server
+		if rp, ok := running[def.listenAddr]; ok {
+			if _, ok := rp.srv.(proxy.UpstreamConfigurable); !ok && def.upstreamAddr != rp.upstreamAddr() {
+				return fmt.Errorf("%s: changing the upstream of %s from %s to %s requires a restart", def.name, def.listenAddr, rp.upstreamAddr(), def.upstreamAddr)
+			}
+			if def.rerandomizeInterval != rp.def.rerandomizeInterval {
+				return fmt.Errorf("%s: changing the rerandomizeInterval of %s requires a restart", def.name, def.listenAddr)
+			}
+			if !sameDuration(def.jitter, rp.def.jitter) || !sameRate(def.upBandwidth, rp.def.upBandwidth) || !sameRate(def.downBandwidth, rp.def.downBandwidth) {
+				return fmt.Errorf("%s: changing the jitter or bandwidth of %s requires a restart", def.name, def.listenAddr)
+			}
+		}
+	}
+
+	for _, rp := range running {
+		if seen[rp.def.listenAddr] {
+			continue
+		}
+		log.Info().Str("listenAddr", rp.def.listenAddr).Str("upstreamAddr", rp.upstreamAddr()).Dur("drainTimeout", reloadDrainTimeout).Msg("proxy removed from config. draining.")
+		r.mu.Lock()
+		rp.removed = true
+		r.mu.Unlock()
+		go func(rp *runningProxy) {
+			ctx, cancel := context.WithTimeout(context.Background(), reloadDrainTimeout)
+			defer cancel()
+			rp.srv.Shutdown(ctx)
+		}(rp)
+	}
+
+	for _, def := range defs {
+		rp, ok := running[def.listenAddr]
+		if !ok {
+			log.Info().Str("listenAddr", def.listenAddr).Str("upstreamAddr", def.upstreamAddr).Msg("proxy added to config. starting.")
+			r.start(def, true)
+			continue
+		}
+		// compare against the server rather than the old definition in case the delays or the upstream were changed via
+		// the admin API
+		if uc, ok := rp.srv.(proxy.UpstreamConfigurable); ok && uc.UpstreamAddr() != def.upstreamAddr {
+			log.Info().Str("listenAddr", def.listenAddr).Str("oldUpstreamAddr", uc.UpstreamAddr()).Str("upstreamAddr", def.upstreamAddr).
+				Msg("proxy upstream changed in config. new sessions use it.")
+			uc.SetUpstreamAddr(def.upstreamAddr)
+		}
+		settings := proxy.DelaySettings{UpDelay: def.upDelay, DownDelay: def.downDelay, RandomizeDelay: def.randomizeDelay}
+		if dc, ok := rp.srv.(proxy.DelayConfigurable); ok && dc.DelaySettings() != settings {
+			log.Info().Str("listenAddr", def.listenAddr).Dur("upDelay", def.upDelay).Dur("downDelay", def.downDelay).
+				Bool("randomizeDelay", def.randomizeDelay).Msg("proxy delays changed in config")
+			dc.SetDelaySettings(settings, false)
+		}
+	}
+
+	return nil
+}
+
+// compare optional settings of proxy definitions
+func sameDuration(a *time.Duration, b *time.Duration) bool {
+	return (a == nil) == (b == nil) && (a == nil || *a == *b)
+}
+
+func sameRate(a *int64, b *int64) bool {
+	return (a == nil) == (b == nil) && (a == nil || *a == *b)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"github.com/wfscot/tcp-delay-proxy/proxy"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a scenario file changes the delay settings of all proxies at given times after startup, e.g. for unattended soak
+// tests. each line holds a step, and several steps can share a line separated by semicolons. # starts a comment.
+//
+//	at 00:30 set down=500ms
+//	at 01:00 set up=100ms down=100ms; at 01:30 set randomize=true
+//	at 02:00 reset
+//
+// times are mm:ss, hh:mm:ss or a duration like 90s, and steps must be in order. set changes the given settings, which
+// are up, down, delay (both up and down) and randomize. reset returns to the settings the proxies started with. changes
+// apply to running sessions as well.
+
+type scenarioStep struct {
+	line int
+	at   time.Duration
+	// the settings changed by set. nil leaves them as they are.
+	upDelay   *time.Duration
+	downDelay *time.Duration
+	randomize *bool
+	reset     bool
+	// the step as written, for the log
+	text string
+}
+
+// reads a scenario file. errors name the offending line.
+func loadScenario(path string) ([]scenarioStep, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	steps, err := parseScenario(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return steps, nil
+}
+
+func parseScenario(r io.Reader) ([]scenarioStep, error) {
+	var steps []scenarioStep
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := s.Text()
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = text[:i]
+		}
+		for _, stmt := range strings.Split(text, ";") {
+			stmt = strings.TrimSpace(stmt)
+			if stmt == "" {
+				continue
+			}
+			step, err := parseScenarioStep(stmt)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", line, err)
+			}
+			if len(steps) > 0 && step.at < steps[len(steps)-1].at {
+				return nil, fmt.Errorf("line %d: step at %s comes before the previous one at %s", line, step.at, steps[len(steps)-1].at)
+			}
+			step.line = line
+			steps = append(steps, step)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("no steps")
+	}
+	return steps, nil
+}
+
+func parseScenarioStep(stmt string) (scenarioStep, error) {
+	step := scenarioStep{text: stmt}
+	fields := strings.Fields(stmt)
+	if len(fields) < 3 || fields[0] != "at" {
+		return step, fmt.Errorf("expected \"at <time> set <setting>=<value> ...\" or \"at <time> reset\" but got %q", stmt)
+	}
+	at, err := parseScenarioTime(fields[1])
+	if err != nil {
+		return step, err
+	}
+	step.at = at
+
+	switch fields[2] {
+	case "reset":
+		if len(fields) != 3 {
+			return step, fmt.Errorf("reset takes no settings")
+		}
+		step.reset = true
+
+	case "set":
+		if len(fields) == 3 {
+			return step, fmt.Errorf("set needs at least one setting")
+		}
+		for _, kv := range fields[3:] {
+			i := strings.Index(kv, "=")
+			if i < 0 {
+				return step, fmt.Errorf("expected <setting>=<value> but got %q", kv)
+			}
+			key, value := kv[:i], kv[i+1:]
+			switch key {
+			case "up", "down", "delay":
+				d, err := time.ParseDuration(value)
+				if err != nil || d < 0 {
+					return step, fmt.Errorf("invalid %s delay %q", key, value)
+				}
+				if key != "down" {
+					step.upDelay = &d
+				}
+				if key != "up" {
+					step.downDelay = &d
+				}
+			case "randomize":
+				b, err := strconv.ParseBool(value)
+				if err != nil {
+					return step, fmt.Errorf("invalid randomize value %q", value)
+				}
+				step.randomize = &b
+			default:
+				return step, fmt.Errorf("unknown setting %q. only up, down, delay and randomize can be changed at runtime", key)
+			}
+		}
+
+	default:
+		return step, fmt.Errorf("unknown action %q. expected set or reset", fields[2])
+	}
+	return step, nil
+}
+
+// parses mm:ss, hh:mm:ss or a duration
+func parseScenarioTime(s string) (time.Duration, error) {
+	if !strings.Contains(s, ":") {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return 0, fmt.Errorf("invalid time %q", s)
+		}
+		return d, nil
+	}
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	var d time.Duration
+	for i, p := range parts {
+		v, err := strconv.ParseUint(p, 10, 32)
+		if err != nil || (i > 0 && v >= 60) {
+			return 0, fmt.Errorf("invalid time %q", s)
+		}
+		d = d*60 + time.Duration(v)*time.Second
+	}
+	return d, nil
+}
+
+// runs the scenario against the running proxies. with loop, it starts over once the last step has been applied, going
+// back to the starting settings first.
+func runScenario(ctx context.Context, runner *proxyRunner, steps []scenarioStep, loop bool) {
+	// the settings to reset to. proxies added by a config reload reset to what they had when first seen.
+	initial := make(map[*runningProxy]proxy.DelaySettings)
+	remember := func() {
+		for _, rp := range runner.active() {
+			if dc, ok := rp.srv.(proxy.DelayConfigurable); ok {
+				if _, ok := initial[rp]; !ok {
+					initial[rp] = dc.DelaySettings()
+				}
+			}
+		}
+	}
+	remember()
+
+	for round := 1; ; round++ {
+		start := time.Now()
+		for _, step := range steps {
+			t := time.NewTimer(time.Until(start.Add(step.at)))
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return
+			case <-t.C:
+			}
+			remember()
+			applyScenarioStep(runner, step, initial, round)
+		}
+		if !loop {
+			log.Info().Msg("scenario finished")
+			return
+		}
+		log.Info().Int("round", round).Msg("scenario finished. starting over.")
+		applyScenarioStep(runner, scenarioStep{reset: true, text: "reset before starting over"}, initial, round)
+	}
+}
+
+func applyScenarioStep(runner *proxyRunner, step scenarioStep, initial map[*runningProxy]proxy.DelaySettings, round int) {
+	for _, rp := range runner.active() {
+		dc, ok := rp.srv.(proxy.DelayConfigurable)
+		if !ok {
+			continue
+		}
+		settings := dc.DelaySettings()
+		if step.reset {
+			settings = initial[rp]
+		}
+		if step.upDelay != nil {
+			settings.UpDelay = *step.upDelay
+		}
+		if step.downDelay != nil {
+			settings.DownDelay = *step.downDelay
+		}
+		if step.randomize != nil {
+			settings.RandomizeDelay = *step.randomize
+		}
+		dc.SetDelaySettings(settings, true)
+		log.Info().Str("listenAddr", rp.def.listenAddr).Int("line", step.line).Str("step", step.text).Int("round", round).
+			Dur("upDelay", settings.UpDelay).Dur("downDelay", settings.DownDelay).Bool("randomizeDelay", settings.RandomizeDelay).
+			Msg("applied scenario step")
+	}
+}
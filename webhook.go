@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"github.com/wfscot/tcp-delay-proxy/proxy"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	// events waiting to be delivered. once the queue is full, new events are dropped rather than holding up sessions.
+	webhookQueueSize = 1024
+	// limit for delivering a single event
+	webhookTimeout = 5 * time.Second
+)
+
+// the JSON document POSTed to --webhook when a session starts or ends. byte counts, duration and error are only set
+// for end events.
+type webhookEvent struct {
+	Event        string    `json:"event"`
+	Time         time.Time `json:"time"`
+	SessionID    string    `json:"sessionId"`
+	Listen       string    `json:"listen"`
+	ClientAddr   string    `json:"clientAddr"`
+	UpstreamAddr string    `json:"upstreamAddr"`
+	UpBytes      int64     `json:"upBytes,omitempty"`
+	DownBytes    int64     `json:"downBytes,omitempty"`
+	Duration     string    `json:"duration,omitempty"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// delivers session events to a webhook from a single routine. each event is tried once.
+type webhook struct {
+	url    string
+	client *http.Client
+	queue  chan webhookEvent
+}
+
+func newWebhook(url string) *webhook {
+	return &webhook{
+		url:    url,
+		client: &http.Client{Timeout: webhookTimeout},
+		queue:  make(chan webhookEvent, webhookQueueSize),
+	}
+}
+
+// delivers queued events until the context is cancelled
+func (w *webhook) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case ev := <-w.queue:
+			if err := w.post(ev); err != nil {
+				log.Warn().Err(err).Str("event", ev.Event).Str("sessionId", ev.SessionID).Msg("error while delivering webhook event")
+			}
+		}
+	}
+}
+
+func (w *webhook) post(ev webhookEvent) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook %s returned %s", w.url, resp.Status)
+	}
+	return nil
+}
+
+// queues an event without blocking
+func (w *webhook) send(ev webhookEvent) {
+	select {
+	case w.queue <- ev:
+	default:
+		log.Warn().Str("event", ev.Event).Str("sessionId", ev.SessionID).Msg("webhook queue full. dropping event.")
+	}
+}
+
+// returns hooks reporting the sessions of the proxy listening on listenAddr. session ids are the ones in the logs and
+// the admin API.
+func (w *webhook) hooks(listenAddr string) proxy.Hooks {
+	return proxy.Hooks{
+		OnAccept: func(ss proxy.SessionSnapshot) {
+			w.send(webhookEvent{
+				Event:        "start",
+				Time:         ss.StartTime,
+				SessionID:    ss.ID,
+				Listen:       listenAddr,
+				ClientAddr:   ss.ClientAddr,
+				UpstreamAddr: ss.UpstreamAddr,
+			})
+		},
+		OnSessionEnd: func(stats proxy.SessionStats) {
+			ev := webhookEvent{
+				Event:        "end",
+				Time:         stats.EndTime,
+				SessionID:    stats.ID,
+				Listen:       listenAddr,
+				ClientAddr:   stats.ClientAddr,
+				UpstreamAddr: stats.UpstreamAddr,
+				UpBytes:      stats.UpBytes,
+				DownBytes:    stats.DownBytes,
+				Duration:     stats.EndTime.Sub(stats.StartTime).String(),
+			}
+			if stats.Err != nil {
+				ev.Error = stats.Err.Error()
+			}
+			w.send(ev)
+		},
+	}
+}